@@ -0,0 +1,277 @@
+package irckit
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sorcix/irc"
+)
+
+var batchCount uint64
+
+// nextBatchRef returns a unique reference tag for a BATCH.
+func nextBatchRef() string {
+	return strconv.FormatUint(atomic.AddUint64(&batchCount, 1), 36)
+}
+
+// EncodeBatch sends the messages wrapped in a BATCH of the given type on
+// behalf of Prefixer. Users who have not negotiated the batch capability
+// receive the messages without the BATCH framing.
+func (user *User) EncodeBatch(from Prefixer, batchType string, msgs ...*irc.Message) error {
+	batch := make([]taggedMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		batch = append(batch, taggedMessage{msg: msg})
+	}
+	return user.encodeBatch(true, from, batchType, nil, batch)
+}
+
+// encodeBatch sends the messages, with their own tags, in a BATCH whose
+// opening message has the given tags. The batch is buffered if it's a
+// response to a labeled command, as with EncodeTags.
+func (user *User) encodeBatch(response bool, from Prefixer, batchType string, tags Tags, msgs []taggedMessage, params ...string) error {
+	if !user.HasCap(CapBatch) {
+		for _, m := range msgs {
+			if err := user.encode(response, m.tags, m.msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ref := nextBatchRef()
+	err := user.encode(response, tags, &irc.Message{
+		Prefix:  from.Prefix(),
+		Command: cmdBatch,
+		Params:  append([]string{"+" + ref, batchType}, params...),
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		tags := Tags{"batch": ref}
+		for k, v := range m.tags {
+			tags[k] = v
+		}
+		if err := user.encode(response, tags, m.msg); err != nil {
+			return err
+		}
+	}
+	return user.encode(response, nil, &irc.Message{
+		Prefix:  from.Prefix(),
+		Command: cmdBatch,
+		Params:  []string{"-" + ref},
+	})
+}
+
+// Limits of a draft/multiline BATCH received from a User.
+const (
+	multilineMaxBytes = 4096
+	multilineMaxLines = 24
+)
+
+// tagMultilineConcat marks a line of a draft/multiline BATCH which continues
+// the previous line, rather than starting a new one.
+const tagMultilineConcat = "draft/multiline-concat"
+
+// multilineLine is a line of a draft/multiline message.
+type multilineLine struct {
+	text   string
+	concat bool
+}
+
+// multilineBatch is a draft/multiline BATCH which is being received.
+type multilineBatch struct {
+	ref    string
+	target string
+	lines  []multilineLine
+	size   int  // Bytes of text in lines
+	failed bool // Remaining lines are discarded
+}
+
+// joinMultiline returns the text of each line, with concatenated lines joined
+// to the ones they continue.
+func joinMultiline(lines []multilineLine) []string {
+	r := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if line.concat && len(r) > 0 {
+			r[len(r)-1] += line.text
+			continue
+		}
+		r = append(r, line.text)
+	}
+	return r
+}
+
+// multilineChannel is implemented by a Channel which can deliver a
+// draft/multiline message as one.
+type multilineChannel interface {
+	messageMultiline(from *User, lines []multilineLine)
+}
+
+// relayMultiline sends a draft/multiline message from another User, as a
+// BATCH if this User negotiated draft/multiline, or otherwise as a PRIVMSG
+// for each line once concatenated lines are joined.
+func (user *User) relayMultiline(from *User, msgid string, target string, lines []multilineLine) error {
+	if !user.HasCap(CapMultiline) || !user.HasCap(CapBatch) {
+		for i, text := range joinMultiline(lines) {
+			if i > 0 {
+				msgid = newMsgID()
+			}
+			err := user.relayMsg(from, msgid, &irc.Message{
+				Prefix:   from.Prefix(),
+				Command:  irc.PRIVMSG,
+				Params:   []string{target},
+				Trailing: text,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	batch := make([]taggedMessage, 0, len(lines))
+	for _, line := range lines {
+		m := taggedMessage{msg: &irc.Message{
+			Prefix:   from.Prefix(),
+			Command:  irc.PRIVMSG,
+			Params:   []string{target},
+			Trailing: line.text,
+		}}
+		if line.concat {
+			m.tags = Tags{tagMultilineConcat: ""}
+		}
+		batch = append(batch, m)
+	}
+	tags := user.relayTags(from)
+	if user.HasCap(CapMessageTags) {
+		if tags == nil {
+			tags = Tags{}
+		}
+		tags["msgid"] = msgid
+	}
+	return user.encodeBatch(from == user, from, batchMultiline, tags, batch, target)
+}
+
+// failBatch returns a FAIL reply for a BATCH received from a User.
+func failBatch(s Server, code string, text string, context ...string) *irc.Message {
+	return &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  cmdFail,
+		Params:   append([]string{cmdBatch, code}, context...),
+		Trailing: text,
+	}
+}
+
+// receiveBatch handles BATCH commands from the User and the lines of their
+// draft/multiline batches, which are delivered once the batch is closed.
+// Returns whether msg was consumed.
+func (s *server) receiveBatch(u *User, tags Tags, msg *irc.Message) bool {
+	b := u.multiline
+	if b != nil && tags["batch"] == b.ref {
+		s.receiveMultiline(u, b, tags, msg)
+		return true
+	}
+	if msg.Command != cmdBatch || len(msg.Params) == 0 {
+		return false
+	}
+
+	ref := msg.Params[0]
+	switch {
+	case strings.HasPrefix(ref, "+"):
+		if b != nil {
+			u.multiline = nil
+			u.Encode(failBatch(s, "MULTILINE_INVALID", "Nested batches are not supported"))
+			return true
+		}
+		if len(msg.Params) < 3 || msg.Params[1] != batchMultiline || !u.HasCap(CapMultiline) {
+			u.Encode(failBatch(s, "INVALID_TYPE", "Unsupported batch type"))
+			return true
+		}
+		u.multiline = &multilineBatch{ref: ref[1:], target: msg.Params[2]}
+	case strings.HasPrefix(ref, "-") && b != nil && ref[1:] == b.ref:
+		u.multiline = nil
+		if !b.failed && len(b.lines) > 0 {
+			s.deliverMultiline(u, b)
+		}
+	}
+	return true
+}
+
+// receiveMultiline adds a line to the batch, or marks it as failed if the
+// line is invalid or exceeds the limits.
+func (s *server) receiveMultiline(u *User, b *multilineBatch, tags Tags, msg *irc.Message) {
+	if b.failed {
+		return
+	}
+	text := msg.Trailing
+	if text == "" && len(msg.Params) > 1 {
+		text = msg.Params[1]
+	}
+	_, concat := tags[tagMultilineConcat]
+	switch {
+	case msg.Command != irc.PRIVMSG || len(msg.Params) == 0 || !strings.EqualFold(msg.Params[0], b.target):
+		b.failed = true
+		u.Encode(failBatch(s, "MULTILINE_INVALID", "Lines must be a PRIVMSG to the target of the batch"))
+	case len(b.lines) >= multilineMaxLines:
+		b.failed = true
+		u.Encode(failBatch(s, "MULTILINE_MAX_LINES", "Multiline batch max-lines exceeded", strconv.Itoa(multilineMaxLines)))
+	case b.size+len(text) > multilineMaxBytes:
+		b.failed = true
+		u.Encode(failBatch(s, "MULTILINE_MAX_BYTES", "Multiline batch max-bytes exceeded", strconv.Itoa(multilineMaxBytes)))
+	default:
+		b.size += len(text)
+		b.lines = append(b.lines, multilineLine{text: text, concat: concat})
+	}
+}
+
+// deliverMultiline sends a completed draft/multiline batch to its target,
+// like a PRIVMSG of each of its joined texts. MaxMsgLen applies to the total
+// text of the batch.
+func (s *server) deliverMultiline(u *User, b *multilineBatch) {
+	lines, ok := limitMultiline(s.Config(), b.lines)
+	if !ok {
+		u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  errInputTooLong,
+			Params:   []string{u.Nick},
+			Trailing: "Input line was too long",
+		})
+		return
+	}
+	msg := &irc.Message{
+		Prefix:  u.Prefix(),
+		Command: irc.PRIVMSG,
+		Params:  []string{b.target},
+	}
+	deliverMsg(s, u, msg, joinMultiline(lines), lines)
+}
+
+// limitMultiline applies MaxMsgLen to the total text of the lines, cutting
+// them off once it's exceeded, or returns false if the MsgLenPolicy is to
+// reject them.
+func limitMultiline(config ServerConfig, lines []multilineLine) ([]multilineLine, bool) {
+	size := 0
+	for _, line := range lines {
+		size += len(line.text)
+	}
+	if config.MaxMsgLen <= 0 || size <= config.MaxMsgLen {
+		return lines, true
+	}
+	if config.MsgLenPolicy == RejectMsg {
+		return nil, false
+	}
+	// Lines are kept while there's room left for the suffix after them.
+	n := config.MaxMsgLen - len(truncatedSuffix)
+	r := make([]multilineLine, 0, len(lines))
+	for _, line := range lines {
+		if len(line.text) > n {
+			line.text = truncateText(line.text, n) + truncatedSuffix
+			return append(r, line), true
+		}
+		n -= len(line.text)
+		r = append(r, line)
+	}
+	return r, true
+}
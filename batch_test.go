@@ -0,0 +1,166 @@
+package irckit
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestUserEncodeBatch(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	msgs := []*irc.Message{
+		{Prefix: srv.Prefix(), Command: irc.NOTICE, Params: []string{"foo"}, Trailing: "one"},
+		{Prefix: srv.Prefix(), Command: irc.NOTICE, Params: []string{"foo"}, Trailing: "two"},
+	}
+
+	c1 := NewConnMock("client1", 10)
+	u1 := NewUser(c1)
+	u1.addCap(CapBatch)
+	if err := u1.EncodeBatch(srv, "example", msgs...); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, c1, "^:testserver BATCH \\+\\w+ example$")
+	expectReply(t, c1, "^@batch=\\w+ :testserver NOTICE foo :one$")
+	expectReply(t, c1, "^@batch=\\w+ :testserver NOTICE foo :two$")
+	expectReply(t, c1, "^:testserver BATCH -\\w+$")
+
+	c2 := NewConnMock("client2", 10)
+	u2 := NewUser(c2)
+	if err := u2.EncodeBatch(srv, "example", msgs...); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, c2, "^:testserver NOTICE foo :one$")
+	expectReply(t, c2, "^:testserver NOTICE foo :two$")
+	if len(c2.send) != 0 {
+		t.Errorf("expected no BATCH framing; got: %v", <-c2.send)
+	}
+}
+
+func TestServerMultiline(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 40)
+		conns[nick] = c
+		u := NewUser(c)
+		if nick != "qux" {
+			u.addCap(CapBatch)
+			u.addCap(CapMultiline)
+		}
+		go srv.Connect(u)
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+	for _, c := range []*mockConn{foo, baz, qux} {
+		c.receive <- irc.ParseMessage("JOIN #chat")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, baz, irc.JOIN)
+
+	foo.receiveLine("BATCH +abc draft/multiline #chat")
+	foo.receiveLine("@batch=abc PRIVMSG #chat :hello")
+	foo.receiveLine("@batch=abc;draft/multiline-concat PRIVMSG #chat :, world")
+	foo.receiveLine("@batch=abc PRIVMSG #chat :second line")
+	foo.receiveLine("BATCH -abc")
+
+	expectReply(t, baz, "^:foo!root@foohost BATCH \\+\\w+ draft/multiline #chat$")
+	expectReply(t, baz, "^@batch=\\w+ :foo!root@foohost PRIVMSG #chat :hello$")
+	expectReply(t, baz, "^@batch=\\w+;draft/multiline-concat :foo!root@foohost PRIVMSG #chat :, world$")
+	expectReply(t, baz, "^@batch=\\w+ :foo!root@foohost PRIVMSG #chat :second line$")
+	expectReply(t, baz, "^:foo!root@foohost BATCH -\\w+$")
+
+	expectReply(t, qux, "^:foo!root@foohost PRIVMSG #chat :hello, world$")
+	expectReply(t, qux, "^:foo!root@foohost PRIVMSG #chat :second line$")
+
+	// Lines to another target fail the batch, and nothing is delivered.
+	foo.receiveLine("BATCH +def draft/multiline #chat")
+	foo.receiveLine("@batch=def PRIVMSG baz :hi")
+	expectReply(t, foo, "^:testserver FAIL BATCH MULTILINE_INVALID ")
+	foo.receiveLine("@batch=def PRIVMSG #chat :dropped")
+	foo.receiveLine("BATCH -def")
+
+	foo.receive <- irc.ParseMessage("PRIVMSG #chat :after")
+	expectReply(t, qux, "^:foo!root@foohost PRIVMSG #chat :after$")
+}
+
+func TestServerMultilineLimits(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := ServerConfig{
+		Name:         testServerName,
+		MaxMsgLen:    20,
+		MsgLenPolicy: RejectMsg,
+		OfflineStore: MemoryOfflineStore(10),
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 40)
+		conns[nick] = c
+		u := NewUser(c)
+		u.addCap(CapBatch)
+		u.addCap(CapMultiline)
+		go srv.Connect(u)
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+
+	// Lines which fit on their own are still limited by their total.
+	foo.receiveLine("BATCH +abc draft/multiline baz")
+	foo.receiveLine("@batch=abc PRIVMSG baz :twelve chars")
+	foo.receiveLine("@batch=abc PRIVMSG baz :twelve chars")
+	foo.receiveLine("BATCH -abc")
+	expectReply(t, foo, "^:testserver 417 foo :Input line was too long$")
+
+	// Away replies are sent as for a PRIVMSG.
+	baz.receive <- irc.ParseMessage("AWAY :gone")
+	receiveReply(t, baz)
+	foo.receiveLine("BATCH +def draft/multiline baz")
+	foo.receiveLine("@batch=def PRIVMSG baz :hi")
+	foo.receiveLine("BATCH -def")
+	expectReply(t, baz, "^:foo!root@foohost BATCH \\+\\w+ draft/multiline baz$")
+	expectReply(t, foo, "^:testserver 301 foo baz :gone$")
+
+	// Batches to offline users are queued.
+	foo.receiveLine("BATCH +ghi draft/multiline nobody")
+	foo.receiveLine("@batch=ghi PRIVMSG nobody :are you there?")
+	foo.receiveLine("BATCH -ghi")
+	foo.receive <- irc.ParseMessage("PRIVMSG nobody :still there?")
+	foo.receive <- irc.ParseMessage("PING sync")
+	expectReply(t, foo, "PONG")
+	if msgs := srv.Config().OfflineStore.Drain("nobody"); len(msgs) != 2 {
+		t.Errorf("got %d queued messages; want 2", len(msgs))
+	}
+}
+
+func TestLimitMultiline(t *testing.T) {
+	lines := []multilineLine{{text: "hello"}, {text: ", world", concat: true}, {text: "bye"}}
+	config := ServerConfig{MaxMsgLen: 10}
+	got, ok := limitMultiline(config, lines)
+	if !ok {
+		t.Fatal("expected lines to be truncated")
+	}
+	if texts := joinMultiline(got); !reflect.DeepEqual(texts, []string{"hello, ..."}) {
+		t.Errorf("got %q", texts)
+	}
+	config.MsgLenPolicy = RejectMsg
+	if _, ok := limitMultiline(config, lines); ok {
+		t.Error("expected lines to be rejected")
+	}
+}
@@ -1,7 +1,9 @@
 package irckit
 
 import (
+	"errors"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -9,12 +11,32 @@ import (
 	"github.com/sorcix/irc"
 )
 
+// ErrNotOnChannel is returned when a User acts on a Channel they're not in.
+var ErrNotOnChannel = errors.New("not on channel")
+
+// ErrUserNotOnChannel is returned when the target of an action on a Channel is
+// not in it.
+var ErrUserNotOnChannel = errors.New("user not on channel")
+
+// ErrNoPrivileges is returned when a User lacks the privileges for an action on
+// a Channel.
+var ErrNoPrivileges = errors.New("no privileges")
+
+// ErrChannelFull is returned by Join when the Channel has reached its limit of
+// Users.
+var ErrChannelFull = errors.New("channel is full")
+
+// ErrBadKey is returned by Join when the Channel has a key which the User
+// didn't give.
+var ErrBadKey = errors.New("bad channel key")
+
 // Channel is a representation of a room in our server
 type Channel interface {
 	Prefixer
 	Publisher
 
-	// ID is a normalized unique identifier for the channel
+	// ID is a normalized unique identifier for the channel, as normalized by
+	// the server's Normalize. String returns the name as it was created.
 	ID() string
 
 	// Created returns the time when the Channel was created.
@@ -32,17 +54,42 @@ type Channel interface {
 	// Invite prompts the User to join the Channel on behalf of Prefixer.
 	Invite(from Prefixer, u *User) error
 
-	// Join introduces the User to the channel (handler for JOIN).
+	// Join introduces the User to the channel (handler for JOIN). Returns
+	// ErrChannelFull if the channel has reached its limit of Users, or
+	// ErrBadKey if it has a key, unless the User is an operator and
+	// ServerConfig.OperOverride is set.
 	Join(u *User) error
 
-	// Part removes the User from the channel (handler for PART).
+	// Part removes the User from the channel (handler for PART). When the
+	// last User leaves, EmptyChanEvent is published to the channel's
+	// subscribers; the channel doesn't unlink itself, that's left to the
+	// Server (see DiscardEmpty).
 	Part(u *User, text string)
 
 	// Message transmits a message from a User to the channel (handler for PRIVMSG).
 	Message(u *User, text string)
 
-	// Topic sets the topic of the channel (handler for TOPIC).
-	Topic(from Prefixer, text string)
+	// Topic returns the topic of the channel.
+	Topic() string
+
+	// SetTopic sets the topic of the channel on behalf of the User (handler
+	// for TOPIC). A nil User bypasses permission checks, for admin use.
+	SetTopic(setter *User, text string) error
+
+	// Mode returns the parameter of a channel mode, which is empty for
+	// flags, and whether the mode is set.
+	Mode(mode byte) (string, bool)
+
+	// SetMode sets a channel mode along with its parameter, which is empty
+	// for flags. Members are not notified.
+	SetMode(mode byte, param string)
+
+	// UnsetMode unsets a channel mode. Members are not notified.
+	UnsetMode(mode byte)
+
+	// Modes returns the set modes of the channel, followed by their
+	// parameters, in the form "+ps".
+	Modes() string
 
 	// Unlink will disassociate the Channel from its Server.
 	Unlink()
@@ -54,33 +101,229 @@ type Channel interface {
 	String() string
 }
 
+// Kicker is implemented by Channels which can remove members other than by
+// their own PART.
+type Kicker interface {
+	// Kick removes the target from the channel on behalf of a User (handler
+	// for KICK), notifying the members. A nil User bypasses permission
+	// checks, for admin use.
+	Kick(by *User, target *User, reason string) error
+
+	// Remove removes the User from the channel without notifying the
+	// members, for when they're notified otherwise (such as by QUIT).
+	Remove(u *User)
+}
+
+// MemberPrefixer is implemented by Channels which show the status of their
+// members in NAMES.
+type MemberPrefixer interface {
+	// NamesWithPrefix returns a sorted slice of Nicks in the channel, each
+	// preceded by its membership prefix as rendered in RPL_NAMREPLY.
+	NamesWithPrefix() []string
+}
+
+// Redacter is implemented by Channels which can redact recent messages.
+type Redacter interface {
+	// Redact notifies the members who negotiated draft/message-redaction
+	// that the recent message with the given ID was removed.
+	Redact(msgid string)
+}
+
+// ReasonCloser is implemented by Channels which can tell their members why
+// they're closed.
+type ReasonCloser interface {
+	// CloseWithReason evicts all the members with a KICK carrying the
+	// reason, so that clients show why they were removed, and closes the
+	// channel's subscribers. Close evicts them with a PART instead.
+	CloseWithReason(reason string) error
+}
+
+// namesWithPrefix returns the Nicks of the channel with their membership
+// prefixes, or without them if the channel doesn't keep any.
+func namesWithPrefix(ch Channel) []string {
+	if mp, ok := ch.(MemberPrefixer); ok {
+		return mp.NamesWithPrefix()
+	}
+	return ch.Names()
+}
+
+// Channel modes supported by the server.
+const (
+	// ModeKey requires Users to give its parameter as the key to join the
+	// channel.
+	ModeKey byte = 'k'
+	// ModeForward redirects Users who can't join the channel to the channel
+	// in its parameter.
+	ModeForward byte = 'f'
+	// ModeLimit caps the number of Users in the channel to its parameter.
+	ModeLimit byte = 'l'
+	// ModePrivate hides the name and topic of the channel from non-members
+	// in LIST.
+	ModePrivate byte = 'p'
+	// ModeSecret conceals the existence of the channel from non-members.
+	ModeSecret byte = 's'
+)
+
+// Member status modes, which are given to members of a channel, from the
+// highest rank to the lowest.
+const (
+	// ModeOwner marks a channel owner, shown with the "~" prefix.
+	ModeOwner byte = 'q'
+	// ModeAdmin marks a channel admin, shown with the "&" prefix.
+	ModeAdmin byte = 'a'
+	// ModeOp marks a channel operator, shown with the "@" prefix.
+	ModeOp byte = 'o'
+	// ModeVoice marks a voiced member, shown with the "+" prefix.
+	ModeVoice byte = 'v'
+)
+
+// memberModes are the supported member status modes, from the highest rank to
+// the lowest, aligned with memberPrefixes.
+const memberModes = "qaov"
+
+// channelFlags are the supported channel modes which don't take a parameter.
+const channelFlags = "ps"
+
+// channelParamModes are the supported channel modes which take a parameter
+// when they're set, but not when they're unset.
+const channelParamModes = "fl"
+
+// channelKeyModes are the supported channel modes which take a parameter both
+// when they're set and unset.
+const channelKeyModes = "k"
+
+// visibleTo returns whether the existence of the channel is visible to the
+// User.
+func visibleTo(ch Channel, u *User) bool {
+	_, secret := ch.Mode(ModeSecret)
+	return !secret || ch.HasUser(u)
+}
+
+// namesType returns the type of the channel for RPL_NAMREPLY.
+func namesType(ch Channel) string {
+	if _, secret := ch.Mode(ModeSecret); secret {
+		return "@"
+	}
+	if _, private := ch.Mode(ModePrivate); private {
+		return "*"
+	}
+	return "="
+}
+
+// keepEmptyChannel is implemented by Channels which can be registered to be
+// kept while they're empty.
+type keepEmptyChannel interface {
+	KeepEmpty() bool
+	SetKeepEmpty(bool)
+}
+
+// maxRecentMsgIDs is the number of recent message IDs which a channel keeps,
+// such as for redacting them.
+const maxRecentMsgIDs = 100
+
+// maxInvites is the number of pending invites which a channel keeps, dropping
+// the oldest ones past it.
+const maxInvites = 100
+
+// normalize returns the ID of a channel name in the Server.
+func normalize(s Server, name string) string {
+	if fn := s.Config().Normalize; fn != nil {
+		return fn(name)
+	}
+	return ID(name)
+}
+
+// activeChannel is implemented by Channels which keep track of their activity.
+type activeChannel interface {
+	// LastActive returns when a message was last sent to the channel, or
+	// when it was created if there were none.
+	LastActive() time.Time
+}
+
+// renameChannel is implemented by Channels which can be renamed.
+type renameChannel interface {
+	SetName(name string)
+}
+
+// memberModeChannel is implemented by Channels which keep the status modes of
+// their members, such as channel operators.
+type memberModeChannel interface {
+	// MemberModes returns the status modes of the member, from the highest
+	// rank to the lowest.
+	MemberModes(u *User) string
+	// SetMemberMode sets or unsets a status mode of the member, returning
+	// whether it changed. Returns ErrUserNotOnChannel if the User is not a
+	// member. Members are not notified.
+	SetMemberMode(u *User, mode byte, set bool) (bool, error)
+}
+
+// inviteChannel is implemented by Channels which keep track of the Users who
+// were invited and haven't joined yet.
+type inviteChannel interface {
+	// Invited returns the sorted nicks of the pending invites.
+	Invited() []string
+}
+
+// keyChannel is implemented by Channels which can be joined with a key.
+type keyChannel interface {
+	// JoinKey is like Join, giving the key for the ModeKey channel mode.
+	JoinKey(u *User, key string) error
+}
+
+// invite is a pending invite to a channel.
+type invite struct {
+	nick string
+	at   time.Time
+}
+
 type channel struct {
 	Publisher
 	created time.Time
-	name    string
 	server  Server
 
-	mu       sync.RWMutex
-	topic    string
-	usersIdx map[*User]struct{}
+	nameMu sync.RWMutex
+	id     string
+	name   string
+
+	mu          sync.RWMutex
+	founded     bool // Whether the channel has had its first member
+	keepEmpty   bool
+	invited     map[string]invite // IDs of invited Users
+	lastActive  time.Time
+	msgIDs      [maxRecentMsgIDs]string
+	msgIDsNext  int // Index in msgIDs for the next message
+	modes       map[byte]string
+	statuses    map[*User]string // Member status modes, such as "o"
+	topic       string
+	topicSetter string
+	topicTime   time.Time
+	usersIdx    map[*User]struct{}
 }
 
 // NewChannel returns a Channel implementation for a given Server.
 func NewChannel(server Server, name string) Channel {
+	now := time.Now()
 	return &channel{
-		Publisher: SyncPublisher(),
-		created:   time.Now(),
-		server:    server,
-		name:      name,
-		usersIdx:  map[*User]struct{}{},
+		Publisher:  SyncPublisher(),
+		created:    now,
+		lastActive: now,
+		server:     server,
+		id:         normalize(server, name),
+		name:       name,
+		modes:      map[byte]string{},
+		statuses:   map[*User]string{},
+		invited:    map[string]invite{},
+		usersIdx:   map[*User]struct{}{},
 	}
 }
 
-func (ch channel) Prefix() *irc.Prefix {
+func (ch *channel) Prefix() *irc.Prefix {
 	return ch.server.Prefix()
 }
 
 func (ch *channel) String() string {
+	ch.nameMu.RLock()
+	defer ch.nameMu.RUnlock()
 	return ch.name
 }
 
@@ -89,35 +332,126 @@ func (ch *channel) Created() time.Time {
 	return ch.created
 }
 
-// ID returns a normalized unique identifier for the channel.
+// ID returns a normalized unique identifier for the channel, as normalized by
+// the server's Normalize.
 func (ch *channel) ID() string {
-	return ID(ch.name)
+	ch.nameMu.RLock()
+	defer ch.nameMu.RUnlock()
+	return ch.id
+}
+
+// SetName changes the name of the channel, along with its ID. Members are not
+// notified, and the server must be updated separately (see
+// Server.RenameChannel).
+func (ch *channel) SetName(name string) {
+	id := normalize(ch.server, name)
+	ch.nameMu.Lock()
+	ch.name, ch.id = name, id
+	ch.nameMu.Unlock()
 }
 
 func (ch *channel) Message(from *User, text string) {
 	msg := &irc.Message{
 		Prefix:   from.Prefix(),
 		Command:  irc.PRIVMSG,
-		Params:   []string{ch.name},
+		Params:   []string{ch.String()},
 		Trailing: text,
 	}
+	msgid := ch.addMsgID()
+	ch.touch()
+
 	ch.mu.RLock()
 	for to := range ch.usersIdx {
 		// TODO: Check err and kick failures?
-		if to == from {
+		if to == from || to.silenced(from) {
 			continue
 		}
-		to.Encode(msg)
+		to.relayMsg(from, msgid, msg)
 	}
 	ch.mu.RUnlock()
 }
 
+// messageMultiline sends a draft/multiline message from the User to the
+// other members of the channel, as a single message with one ID.
+func (ch *channel) messageMultiline(from *User, lines []multilineLine) {
+	msgid := ch.addMsgID()
+	ch.touch()
+
+	ch.mu.RLock()
+	for to := range ch.usersIdx {
+		if to == from || to.silenced(from) {
+			continue
+		}
+		to.relayMultiline(from, msgid, ch.String(), lines)
+	}
+	ch.mu.RUnlock()
+}
+
+// touch marks the channel as active now.
+func (ch *channel) touch() {
+	ch.mu.Lock()
+	ch.lastActive = time.Now()
+	ch.mu.Unlock()
+}
+
+// LastActive returns when a message was last sent to the channel, or when it
+// was created if there were none.
+func (ch *channel) LastActive() time.Time {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.lastActive
+}
+
+// addMsgID returns a new message ID, which is kept among the recent messages
+// of the channel.
+func (ch *channel) addMsgID() string {
+	msgid := newMsgID()
+	ch.mu.Lock()
+	ch.msgIDs[ch.msgIDsNext] = msgid
+	ch.msgIDsNext = (ch.msgIDsNext + 1) % len(ch.msgIDs)
+	ch.mu.Unlock()
+	return msgid
+}
+
+// Redact notifies the members who negotiated draft/message-redaction that the
+// message with the given ID was removed. Other members are not notified, as
+// they have no way to act on it. IDs which are not among the recent messages
+// of the channel are ignored.
+func (ch *channel) Redact(msgid string) {
+	msg := &irc.Message{
+		Prefix:  ch.Prefix(),
+		Command: cmdRedact,
+		Params:  []string{ch.String(), msgid},
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if msgid == "" || !ch.hasMsgID(msgid) {
+		return
+	}
+	for to := range ch.usersIdx {
+		if to.HasCap(CapMessageRedaction) {
+			to.notify(nil, msg)
+		}
+	}
+}
+
+// hasMsgID returns whether msgid is among the recent messages of the channel.
+// The caller must hold the lock.
+func (ch *channel) hasMsgID(msgid string) bool {
+	for _, id := range ch.msgIDs {
+		if id == msgid {
+			return true
+		}
+	}
+	return false
+}
+
 // Quit will remove the user from the channel and emit a PART message.
 func (ch *channel) Part(u *User, text string) {
 	msg := &irc.Message{
 		Prefix:   u.Prefix(),
 		Command:  irc.PART,
-		Params:   []string{ch.name},
+		Params:   []string{ch.String()},
 		Trailing: text,
 	}
 	ch.mu.Lock()
@@ -126,15 +460,16 @@ func (ch *channel) Part(u *User, text string) {
 		u.Encode(&irc.Message{
 			Prefix:   ch.Prefix(),
 			Command:  irc.ERR_NOTONCHANNEL,
-			Params:   []string{ch.name},
+			Params:   []string{ch.String()},
 			Trailing: "You're not on that channel",
 		})
 		return
 	}
 	for to := range ch.usersIdx {
-		to.Encode(msg)
+		to.relay(u, msg)
 	}
 	delete(ch.usersIdx, u)
+	delete(ch.statuses, u)
 	n := len(ch.usersIdx)
 	ch.mu.Unlock()
 	u.Lock()
@@ -153,58 +488,394 @@ func (ch *channel) Unlink() {
 
 // Close will evict all users in the channel.
 func (ch *channel) Close() error {
-	ch.mu.Lock()
-	for to := range ch.usersIdx {
-		to.Encode(&irc.Message{
-			Prefix:  to.Prefix(),
+	return ch.close(func(u *User) *irc.Message {
+		return &irc.Message{
+			Prefix:  u.Prefix(),
 			Command: irc.PART,
-			Params:  []string{ch.name},
-		})
+			Params:  []string{ch.String()},
+		}
+	})
+}
+
+// CloseWithReason evicts all the members of the channel with a KICK from the
+// channel, giving the reason (default: "Channel closed"), and closes its
+// subscribers.
+func (ch *channel) CloseWithReason(reason string) error {
+	if reason == "" {
+		reason = "Channel closed"
 	}
+	return ch.close(func(u *User) *irc.Message {
+		return &irc.Message{
+			Prefix:   ch.Prefix(),
+			Command:  irc.KICK,
+			Params:   []string{ch.String(), u.Nick},
+			Trailing: reason,
+		}
+	})
+}
+
+// close evicts all the members, sending each of them the eviction message of
+// every member, and closes the channel's subscribers.
+func (ch *channel) close(evict func(u *User) *irc.Message) error {
+	ch.mu.Lock()
+	users := ch.usersIdx
 	ch.usersIdx = map[*User]struct{}{}
+	ch.statuses = map[*User]string{}
 	ch.Publisher.Close()
 	ch.mu.Unlock()
+
+	for to := range users {
+		msg := evict(to)
+		for other := range users {
+			other.notify(nil, msg)
+		}
+		to.Lock()
+		delete(to.channels, ch)
+		to.Unlock()
+	}
 	return nil
 }
 
 // Invite prompts the User to join the Channel on behalf of Prefixer.
+// The invite is pending until the User joins.
 func (ch *channel) Invite(from Prefixer, u *User) error {
-	return u.Encode(&irc.Message{
+	ch.mu.Lock()
+	id := u.ID()
+	if _, ok := ch.invited[id]; !ok && len(ch.invited) >= maxInvites {
+		oldest := ""
+		for other, inv := range ch.invited {
+			if oldest == "" || inv.at.Before(ch.invited[oldest].at) {
+				oldest = other
+			}
+		}
+		delete(ch.invited, oldest)
+	}
+	ch.invited[id] = invite{nick: u.Nick, at: time.Now()}
+	ch.mu.Unlock()
+	by, _ := from.(*User)
+	return u.encodeFrom(by, nil, &irc.Message{
 		Prefix:  from.Prefix(),
 		Command: irc.INVITE,
-		Params:  []string{u.Nick, ch.name},
+		Params:  []string{u.Nick, ch.String()},
 	})
-	// TODO: Save state that the user is invited?
 }
 
-// Topic sets the topic of the channel (handler for TOPIC).
-func (ch *channel) Topic(from Prefixer, text string) {
+// Invited returns the sorted nicks of the Users who were invited to the
+// channel and haven't joined yet.
+func (ch *channel) Invited() []string {
 	ch.mu.RLock()
-	ch.topic = text
+	nicks := make([]string, 0, len(ch.invited))
+	for _, inv := range ch.invited {
+		nicks = append(nicks, inv.nick)
+	}
+	ch.mu.RUnlock()
+	sort.Strings(nicks)
+	return nicks
+}
+
+// Topic returns the topic of the channel.
+func (ch *channel) Topic() string {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.topic
+}
+
+// SetTopic sets the topic of the channel on behalf of the User, or the server
+// if the User is nil (handler for TOPIC). Only ops and higher ranks can set
+// the topic.
+func (ch *channel) SetTopic(setter *User, text string) error {
+	var from Prefixer = ch
+	if setter != nil {
+		if !ch.HasUser(setter) {
+			return ErrNotOnChannel
+		}
+		if !isChannelOp(ch, setter) {
+			return ErrNoPrivileges
+		}
+		from = setter
+	}
 
 	msg := &irc.Message{
 		Prefix:   from.Prefix(),
 		Command:  irc.TOPIC,
-		Params:   []string{ch.name},
+		Params:   []string{ch.String()},
 		Trailing: text,
 	}
+
+	ch.mu.Lock()
+	ch.topic = text
+	ch.topicSetter = msg.Prefix.String()
+	ch.topicTime = time.Now()
 	for to := range ch.usersIdx {
-		to.Encode(msg)
+		to.encodeFrom(setter, nil, msg)
 	}
+	ch.mu.Unlock()
 
+	ch.server.Publish(&event{TopicEvent, ch.server, ch, setter, msg})
+	return nil
+}
+
+// Mode returns the parameter of a channel mode, which is empty for flags, and
+// whether the mode is set.
+func (ch *channel) Mode(mode byte) (string, bool) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	param, ok := ch.modes[mode]
+	return param, ok
+}
+
+// SetMode sets a channel mode along with its parameter, which is empty for
+// flags. Members are not notified.
+func (ch *channel) SetMode(mode byte, param string) {
+	ch.mu.Lock()
+	ch.modes[mode] = param
+	ch.mu.Unlock()
+}
+
+// UnsetMode unsets a channel mode. Members are not notified.
+func (ch *channel) UnsetMode(mode byte) {
+	ch.mu.Lock()
+	delete(ch.modes, mode)
+	ch.mu.Unlock()
+}
+
+// Modes returns the set modes of the channel, followed by their parameters,
+// in the form "+ps".
+func (ch *channel) Modes() string {
+	ch.mu.RLock()
+	modes := make([]byte, 0, len(ch.modes))
+	for mode := range ch.modes {
+		modes = append(modes, mode)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+	params := []string{}
+	for _, mode := range modes {
+		if param := ch.modes[mode]; param != "" {
+			params = append(params, param)
+		}
+	}
 	ch.mu.RUnlock()
+	return strings.Join(append([]string{"+" + string(modes)}, params...), " ")
+}
+
+// KeepEmpty returns whether the channel is registered to be kept by the
+// server while it's empty.
+func (ch *channel) KeepEmpty() bool {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.keepEmpty
+}
+
+// SetKeepEmpty sets whether the channel is kept by the server while it's
+// empty.
+func (ch *channel) SetKeepEmpty(keep bool) {
+	ch.mu.Lock()
+	ch.keepEmpty = keep
+	ch.mu.Unlock()
+}
+
+// Kick removes the target from the channel on behalf of a User, notifying the
+// members. Members can only be kicked by ops who don't rank below them. A nil
+// User bypasses permission checks, for admin use.
+func (ch *channel) Kick(by *User, target *User, reason string) error {
+	var from Prefixer = ch
+	if by != nil {
+		if !ch.HasUser(by) {
+			return ErrNotOnChannel
+		}
+		if !by.IsOper() {
+			modes := ch.MemberModes(by)
+			if !hasRank(modes, ModeOp) || statusRank(ch.MemberModes(target)) < statusRank(modes) {
+				return ErrNoPrivileges
+			}
+		}
+		from = by
+	}
+	if reason == "" {
+		reason = target.Nick
+	}
+	msg := &irc.Message{
+		Prefix:   from.Prefix(),
+		Command:  irc.KICK,
+		Params:   []string{ch.String(), target.Nick},
+		Trailing: reason,
+	}
+
+	ch.mu.Lock()
+	if _, ok := ch.usersIdx[target]; !ok {
+		ch.mu.Unlock()
+		return ErrUserNotOnChannel
+	}
+	for to := range ch.usersIdx {
+		to.encodeFrom(by, nil, msg)
+	}
+	delete(ch.usersIdx, target)
+	delete(ch.statuses, target)
+	n := len(ch.usersIdx)
+	ch.mu.Unlock()
+	target.Lock()
+	delete(target.channels, ch)
+	target.Unlock()
+
+	ch.server.Publish(&event{KickEvent, ch.server, ch, target, msg})
+	if n == 0 {
+		ch.Publish(&event{EmptyChanEvent, ch.server, ch, target, nil})
+	}
+	return nil
+}
+
+// Remove removes the User from the channel without notifying the members,
+// for when they're notified otherwise (such as by QUIT).
+func (ch *channel) Remove(u *User) {
+	ch.mu.Lock()
+	if _, ok := ch.usersIdx[u]; !ok {
+		ch.mu.Unlock()
+		return
+	}
+	delete(ch.usersIdx, u)
+	delete(ch.statuses, u)
+	n := len(ch.usersIdx)
+	ch.mu.Unlock()
+	u.Lock()
+	delete(u.channels, ch)
+	u.Unlock()
+	if n == 0 {
+		ch.Publish(&event{EmptyChanEvent, ch.server, ch, u, nil})
+	}
+}
+
+// MemberModes returns the status modes of the member, from the highest rank to
+// the lowest, such as "ov".
+func (ch *channel) MemberModes(u *User) string {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.statuses[u]
+}
+
+// SetMemberMode sets or unsets a status mode of the member, returning whether
+// it changed. Members are not notified.
+func (ch *channel) SetMemberMode(u *User, mode byte, set bool) (bool, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if _, ok := ch.usersIdx[u]; !ok {
+		return false, ErrUserNotOnChannel
+	}
+	old := ch.statuses[u]
+	if (strings.IndexByte(old, mode) >= 0) == set {
+		return false, nil
+	}
+	modes := []byte{}
+	for i := 0; i < len(memberModes); i++ {
+		m := memberModes[i]
+		if m == mode && set || m != mode && strings.IndexByte(old, m) >= 0 {
+			modes = append(modes, m)
+		}
+	}
+	if len(modes) == 0 {
+		delete(ch.statuses, u)
+	} else {
+		ch.statuses[u] = string(modes)
+	}
+	return true, nil
+}
+
+// statusRank returns the rank of the highest of the status modes, where lower
+// ranks come first, or len(memberModes) if there are none.
+func statusRank(modes string) int {
+	for i := 0; i < len(memberModes); i++ {
+		if strings.IndexByte(modes, memberModes[i]) >= 0 {
+			return i
+		}
+	}
+	return len(memberModes)
+}
+
+// hasRank returns whether the status modes include the given mode or a higher
+// ranked one.
+func hasRank(modes string, mode byte) bool {
+	return statusRank(modes) <= strings.IndexByte(memberModes, mode)
+}
+
+// isChannelOp returns whether the User is an op of the channel, or ranks
+// above one, or is an IRC operator.
+func isChannelOp(ch Channel, u *User) bool {
+	if u.IsOper() {
+		return true
+	}
+	mc, ok := ch.(memberModeChannel)
+	return ok && hasRank(mc.MemberModes(u), ModeOp)
+}
+
+// State returns the persistable state of the channel.
+func (ch *channel) State() ChannelState {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	state := ChannelState{
+		Topic:       ch.topic,
+		TopicSetter: ch.topicSetter,
+		TopicTime:   ch.topicTime,
+		Modes:       map[byte]string{},
+		Key:         ch.modes[ModeKey],
+	}
+	for mode, param := range ch.modes {
+		if mode != ModeKey {
+			state.Modes[mode] = param
+		}
+	}
+	return state
+}
+
+// SetState restores the persisted state of the channel, without notifying
+// any members.
+func (ch *channel) SetState(state ChannelState) {
+	ch.mu.Lock()
+	ch.topic = state.Topic
+	ch.topicSetter = state.TopicSetter
+	ch.topicTime = state.TopicTime
+	ch.modes = map[byte]string{}
+	for mode, param := range state.Modes {
+		ch.modes[mode] = param
+	}
+	if state.Key != "" {
+		ch.modes[ModeKey] = state.Key
+	}
+	ch.founded = true
+	ch.mu.Unlock()
 }
 
 // Join introduces the User to the channel (sends relevant messages, stores).
 func (ch *channel) Join(u *User) error {
-	// TODO: Check if user is already here?
+	return ch.JoinKey(u, "")
+}
+
+// JoinKey introduces the User to the channel if the key matches its ModeKey
+// mode, returning ErrBadKey otherwise.
+func (ch *channel) JoinKey(u *User, key string) error {
+	override := operOverride(ch.server, u)
 	ch.mu.Lock()
 	if _, exists := ch.usersIdx[u]; exists {
 		ch.mu.Unlock()
 		return nil
 	}
-	topic := ch.topic
+	if chKey, ok := ch.modes[ModeKey]; ok && chKey != key && !override {
+		ch.mu.Unlock()
+		return ErrBadKey
+	}
+	if limit, ok := ch.modes[ModeLimit]; ok && !override {
+		if n, _ := strconv.Atoi(limit); len(ch.usersIdx) >= n {
+			ch.mu.Unlock()
+			return ErrChannelFull
+		}
+	}
+	topic, topicSetter, topicTime := ch.topic, ch.topicSetter, ch.topicTime
+	if !ch.founded {
+		// The member who creates the channel is its operator. Channels which
+		// were kept or restored while empty don't give it to whoever rejoins.
+		ch.founded = true
+		ch.statuses[u] = string(ModeOp)
+	}
 	ch.usersIdx[u] = struct{}{}
+	delete(ch.invited, u.ID())
 	ch.mu.Unlock()
 	u.Lock()
 	u.channels[ch] = struct{}{}
@@ -213,32 +884,41 @@ func (ch *channel) Join(u *User) error {
 	msg := &irc.Message{
 		Prefix:  u.Prefix(),
 		Command: irc.JOIN,
-		Params:  []string{ch.name},
+		Params:  []string{ch.String()},
 	}
+	ch.mu.RLock()
 	for to := range ch.usersIdx {
-		to.Encode(msg)
+		to.relay(u, msg)
 	}
+	ch.mu.RUnlock()
 
 	msgs := []*irc.Message{}
 	if topic != "" {
-		msgs = append(msgs, &irc.Message{
-			Prefix:   ch.Prefix(),
-			Command:  irc.RPL_TOPIC,
-			Params:   []string{u.Nick, ch.name},
-			Trailing: topic,
-		})
+		msgs = append(msgs,
+			&irc.Message{
+				Prefix:   ch.Prefix(),
+				Command:  irc.RPL_TOPIC,
+				Params:   []string{u.Nick, ch.String()},
+				Trailing: topic,
+			},
+			&irc.Message{
+				Prefix:  ch.Prefix(),
+				Command: rplTopicWhoTime,
+				Params:  []string{u.Nick, ch.String(), topicSetter, strconv.FormatInt(topicTime.Unix(), 10)},
+			},
+		)
 	}
 
 	msgs = append(msgs,
 		&irc.Message{
 			Prefix:   ch.Prefix(),
 			Command:  irc.RPL_NAMREPLY,
-			Params:   []string{u.Nick, "=", ch.name},
-			Trailing: strings.Join(ch.Names(), " "),
+			Params:   []string{u.Nick, namesType(ch), ch.String()},
+			Trailing: strings.Join(namesWithPrefix(ch), " "),
 		},
 		&irc.Message{
 			Prefix:   ch.Prefix(),
-			Params:   []string{u.Nick, ch.name},
+			Params:   []string{u.Nick, ch.String()},
 			Command:  irc.RPL_ENDOFNAMES,
 			Trailing: "End of /NAMES list.",
 		},
@@ -247,6 +927,7 @@ func (ch *channel) Join(u *User) error {
 	return u.Encode(msgs...)
 }
 
+// HasUser returns whether the User is in the channel.
 func (ch *channel) HasUser(u *User) bool {
 	ch.mu.RLock()
 	_, ok := ch.usersIdx[u]
@@ -266,7 +947,7 @@ func (ch *channel) Users() []*User {
 }
 
 // Names returns a sorted slice of Nick strings of users who are in the channel.
-func (ch channel) Names() []string {
+func (ch *channel) Names() []string {
 	users := ch.Users()
 	names := make([]string, 0, len(users))
 	for _, u := range users {
@@ -277,6 +958,56 @@ func (ch channel) Names() []string {
 	return names
 }
 
+// NamesWithPrefix returns a sorted slice of Nick strings of users who are in
+// the channel, with their membership prefixes.
+func (ch *channel) NamesWithPrefix() []string {
+	users := ch.Users()
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, ch.memberPrefix(u)+u.Nick)
+	}
+	sortNames(names)
+	return names
+}
+
+// memberPrefixes are the characters which can precede a Nick in RPL_NAMREPLY,
+// from the highest rank to the lowest, aligned with memberModes.
+const memberPrefixes = "~&@+"
+
+// memberRank returns the rank of a prefixed name, where lower ranks come
+// first: owners, admins, operators, voiced, then regular members.
+func memberRank(name string) int {
+	if name == "" {
+		return len(memberPrefixes)
+	}
+	if i := strings.IndexByte(memberPrefixes, name[0]); i >= 0 {
+		return i
+	}
+	return len(memberPrefixes)
+}
+
+// sortNames sorts prefixed names by rank, then alphabetically within each
+// rank. Without any prefixes, it's plain alphabetical.
+func sortNames(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		ri, rj := memberRank(names[i]), memberRank(names[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return strings.TrimLeft(names[i], memberPrefixes) < strings.TrimLeft(names[j], memberPrefixes)
+	})
+}
+
+// memberPrefix returns the RPL_NAMREPLY prefix for a member of the channel,
+// for their highest ranked status.
+func (ch *channel) memberPrefix(u *User) string {
+	rank := statusRank(ch.MemberModes(u))
+	if rank == len(memberPrefixes) {
+		return ""
+	}
+	return memberPrefixes[rank : rank+1]
+}
+
 // Len returns the number of users in the channel.
 func (ch *channel) Len() int {
 	ch.mu.RLock()
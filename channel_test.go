@@ -0,0 +1,224 @@
+package irckit
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestChannelHasUser(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	u1 := NewUser(NewConnMock("client1", 10))
+	u1.Nick = "foo"
+	u2 := NewUser(NewConnMock("client2", 10))
+	u2.Nick = "baz"
+
+	ch := srv.Channel("#chat")
+	if ch.HasUser(u1) {
+		t.Error("expected foo to not be in #chat before joining")
+	}
+	if err := ch.Join(u1); err != nil {
+		t.Fatal(err)
+	}
+	if !ch.HasUser(u1) {
+		t.Error("expected foo to be in #chat after joining")
+	}
+	if ch.HasUser(u2) {
+		t.Error("expected baz to not be in #chat")
+	}
+	ch.Part(u1, "")
+	if ch.HasUser(u1) {
+		t.Error("expected foo to not be in #chat after parting")
+	}
+}
+
+func TestChannelSubscribe(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	u := NewUser(NewConnMock("client", 10))
+	u.Nick = "foo"
+
+	ch := srv.Channel("#chat")
+	events := make(chan Event, 10)
+	ch.Subscribe(events)
+
+	ch.Join(u)
+	ch.Part(u, "")
+	select {
+	case evt := <-events:
+		if evt.Kind() != EmptyChanEvent || evt.Channel() != ch {
+			t.Errorf("got %s; want EmptyChanEvent in %s", evt, ch)
+		}
+	default:
+		t.Fatal("expected EmptyChanEvent after the last user parted")
+	}
+
+	if !ch.Unsubscribe(events) {
+		t.Error("expected Unsubscribe to find the subscriber")
+	}
+	if ch.Unsubscribe(events) {
+		t.Error("expected the second Unsubscribe to be a no-op")
+	}
+	ch.Join(u)
+	ch.Part(u, "")
+	select {
+	case evt := <-events:
+		t.Errorf("unexpected event after unsubscribing: %s", evt)
+	default:
+	}
+}
+
+func TestChannelKick(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1, c2 := NewConnMock("client1", 10), NewConnMock("client2", 10)
+	u1, u2 := NewUser(c1), NewUser(c2)
+	u1.Nick, u2.Nick = "foo", "baz"
+
+	ch := srv.Channel("#chat")
+	<-events // NewChanEvent
+	ch.Join(u1)
+	ch.Join(u2)
+	receiveUntil(t, c1, irc.RPL_ENDOFNAMES)
+	receiveUntil(t, c1, irc.JOIN)
+	receiveUntil(t, c2, irc.RPL_ENDOFNAMES)
+
+	// foo is an op for joining first, and baz is a plain member.
+	k := ch.(Kicker)
+	if err := k.Kick(u2, u1, "bye"); err != ErrNoPrivileges {
+		t.Errorf("got %v; want ErrNoPrivileges", err)
+	}
+	if _, err := ch.(memberModeChannel).SetMemberMode(u2, ModeAdmin, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Kick(u1, u2, "bye"); err != ErrNoPrivileges {
+		t.Errorf("op kicking an admin: got %v; want ErrNoPrivileges", err)
+	}
+	if err := k.Kick(nil, u2, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*mockConn{c1, c2} {
+		expectReply(t, c, "^:testserver KICK #chat baz :bye$")
+	}
+	if ch.HasUser(u2) {
+		t.Error("expected baz to be removed from #chat")
+	}
+	if evt := expectEvent(t, events, KickEvent); evt.User() != u2 {
+		t.Errorf("got %s; want KickEvent for baz", evt)
+	}
+	if err := k.Kick(nil, u2, ""); err != ErrUserNotOnChannel {
+		t.Errorf("got %v; want ErrUserNotOnChannel", err)
+	}
+}
+
+func TestChannelFounderOp(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	u1 := NewUser(NewConnMock("client1", 10))
+	u1.Nick = "foo"
+	u2 := NewUser(NewConnMock("client2", 10))
+	u2.Nick = "baz"
+
+	// Whoever creates the channel is its op, but not whoever rejoins it once
+	// it's been kept while empty.
+	ch := srv.Register("#kept")
+	mc := ch.(memberModeChannel)
+	ch.Join(u1)
+	if modes := mc.MemberModes(u1); modes != "o" {
+		t.Errorf("got %q for the creator; want \"o\"", modes)
+	}
+	ch.Part(u1, "")
+	ch.Join(u2)
+	if modes := mc.MemberModes(u2); modes != "" {
+		t.Errorf("got %q after rejoining; want none", modes)
+	}
+
+	// Nor whoever joins first once it's been restored.
+	restored := NewChannel(srv, "#restored")
+	restored.(stateChannel).SetState(ChannelState{Topic: "kept"})
+	restored.Join(u1)
+	if modes := restored.(memberModeChannel).MemberModes(u1); modes != "" {
+		t.Errorf("got %q after restoring; want none", modes)
+	}
+}
+
+func TestChannelInviteLimit(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	ch := srv.Channel("#chat")
+	for i := 0; i <= maxInvites; i++ {
+		u := NewUser(NewConnMock("client", 1))
+		u.Nick = fmt.Sprintf("user%03d", i)
+		ch.Invite(srv, u)
+		<-u.Conn.(*mockConn).send
+	}
+	invited := ch.(inviteChannel).Invited()
+	if len(invited) != maxInvites {
+		t.Fatalf("got %d invites; want %d", len(invited), maxInvites)
+	}
+	if invited[0] != "user001" {
+		t.Errorf("expected the oldest invite to be dropped; got %v", invited[:2])
+	}
+}
+
+func TestChannelCloseWithReason(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	c1, c2 := NewConnMock("client1", 10), NewConnMock("client2", 10)
+	u1, u2 := NewUser(c1), NewUser(c2)
+	u1.Nick, u2.Nick = "foo", "baz"
+
+	ch := srv.Channel("#chat")
+	ch.Join(u1)
+	ch.Join(u2)
+	receiveUntil(t, c1, irc.RPL_ENDOFNAMES)
+	receiveUntil(t, c1, irc.JOIN)
+	receiveUntil(t, c2, irc.RPL_ENDOFNAMES)
+
+	if err := ch.(ReasonCloser).CloseWithReason("Moving to #other"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*mockConn{c1, c2} {
+		kicked := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			msg := receiveReply(t, c)
+			if msg.Command != irc.KICK || msg.Params[0] != "#chat" || msg.Trailing != "Moving to #other" {
+				t.Errorf("expected KICK #chat with reason; got %s", msg)
+				continue
+			}
+			kicked[msg.Params[1]] = true
+		}
+		if !kicked["foo"] || !kicked["baz"] {
+			t.Errorf("expected KICKs for foo and baz; got %v", kicked)
+		}
+	}
+	if ch.Len() != 0 || len(u1.Channels()) != 0 {
+		t.Error("expected #chat to be empty")
+	}
+}
+
+func TestSortNames(t *testing.T) {
+	names := []string{"carol", "+bob", "alice", "@zed", "&amy", "+al", "~zoe", "@abe"}
+	sortNames(names)
+	if want := []string{"~zoe", "&amy", "@abe", "@zed", "+al", "+bob", "alice", "carol"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q; want %q", names, want)
+	}
+
+	// Without any statuses, it's alphabetical.
+	names = []string{"zed", "bob", "alice"}
+	sortNames(names)
+	if want := []string{"alice", "bob", "zed"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q; want %q", names, want)
+	}
+}
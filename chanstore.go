@@ -0,0 +1,60 @@
+package irckit
+
+import (
+	"sync"
+	"time"
+)
+
+// ChannelState is the state of a Channel which is persisted by a
+// ChannelStore while the Channel is discarded.
+type ChannelState struct {
+	Topic       string
+	TopicSetter string
+	TopicTime   time.Time
+	// Modes are the channel modes other than the key, to their parameters
+	// (empty for flags).
+	Modes map[byte]string
+	// Key is the parameter of the ModeKey channel mode, if it's set.
+	Key string
+}
+
+// ChannelStore persists the state of Channels which are discarded for being
+// empty, so that it can be restored when they are recreated.
+type ChannelStore interface {
+	// Save stores the state of the channel with the given ID.
+	Save(id string, state ChannelState)
+	// Load returns the stored state of the channel with the given ID.
+	Load(id string) (ChannelState, bool)
+}
+
+// stateChannel is implemented by Channels whose state can be persisted.
+type stateChannel interface {
+	State() ChannelState
+	SetState(ChannelState)
+}
+
+// MemoryChannelStore returns a ChannelStore which keeps the state of channels
+// in memory.
+func MemoryChannelStore() ChannelStore {
+	return &memChannelStore{
+		states: map[string]ChannelState{},
+	}
+}
+
+type memChannelStore struct {
+	mu     sync.Mutex
+	states map[string]ChannelState
+}
+
+func (store *memChannelStore) Save(id string, state ChannelState) {
+	store.mu.Lock()
+	store.states[id] = state
+	store.mu.Unlock()
+}
+
+func (store *memChannelStore) Load(id string) (ChannelState, bool) {
+	store.mu.Lock()
+	state, ok := store.states[id]
+	store.mu.Unlock()
+	return state, ok
+}
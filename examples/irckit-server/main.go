@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/alexcesaro/log"
 	"github.com/alexcesaro/log/golog"
@@ -86,7 +88,12 @@ func main() {
 		Name: options.Name,
 		Motd: motd,
 	}.Server()
-	go start(srv, socket)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		startContext(ctx, srv, socket)
+		close(stopped)
+	}()
 
 	fmt.Printf("Listening for connections on %v\n", socket.Addr().String())
 
@@ -96,22 +103,68 @@ func main() {
 
 	<-sig // Wait for ^C signal
 	fmt.Fprintln(os.Stderr, "Interrupt signal detected, shutting down.")
-	srv.Close()
+	cancel()
+	<-stopped
 	os.Exit(0)
 }
 
+// maxAcceptDelay caps the backoff between retries after a temporary Accept
+// error.
+const maxAcceptDelay = time.Second
+
 func start(srv irckit.Server, socket net.Listener) {
+	startContext(context.Background(), srv, socket)
+}
+
+// startContext accepts connections for the server until the context is
+// cancelled, at which point the listener and the server are closed.
+func startContext(ctx context.Context, srv irckit.Server, socket net.Listener) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock Accept
+			socket.Close()
+		case <-done:
+		}
+	}()
+
+	var delay time.Duration
 	for {
 		conn, err := socket.Accept()
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			srv.Close()
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			// Temporary errors (such as running out of file descriptors)
+			// shouldn't take down the listener, so back off and retry.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			logger.Warningf("Temporary error accepting connection: %v; retrying in %v", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+			continue
+		}
 		if err != nil {
 			logger.Errorf("Failed to accept connection: %v", err)
 			return
 		}
+		delay = 0
 
 		// Goroutineify to resume accepting sockets early
 		go func() {
 			logger.Infof("New connection: %s", conn.RemoteAddr())
-			err = srv.Connect(irckit.NewUserNet(conn))
+			err := irckit.ConnectNet(srv, conn)
 			if err != nil {
 				logger.Errorf("Failed to join: %v", err)
 				return
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shazow/go-irckit"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// stubListener returns the queued results from Accept, then a permanent error.
+type stubListener struct {
+	net.Listener
+	results chan interface{}
+}
+
+func (l *stubListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.results:
+		if err, ok := r.(error); ok {
+			return nil, err
+		}
+		return r.(net.Conn), nil
+	default:
+		return nil, errors.New("use of closed network connection")
+	}
+}
+
+func TestStartTemporaryError(t *testing.T) {
+	srv := irckit.NewServer("testserver")
+	defer srv.Close()
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	l := &stubListener{results: make(chan interface{}, 2)}
+	l.results <- temporaryError{}
+	l.results <- server
+
+	done := make(chan struct{})
+	go func() {
+		start(srv, l)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("start did not return after a permanent error")
+	}
+	if len(l.results) != 0 {
+		t.Errorf("expected connection to be accepted after the temporary error")
+	}
+}
+
+func TestStartContextCancel(t *testing.T) {
+	srv := irckit.NewServer("testserver")
+
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		startContext(ctx, srv, socket)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("startContext did not return after cancel")
+	}
+	if _, err := net.Dial("tcp", socket.Addr().String()); err == nil {
+		t.Error("expected listener to be closed")
+	}
+}
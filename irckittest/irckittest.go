@@ -0,0 +1,109 @@
+// Package irckittest provides utilities for testing code which is built on
+// irckit, such as bots and custom command handlers, without real sockets.
+package irckittest
+
+import (
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+
+	"github.com/shazow/go-irckit"
+)
+
+// Timeout is how long Expect and Receive wait for a message.
+var Timeout = time.Second
+
+// MockConn is an irckit.Conn which passes messages over channels. Messages
+// encoded for the User are sent on Send, and messages pushed to Receive are
+// decoded as if the User had sent them. Closing Receive disconnects the User.
+type MockConn struct {
+	Send    chan *irc.Message
+	Receive chan *irc.Message
+
+	host string
+}
+
+// NewConnMock returns a MockConn for a client connecting from host, with
+// capacity buffered messages in each direction.
+func NewConnMock(host string, capacity int) *MockConn {
+	return &MockConn{
+		Send:    make(chan *irc.Message, capacity),
+		Receive: make(chan *irc.Message, capacity),
+		host:    host,
+	}
+}
+
+// NewUserMock returns a User whose Conn is backed by the given channels.
+func NewUserMock(send chan *irc.Message, receive chan *irc.Message) *irckit.User {
+	return irckit.NewUser(&MockConn{
+		Send:    send,
+		Receive: receive,
+		host:    "mockhost.local",
+	})
+}
+
+func (conn *MockConn) Close() error {
+	return nil
+}
+
+func (conn *MockConn) Encode(msg *irc.Message) error {
+	conn.Send <- msg
+	return nil
+}
+
+// Decode returns the next message pushed to Receive, or io.EOF once it's
+// closed.
+func (conn *MockConn) Decode() (*irc.Message, error) {
+	msg, ok := <-conn.Receive
+	if !ok {
+		return nil, io.EOF
+	}
+	return msg, nil
+}
+
+func (conn *MockConn) ResolveHost() string {
+	return conn.host
+}
+
+// Write queues a raw line to be decoded as if the User had sent it.
+func (conn *MockConn) Write(line string) {
+	conn.Receive <- irc.ParseMessage(line)
+}
+
+// Next returns the next message which was sent to the User, failing the test
+// if none arrives within Timeout.
+func (conn *MockConn) Next(t testing.TB) *irc.Message {
+	t.Helper()
+	select {
+	case msg := <-conn.Send:
+		return msg
+	case <-time.After(Timeout):
+		t.Fatal("timed out waiting for message")
+	}
+	return nil
+}
+
+// Expect fails the test unless the next message which was sent to the User
+// matches the regular expression.
+func (conn *MockConn) Expect(t testing.TB, expect string) *irc.Message {
+	t.Helper()
+	msg := conn.Next(t)
+	if line := msg.String(); !regexp.MustCompile(expect).MatchString(line) {
+		t.Errorf("\ngot\t\t%q\nwant\t%q", line, expect)
+	}
+	return msg
+}
+
+// ExpectCommand consumes the messages which were sent to the User up to and
+// including the next one with the given command.
+func (conn *MockConn) ExpectCommand(t testing.TB, command string) *irc.Message {
+	t.Helper()
+	for {
+		if msg := conn.Next(t); msg.Command == command {
+			return msg
+		}
+	}
+}
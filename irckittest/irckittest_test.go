@@ -0,0 +1,55 @@
+package irckittest_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorcix/irc"
+
+	"github.com/shazow/go-irckit"
+	"github.com/shazow/go-irckit/irckittest"
+)
+
+func Example() {
+	srv := irckit.NewServer("testserver")
+	defer srv.Close()
+
+	conn := irckittest.NewConnMock("client", 20)
+	go srv.Connect(irckit.NewUser(conn))
+	conn.Write("NICK foo")
+	conn.Write("USER root 0 * :Foo Bar")
+
+	msg := <-conn.Send
+	fmt.Println(msg)
+	// Output: :testserver 001 foo :Welcome! foo!root@client
+}
+
+func TestMockConn(t *testing.T) {
+	srv := irckit.NewServer("testserver")
+	defer srv.Close()
+
+	conn := irckittest.NewConnMock("client", 20)
+	go srv.Connect(irckit.NewUser(conn))
+	conn.Write("NICK foo")
+	conn.Write("USER root 0 * :Foo Bar")
+	conn.ExpectCommand(t, irc.RPL_ENDOFMOTD)
+
+	conn.Write("JOIN #chat")
+	conn.Expect(t, "^:foo!root@client JOIN #chat$")
+	conn.Expect(t, "^:testserver 353 foo = #chat :@foo$")
+}
+
+func TestUserMock(t *testing.T) {
+	send, receive := make(chan *irc.Message, 1), make(chan *irc.Message, 1)
+	u := irckittest.NewUserMock(send, receive)
+
+	u.Encode(&irc.Message{Command: irc.PING, Trailing: "hi"})
+	if got := <-send; got.String() != "PING :hi" {
+		t.Errorf("got %q; want %q", got, "PING :hi")
+	}
+
+	receive <- irc.ParseMessage("QUIT")
+	if msg, _ := u.Decode(); msg.Command != irc.QUIT {
+		t.Errorf("got %q; want %q", msg.Command, irc.QUIT)
+	}
+}
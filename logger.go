@@ -1,6 +1,9 @@
 package irckit
 
 import (
+	"io"
+	"sync"
+
 	"github.com/alexcesaro/log"
 )
 
@@ -9,3 +12,16 @@ var logger log.Logger = log.NullLogger
 func SetLogger(l log.Logger) {
 	logger = l
 }
+
+// syncWriter serializes writes from concurrent connections, so that their
+// lines don't interleave.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
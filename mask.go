@@ -0,0 +1,51 @@
+package irckit
+
+import "strings"
+
+// MatchMask returns whether name matches the mask, where '*' matches any
+// sequence of characters and '?' matches any single character. Matching is
+// case-insensitive.
+func MatchMask(mask string, name string) bool {
+	mask, name = strings.ToLower(mask), strings.ToLower(name)
+
+	// Position to resume from when a '*' needs to consume more of name.
+	star, resume := -1, 0
+	m, n := 0, 0
+	for n < len(name) {
+		switch {
+		case m < len(mask) && (mask[m] == '?' || mask[m] == name[n]):
+			m++
+			n++
+		case m < len(mask) && mask[m] == '*':
+			star, resume = m, n
+			m++
+		case star >= 0:
+			resume++
+			m, n = star+1, resume
+		default:
+			return false
+		}
+	}
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+	return m == len(mask)
+}
+
+// normalizeMask expands a partial mask into a full nick!user@host mask, such
+// that "foo" becomes "foo!*@*" and "foo@bar" becomes "foo!*@bar".
+func normalizeMask(mask string) string {
+	nick, userHost := mask, "*@*"
+	if i := strings.IndexByte(mask, '!'); i >= 0 {
+		nick, userHost = mask[:i], mask[i+1:]
+		if !strings.Contains(userHost, "@") {
+			userHost += "@*"
+		}
+	} else if i := strings.IndexByte(mask, '@'); i >= 0 {
+		nick, userHost = mask[:i], "*"+mask[i:]
+	}
+	if nick == "" {
+		nick = "*"
+	}
+	return nick + "!" + userHost
+}
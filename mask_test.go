@@ -0,0 +1,44 @@
+package irckit
+
+import "testing"
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask  string
+		name  string
+		match bool
+	}{
+		{"*", "foo!root@host", true},
+		{"foo!*@*", "foo!root@host", true},
+		{"FOO!*@*", "foo!root@host", true},
+		{"foo!*@*", "foobar!root@host", false},
+		{"f?o!*@*.example.com", "fao!root@irc.example.com", true},
+		{"f?o!*@*.example.com", "fo!root@irc.example.com", false},
+		{"*!*@host", "foo!root@host", true},
+		{"*!*@host", "foo!root@otherhost", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+		{"", "", true},
+		{"", "foo", false},
+	}
+	for _, test := range tests {
+		if got := MatchMask(test.mask, test.name); got != test.match {
+			t.Errorf("MatchMask(%q, %q) = %v; want %v", test.mask, test.name, got, test.match)
+		}
+	}
+}
+
+func TestNormalizeMask(t *testing.T) {
+	tests := map[string]string{
+		"foo":          "foo!*@*",
+		"foo!bar":      "foo!bar@*",
+		"foo@host":     "foo!*@host",
+		"@host":        "*!*@host",
+		"foo!bar@host": "foo!bar@host",
+	}
+	for in, want := range tests {
+		if got := normalizeMask(in); got != want {
+			t.Errorf("normalizeMask(%q) = %q; want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package irckit
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sorcix/irc"
+)
+
+// MaxMessageLen is the maximum length of an encoded message, excluding tags
+// and the trailing CR-LF.
+const MaxMessageLen = 510
+
+// MsgLenPolicy decides what happens to PRIVMSG text which exceeds the
+// server's MaxMsgLen, or to a topic which exceeds MaxTopicLen.
+type MsgLenPolicy int
+
+const (
+	// TruncateMsg delivers the text cut short, ending with truncatedSuffix.
+	TruncateMsg MsgLenPolicy = iota
+	// RejectMsg drops the message and replies with ERR_INPUTTOOLONG.
+	RejectMsg
+)
+
+// truncatedSuffix indicates that the text of a message was truncated.
+const truncatedSuffix = "..."
+
+// fitMessage makes sure that msg fits within MaxMessageLen. PRIVMSG and
+// NOTICE messages with an oversized trailing are split into multiple messages,
+// preferably on whitespace. Numeric replies are truncated on a rune boundary.
+// Anything else is returned as is.
+func fitMessage(msg *irc.Message) []*irc.Message {
+	if msg.Len() <= MaxMessageLen {
+		return []*irc.Message{msg}
+	}
+
+	// Length of the message without the trailing, plus the " :" separator.
+	head := *msg
+	head.Trailing = ""
+	head.EmptyTrailing = false
+	avail := MaxMessageLen - head.Len() - 2
+	if avail <= 0 {
+		return []*irc.Message{msg}
+	}
+
+	switch {
+	case msg.Command == irc.PRIVMSG || msg.Command == irc.NOTICE:
+		parts := splitText(msg.Trailing, avail)
+		r := make([]*irc.Message, 0, len(parts))
+		for _, part := range parts {
+			m := head
+			m.Trailing = part
+			r = append(r, &m)
+		}
+		return r
+	case isNumeric(msg.Command):
+		m := head
+		m.Trailing = truncateText(msg.Trailing, avail)
+		return []*irc.Message{&m}
+	}
+	return []*irc.Message{msg}
+}
+
+// splitText breaks text into parts of at most n bytes, on the last whitespace
+// within each part if possible, otherwise on a rune boundary.
+func splitText(text string, n int) []string {
+	parts := []string{}
+	for len(text) > n {
+		part := truncateText(text, n)
+		if i := strings.LastIndexByte(part, ' '); i > 0 {
+			part = part[:i]
+			text = text[i+1:]
+		} else {
+			text = text[len(part):]
+		}
+		parts = append(parts, part)
+	}
+	return append(parts, text)
+}
+
+// limitText returns the text cut short to fit within max bytes, ending with
+// truncatedSuffix, if it exceeds it. The max must fit truncatedSuffix.
+func limitText(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	return truncateText(text, max-len(truncatedSuffix)) + truncatedSuffix
+}
+
+// truncateText returns at most n bytes of text without splitting a rune.
+func truncateText(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
+
+// validUTF8 returns whether the parameters and trailing of msg are valid
+// UTF-8.
+func validUTF8(msg *irc.Message) bool {
+	for _, param := range msg.Params {
+		if !utf8.ValidString(param) {
+			return false
+		}
+	}
+	return utf8.ValidString(msg.Trailing)
+}
+
+// lineLen returns the length of msg encoded as a line with its tags, including
+// the trailing CR-LF.
+func lineLen(tags Tags, msg *irc.Message) uint64 {
+	n := msg.Len() + len(crlf)
+	if len(tags) > 0 {
+		// "@" and the separating space.
+		n += len(tags.String()) + 2
+	}
+	return uint64(n)
+}
+
+// isNumeric returns whether the command is a numeric reply.
+func isNumeric(command string) bool {
+	if len(command) != 3 {
+		return false
+	}
+	for _, c := range command {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
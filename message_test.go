@@ -0,0 +1,127 @@
+package irckit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestFitMessage(t *testing.T) {
+	prefix := &irc.Prefix{Name: "foo", User: "root", Host: "client"}
+	words := strings.Repeat("hello world ", 100)
+	msg := &irc.Message{
+		Prefix:   prefix,
+		Command:  irc.PRIVMSG,
+		Params:   []string{"#chat"},
+		Trailing: strings.TrimSpace(words),
+	}
+	msgs := fitMessage(msg)
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages; got %d", len(msgs))
+	}
+	parts := []string{}
+	for _, m := range msgs {
+		if m.Len() > MaxMessageLen {
+			t.Errorf("message too long (%d): %s", m.Len(), m)
+		}
+		if strings.HasPrefix(m.Trailing, " ") || strings.HasSuffix(m.Trailing, " ") {
+			t.Errorf("expected split on whitespace; got %q", m.Trailing)
+		}
+		parts = append(parts, m.Trailing)
+	}
+	if got := strings.Join(parts, " "); got != msg.Trailing {
+		t.Errorf("split text doesn't match:\ngot\t%q\nwant\t%q", got, msg.Trailing)
+	}
+
+	// No whitespace to split on, don't break runes.
+	msg.Trailing = strings.Repeat("é", 300)
+	msgs = fitMessage(msg)
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages; got %d", len(msgs))
+	}
+	if got := msgs[0].Trailing + msgs[1].Trailing; got != msg.Trailing {
+		t.Errorf("split text doesn't match")
+	}
+
+	numeric := &irc.Message{
+		Prefix:   &irc.Prefix{Name: testServerName},
+		Command:  irc.RPL_TOPIC,
+		Params:   []string{"foo", "#chat"},
+		Trailing: strings.Repeat("é", 300),
+	}
+	msgs = fitMessage(numeric)
+	if len(msgs) != 1 || msgs[0].Len() > MaxMessageLen {
+		t.Fatalf("expected numeric to be truncated; got %v", msgs)
+	}
+	if !strings.HasPrefix(numeric.Trailing, msgs[0].Trailing) {
+		t.Errorf("expected truncation on a rune boundary; got %q", msgs[0].Trailing)
+	}
+}
+
+func TestServerSplitMessage(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1 := NewConnMock("client1", 20)
+	c2 := NewConnMock("client2", 20)
+	go srv.Connect(NewUser(c1))
+	go srv.Connect(NewUser(c2))
+
+	c1.receive <- irc.ParseMessage("NICK foo")
+	c1.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz Quux")
+	expectEvent(t, events, ConnectEvent)
+
+	c1.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, NewChanEvent)
+	expectEvent(t, events, JoinEvent)
+	c2.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, JoinEvent)
+	receiveWelcome(t, c2)
+	receiveUntil(t, c2, irc.RPL_ENDOFNAMES)
+
+	text := strings.TrimSpace(strings.Repeat("lorem ipsum ", 60))
+	c1.receive <- irc.ParseMessage("PRIVMSG #chat :" + text)
+	expectEvent(t, events, ChanMsgEvent)
+	parts := []string{}
+	for i := 0; i < 2; i++ {
+		msg := receiveReply(t, c2)
+		if msg.Len() > MaxMessageLen {
+			t.Errorf("message too long (%d): %s", msg.Len(), msg)
+		}
+		parts = append(parts, msg.Trailing)
+	}
+	if got := strings.Join(parts, " "); got != text {
+		t.Errorf("split text doesn't match:\ngot\t%q\nwant\t%q", got, text)
+	}
+}
+
+func TestLimitText(t *testing.T) {
+	tests := []struct {
+		text string
+		max  int
+		want string
+	}{
+		{"hello", 5, "hello"},
+		{"hello, world", 8, "hello..."},
+		{"hello", 3, "..."},
+		{"héllo", 5, "h..."},
+	}
+	for _, test := range tests {
+		if got := limitText(test.text, test.max); got != test.want {
+			t.Errorf("limitText(%q, %d) = %q; want %q", test.text, test.max, got, test.want)
+		}
+	}
+
+	// Limits which can't fit the suffix are raised to fit it.
+	srv := ServerConfig{Name: testServerName, MaxMsgLen: 1}.Server()
+	defer srv.Close()
+	if got := srv.Config().MaxMsgLen; got != len(truncatedSuffix) {
+		t.Errorf("got MaxMsgLen %d; want %d", got, len(truncatedSuffix))
+	}
+}
@@ -1,8 +1,16 @@
 package irckit
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sorcix/irc"
 )
@@ -17,10 +25,171 @@ type Conn interface {
 	ResolveHost() string
 }
 
+// ErrLineTooLong is returned by Decode when a received line exceeds the
+// maximum line length. The rest of the line is discarded.
+var ErrLineTooLong = errors.New("line too long")
+
+// defaultMaxLineLen fits a message with the maximum length of client tags.
+const defaultMaxLineLen = 4096 + 512
+
+var crlf = []byte("\r\n")
+
+// lineLimiter is implemented by a Conn which supports limiting the length of
+// received lines.
+type lineLimiter interface {
+	setMaxLineLen(int)
+}
+
+// writeTimeouter is implemented by a Conn which supports a deadline on its
+// writes.
+type writeTimeouter interface {
+	setWriteTimeout(time.Duration)
+}
+
 type conn struct {
 	net.Conn
-	*irc.Encoder
-	*irc.Decoder
+	reader     *bufio.Reader
+	maxLineLen int
+
+	mu           sync.Mutex
+	writer       *bufio.Writer
+	writeTimeout time.Duration
+	flushPending bool // Whether a Flush is scheduled for the buffered writes
+}
+
+// newConn wraps a net.Conn with buffered reads and writes.
+func newConn(c net.Conn) *conn {
+	return &conn{
+		Conn:       c,
+		reader:     bufio.NewReader(c),
+		maxLineLen: defaultMaxLineLen,
+		writer:     bufio.NewWriter(c),
+	}
+}
+
+func (c *conn) setMaxLineLen(n int) {
+	c.maxLineLen = n
+}
+
+func (c *conn) setWriteTimeout(d time.Duration) {
+	c.mu.Lock()
+	c.writeTimeout = d
+	c.mu.Unlock()
+}
+
+// startWrite sets the write deadline, if any, for the next write. Must hold
+// c.mu.
+func (c *conn) startWrite() {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+}
+
+// writeFailed closes the connection if the write timed out, since the peer
+// is not reading and the connection can't be trusted to recover. Closing it
+// fails the pending Decode, which disconnects the User.
+func (c *conn) writeFailed(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.Conn.Close()
+	}
+	return err
+}
+
+// readLine reads until the end of the line, or returns ErrLineTooLong once the
+// rest of an overlong line has been discarded.
+func (c *conn) readLine() (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			tooLong = len(line) > c.maxLineLen
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return "", ErrLineTooLong
+	}
+	return string(line), nil
+}
+
+// Decode reads the next message, discarding any tags.
+func (c *conn) Decode() (*irc.Message, error) {
+	_, msg, err := c.DecodeTags()
+	return msg, err
+}
+
+// DecodeTags reads the next message along with its tags.
+func (c *conn) DecodeTags() (Tags, *irc.Message, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, nil, err
+	}
+	tags, msg := parseLine(line)
+	return tags, msg, nil
+}
+
+// Encode buffers the message to be sent on the next Flush.
+func (c *conn) Encode(msg *irc.Message) error {
+	return c.EncodeTags(nil, msg)
+}
+
+// EncodeTags buffers the message prefixed with its tags to be sent on the
+// next Flush, which is scheduled once the buffer is no longer empty. Messages
+// which are encoded before it runs, such as the rest of a burst, are sent
+// along with it.
+func (c *conn) EncodeTags(tags Tags, msg *irc.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The buffer may fill up and write through, so the deadline applies here
+	// too.
+	c.startWrite()
+	if len(tags) > 0 {
+		c.writer.WriteString("@" + tags.String() + " ")
+	}
+	c.writer.Write(msg.Bytes())
+	if _, err := c.writer.Write(crlf); err != nil {
+		return c.writeFailed(err)
+	}
+	if !c.flushPending {
+		c.flushPending = true
+		go c.Flush()
+	}
+	return nil
+}
+
+// Flush sends any buffered messages.
+func (c *conn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushPending = false
+	if c.writer.Buffered() == 0 {
+		return nil
+	}
+	c.startWrite()
+	if err := c.writer.Flush(); err != nil {
+		return c.writeFailed(err)
+	}
+	return nil
+}
+
+// closeFlushTimeout bounds how long Close waits for buffered messages to be
+// sent, so that a peer which isn't reading can't hold up the disconnect.
+const closeFlushTimeout = time.Second
+
+// Close sends any buffered messages before closing the connection.
+func (c *conn) Close() error {
+	// Setting the deadline also unblocks a pending write.
+	c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+	c.Flush()
+	return c.Conn.Close()
 }
 
 // resolveHost will convert an IP to a Hostname, but fall back to IP on error.
@@ -40,3 +209,69 @@ func (c *conn) ResolveHost() string {
 
 	return strings.TrimSuffix(names[0], ".")
 }
+
+// secureConn is implemented by a Conn which can tell whether it's encrypted.
+type secureConn interface {
+	Secure() bool
+}
+
+// Secure returns whether the connection uses TLS.
+func (c *conn) Secure() bool {
+	_, ok := c.Conn.(*tls.Conn)
+	return ok
+}
+
+// certConn is implemented by a Conn which can identify the client
+// certificate of the other end.
+type certConn interface {
+	CertFingerprint() string
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the client certificate,
+// in hex, or an empty string if there is none. It's only known once the TLS
+// handshake is completed.
+func (c *conn) CertFingerprint() string {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// remoteIP returns the IP address of the Conn's RemoteAddr, or an empty string
+// if it doesn't have one.
+func remoteIP(c Conn) string {
+	nc, ok := c.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(nc.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return ip
+}
+
+// ConnectLoopback connects a new User to the server over an in-memory
+// net.Pipe, and returns it along with the client's end of the pipe. The
+// handshake runs in the background until the client registers with NICK and
+// USER. Writes to the pipe block until they're read, so the client should be
+// read continuously.
+func ConnectLoopback(srv Server) (*User, io.ReadWriteCloser) {
+	server, client := net.Pipe()
+	u := srv.Config().NewUser(server)
+	go srv.Connect(u)
+	return u, client
+}
+
+// ConnectNet creates a User for the network connection with the server's
+// NewUser constructor and connects it. Blocks until the handshake is completed
+// or failed with an error.
+func ConnectNet(srv Server, c net.Conn) error {
+	return srv.Connect(srv.Config().NewUser(c))
+}
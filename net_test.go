@@ -0,0 +1,375 @@
+package irckit
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			tb.Error(err)
+		}
+		accepted <- c
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return <-accepted, client
+}
+
+func TestUserNetEncodeFlush(t *testing.T) {
+	server, client := tcpPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	u := NewUserNet(server)
+	r := bufio.NewReader(client)
+
+	err := u.Encode(
+		&irc.Message{Command: irc.PING, Trailing: "one"},
+		&irc.Message{Command: irc.PING, Trailing: "two"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"PING :one\r\n", "PING :two\r\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Errorf("got %q; want %q", line, want)
+		}
+	}
+
+	err = u.EncodeTags(Tags{"label": "x"}, &irc.Message{Command: irc.PING, Trailing: "three"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := r.ReadString('\n'); line != "@label=x PING :three\r\n" {
+		t.Errorf("got %q", line)
+	}
+}
+
+// unbufferedConn writes each message straight to the connection, as conns did
+// before their writes were buffered.
+type unbufferedConn struct {
+	net.Conn
+	*irc.Encoder
+}
+
+func (c unbufferedConn) Decode() (*irc.Message, error) {
+	return nil, io.EOF
+}
+
+func (c unbufferedConn) ResolveHost() string {
+	return "unbuffered"
+}
+
+func benchmarkBroadcast(b *testing.B, buffered bool) {
+	server, client := tcpPair(b)
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	u := NewUserNet(server)
+	if !buffered {
+		u = NewUser(unbufferedConn{server, irc.NewEncoder(server)})
+	}
+	msg := &irc.Message{
+		Prefix:   &irc.Prefix{Name: "foo", User: "root", Host: "client"},
+		Command:  irc.PRIVMSG,
+		Params:   []string{"#chat"},
+		Trailing: "hello, is it me you're looking for?",
+	}
+
+	// Channel messages are relayed to each member with their own Encode.
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 20; j++ {
+			u.Encode(msg)
+		}
+	}
+}
+
+func BenchmarkBroadcastBuffered(b *testing.B)   { benchmarkBroadcast(b, true) }
+func BenchmarkBroadcastUnbuffered(b *testing.B) { benchmarkBroadcast(b, false) }
+
+func TestServerLineTooLong(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:       testServerName,
+		MaxLineLen: 100,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	server, client := tcpPair(t)
+	defer client.Close()
+	go srv.Connect(NewUserNet(server))
+
+	io.WriteString(client, "NICK foo\r\nUSER root 0 * :Foo Bar\r\n")
+	expectEvent(t, events, ConnectEvent)
+
+	io.WriteString(client, "PRIVMSG foo :"+strings.Repeat("x", 200)+"\r\n")
+	r := bufio.NewReader(client)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected ERROR before disconnect; got: %v", err)
+		}
+		if strings.HasPrefix(line, ":testserver ERROR") {
+			if want := ":testserver ERROR :Request too long\r\n"; line != want {
+				t.Errorf("got %q; want %q", line, want)
+			}
+			break
+		}
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected disconnect; got: %v", err)
+	}
+}
+
+// readLines reads lines from r in the background until it's closed.
+func readLines(r io.Reader) <-chan string {
+	lines := make(chan string, 20)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	return lines
+}
+
+// expectLine consumes lines until one has the given prefix.
+func expectLine(t *testing.T, lines <-chan string, prefix string) {
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("closed while waiting for %q", prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return
+			}
+		case <-time.After(expectTimeout):
+			t.Fatalf("timed out waiting for %q", prefix)
+		}
+	}
+}
+
+func TestConnectLoopback(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	_, c1 := ConnectLoopback(srv)
+	defer c1.Close()
+	lines1 := readLines(c1)
+	io.WriteString(c1, "NICK foo\r\nUSER root 0 * :Foo Bar\r\nJOIN #chat\r\n")
+	expectLine(t, lines1, ":testserver 001 foo ")
+	expectLine(t, lines1, ":foo!root@pipe JOIN #chat")
+
+	_, c2 := ConnectLoopback(srv)
+	defer c2.Close()
+	lines2 := readLines(c2)
+	io.WriteString(c2, "NICK baz\r\nUSER root 0 * :Baz Quux\r\nJOIN #chat\r\n")
+	expectLine(t, lines2, ":baz!root@pipe JOIN #chat")
+	expectLine(t, lines1, ":baz!root@pipe JOIN #chat")
+}
+
+func TestConnectNewUser(t *testing.T) {
+	srv := ServerConfig{
+		Name: testServerName,
+		NewUser: func(c net.Conn) *User {
+			u := NewUserNet(c)
+			u.account = "preset"
+			return u
+		},
+	}.Server()
+	defer srv.Close()
+
+	u, c := ConnectLoopback(srv)
+	defer c.Close()
+	lines := readLines(c)
+	io.WriteString(c, "NICK foo\r\nUSER root 0 * :Foo Bar\r\n")
+	expectLine(t, lines, ":testserver 001 foo ")
+
+	if other, ok := srv.HasUser("foo"); !ok || other != u {
+		t.Fatal("expected the User from NewUser to be registered")
+	}
+	if got := u.Account(); got != "preset" {
+		t.Errorf("got account %q; want %q", got, "preset")
+	}
+}
+
+func TestUserNetSecure(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	if NewUserNet(server).Secure() {
+		t.Error("plain connection reported as secure")
+	}
+	if !NewUserNet(tls.Server(server, &tls.Config{})).Secure() {
+		t.Error("TLS connection not reported as secure")
+	}
+}
+
+// testCert returns a self-signed certificate for name.
+func testCert(tb testing.TB, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServerCertAuth(t *testing.T) {
+	clientCert := testCert(t, "foo")
+	sum := sha256.Sum256(clientCert.Certificate[0])
+	fingerprint := hex.EncodeToString(sum[:])
+
+	srv := ServerConfig{
+		Name: testServerName,
+		CertAuthenticator: func(fp string) (string, bool) {
+			return "fooaccount", fp == fingerprint
+		},
+	}.Server()
+	defer srv.Close()
+
+	server, client := tcpPair(t)
+	defer client.Close()
+	go srv.Connect(NewUserNet(tls.Server(server, &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, testServerName)},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})))
+
+	c := tls.Client(client, &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+	})
+	io.WriteString(c, "NICK foo\r\nUSER root 0 * :Foo Bar\r\n")
+	lines := readLines(c)
+	expectLine(t, lines, ":testserver 900 foo foo!root@")
+
+	u, ok := srv.HasUser("foo")
+	if !ok {
+		t.Fatal("user not registered")
+	}
+	if got := u.Account(); got != "fooaccount" {
+		t.Errorf("got account %q; want fooaccount", got)
+	}
+	if got := u.CertFingerprint(); got != fingerprint {
+		t.Errorf("got fingerprint %q; want %q", got, fingerprint)
+	}
+
+	io.WriteString(c, "WHOIS foo\r\n")
+	expectLine(t, lines, ":testserver 276 foo foo :has client certificate fingerprint "+fingerprint)
+}
+
+func TestServerWriteTimeout(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:         testServerName,
+		WriteTimeout: 50 * time.Millisecond,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	_, c := ConnectLoopback(srv)
+	defer c.Close()
+	io.WriteString(c, "NICK foo\r\nUSER root 0 * :Foo Bar\r\n")
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, ":testserver 376 foo ") {
+			break
+		}
+	}
+	expectEvent(t, events, ConnectEvent)
+
+	// Stop reading, so the reply blocks until the write deadline.
+	io.WriteString(c, "PING :hello\r\n")
+	deadline := time.Now().Add(expectTimeout)
+	for {
+		if _, ok := srv.HasUser("foo"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected foo to be disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected closed connection; got: %v", err)
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	srv := ServerConfig{
+		Name:             testServerName,
+		HandshakeTimeout: 50 * time.Millisecond,
+	}.Server()
+	defer srv.Close()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Connect(NewUserNet(server)) }()
+
+	// Say nothing, so the handshake never completes.
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrHandshakeTimeout) || !errors.Is(err, ErrHandshakeFailed) {
+			t.Errorf("got %v; want %v", err, ErrHandshakeTimeout)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatal("timed out waiting for the handshake to be reaped")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected closed connection; got: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package irckit
+
+import (
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+// OfflineStore queues private messages for Nicks which are not connected, to
+// be replayed when they next connect.
+type OfflineStore interface {
+	// Store queues the PRIVMSG for the nick, returns whether it was queued.
+	Store(nick string, msg *irc.Message) bool
+	// Drain removes and returns the messages queued for the nick.
+	Drain(nick string) []*irc.Message
+}
+
+// MemoryOfflineStore returns an OfflineStore which keeps up to size messages
+// per nick in memory.
+func MemoryOfflineStore(size int) OfflineStore {
+	return &memOfflineStore{
+		size:     size,
+		messages: map[string][]*irc.Message{},
+	}
+}
+
+type memOfflineStore struct {
+	mu       sync.Mutex
+	size     int
+	messages map[string][]*irc.Message
+}
+
+func (store *memOfflineStore) Store(nick string, msg *irc.Message) bool {
+	id := ID(nick)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.messages[id]) >= store.size {
+		return false
+	}
+	store.messages[id] = append(store.messages[id], msg)
+	return true
+}
+
+func (store *memOfflineStore) Drain(nick string) []*irc.Message {
+	id := ID(nick)
+	store.mu.Lock()
+	msgs := store.messages[id]
+	delete(store.messages, id)
+	store.mu.Unlock()
+	return msgs
+}
@@ -29,6 +29,24 @@ const (
 	NewChanEvent
 	// ShutdownEvent is emitted when the server shuts down.
 	ShutdownEvent
+	// CloseChanEvent is emitted when a Channel is closed and its members evicted.
+	CloseChanEvent
+	// TopicEvent is emitted when the topic of a Channel is set.
+	TopicEvent
+	// UndeliveredMsgEvent is emitted when a User sends a message to a Nick
+	// (or Channel) which doesn't exist.
+	UndeliveredMsgEvent
+	// DestroyChanEvent is emitted when a Channel is removed from the Server,
+	// such as when it's discarded for being empty.
+	DestroyChanEvent
+	// KickEvent is emitted when a User is kicked from a Channel. The User of
+	// the event is the one who was kicked.
+	KickEvent
+	// InviteEvent is emitted when a User invites another to a Channel. The
+	// User of the event is the inviter, and the Message is the INVITE with
+	// the Nick of the invited User as its first parameter. The event is a
+	// TargetEvent whose Target is the invited User.
+	InviteEvent
 )
 
 type event struct {
@@ -71,13 +89,29 @@ type Event interface {
 	Message() *irc.Message
 }
 
+// TargetEvent is an Event which acts on another User than the one who
+// triggered it, such as an InviteEvent.
+type TargetEvent interface {
+	Event
+	// Target is the User acted on.
+	Target() *User
+}
+
+type targetEvent struct {
+	event
+	target *User
+}
+
+func (evt targetEvent) Target() *User { return evt.target }
+
 // Publisher emits Events to existing subscribers.
 type Publisher interface {
 	// Subscribe registers channel to receive events. Will skip events if channel is full.
 	Subscribe(chan<- Event)
 
-	// Unsubscribe stops the channel from receiving further events. Returns false if channel was not subscribed to start with.
-	// TODO: Unsubcribe(chan<- Event) bool
+	// Unsubscribe stops the channel from receiving further events, without
+	// closing it. Returns false if channel was not subscribed to start with.
+	Unsubscribe(chan<- Event) bool
 
 	// Publish emits the Event to all the subscribers.
 	Publish(Event)
@@ -103,6 +137,18 @@ func (pub *publisher) Subscribe(sub chan<- Event) {
 	pub.mu.Unlock()
 }
 
+func (pub *publisher) Unsubscribe(sub chan<- Event) bool {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	for i, s := range pub.subscribers {
+		if s == sub {
+			pub.subscribers = append(pub.subscribers[:i:i], pub.subscribers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (pub *publisher) Publish(evt Event) {
 	// TODO: Should this be non-blocking? Could do that with the broadcast channel.
 	pub.mu.Lock()
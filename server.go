@@ -3,6 +3,9 @@ package irckit
 import (
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -10,17 +13,242 @@ import (
 	"github.com/sorcix/irc"
 )
 
+// ErrHandshakeFailed matches any HandshakeError with errors.Is.
 var ErrHandshakeFailed = errors.New("handshake failed")
 
+// ErrTooManyAttempts is the cause of a HandshakeError when the User sent too
+// many registration commands without completing registration.
+var ErrTooManyAttempts = errors.New("too many registration attempts")
+
+// HandshakeError is returned by Connect when the User fails to register. The
+// cause, such as ErrBanned, ErrTooManyAttempts or a read error from the Conn,
+// can be retrieved with errors.Is or errors.As.
+type HandshakeError struct {
+	Host string // Real host of the User
+	Err  error  // Cause of the failure
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake failed for %s: %s", e.Host, e.Err)
+}
+
+// Unwrap returns the cause of the failure.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrHandshakeFailed.
+func (e *HandshakeError) Is(target error) bool {
+	return target == ErrHandshakeFailed
+}
+
+// ValidateServerName returns an error unless the name is a hostname-like
+// token which is safe to use in the prefix of messages: 1 to 63 letters,
+// digits, '-', '_' or '.', not starting with '-' or '.'.
+func ValidateServerName(name string) error {
+	if name == "" || len(name) > maxServerNameLen {
+		return fmt.Errorf("invalid server name %q: must be 1 to %d characters", name, maxServerNameLen)
+	}
+	if name[0] == '-' || name[0] == '.' {
+		return fmt.Errorf("invalid server name %q: must start with a letter or digit", name)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return fmt.Errorf("invalid server name %q: unexpected character %q", name, c)
+		}
+	}
+	return nil
+}
+
+// ErrBanned is returned by Connect when the User matches a ban.
+var ErrBanned = errors.New("banned")
+
+// ErrRefused is returned by Connect when the User's address is not allowed by
+// ServerConfig.AllowCIDRs and DenyCIDRs.
+var ErrRefused = errors.New("connection refused")
+
+// ErrInvalidWebIRC is the cause of a HandshakeError when a WEBIRC gateway
+// gives an address which is not an IP.
+var ErrInvalidWebIRC = errors.New("invalid WEBIRC address")
+
+// ErrHandshakeTimeout is returned by Connect when the User doesn't register
+// within ServerConfig.HandshakeTimeout.
+var ErrHandshakeTimeout = errors.New("handshake timed out")
+
+// ErrNoSuchChannel is returned by RenameChannel when the channel doesn't
+// exist, or can't be renamed.
+var ErrNoSuchChannel = errors.New("no such channel")
+
+// ErrChannelExists is returned by RenameChannel when the new name is taken by
+// another channel.
+var ErrChannelExists = errors.New("channel already exists")
+
+// ErrInvalidChannelName is returned by RenameChannel when the new name is not
+// a channel name.
+var ErrInvalidChannelName = errors.New("invalid channel name")
+
 var defaultVersion = "go-irckit"
 
+var defaultServerName = "go-irckit"
+
+const (
+	defaultPingInterval = 60 * time.Second
+	defaultPingTimeout  = 30 * time.Second
+	defaultWriteTimeout = 30 * time.Second
+
+	defaultHandshakeTimeout = 60 * time.Second
+
+	defaultNickChangeWindow = time.Minute
+
+	defaultMaxAwayLen = 200
+)
+
+// minAutoAwayInterval is the shortest interval between checks for idle Users,
+// however short AutoAway is.
+const minAutoAwayInterval = 10 * time.Millisecond
+
+// maxServerNameLen is the maximum length of a server name, as in RFC 2812.
+const maxServerNameLen = 63
+
+// handshakeMsgTolerance is the number of registration attempts (NICK, USER
+// or PASS messages) after which the handshake is given up. Other messages,
+// such as CAP negotiation, don't count towards it.
 const handshakeMsgTolerance = 20
 
+// Commands and replies which are not defined by github.com/sorcix/irc.
+const (
+	cmdWebIRC   = "WEBIRC"
+	cmdSanick   = "SANICK"
+	cmdSajoin   = "SAJOIN"
+	cmdAccount  = "ACCOUNT"
+	cmdBatch    = "BATCH"
+	cmdAck      = "ACK"
+	cmdSilence  = "SILENCE"
+	cmdKline    = "KLINE"
+	cmdUnkline  = "UNKLINE"
+	cmdRelayMsg = "RELAYMSG"
+	cmdUserIP   = "USERIP"
+	cmdRedact   = "REDACT"
+	cmdFail     = "FAIL"
+	cmdCheck    = "CHECK"
+	cmdRename   = "RENAME"
+
+	cmdIdleChannels = "IDLECHANNELS"
+
+	batchLabeledResponse = "labeled-response"
+	batchMultiline       = "draft/multiline"
+
+	capNew = "NEW"
+	capDel = "DEL"
+
+	errUnknownError  = "400"
+	errInvalidCapCmd = "410"
+	errLinkChannel   = "470"
+	errInputTooLong  = "417"
+	errSileListFull  = "511"
+	rplISupport      = "005"
+	rplSileList      = "271"
+	rplEndOfSileList = "272"
+	rplTopicWhoTime  = "333"
+	rplUserIP        = "340"
+	errNickTooFast   = "438"
+	rplWhoisSecure   = "671"
+	rplWhoisCertFP   = "276"
+	rplWhoisHost     = "378"
+	rplLoggedIn      = "900"
+)
+
+// maxSilence is the maximum number of entries in a User's silence list.
+const maxSilence = 32
+
+// Capabilities implemented by the server.
+const (
+	// CapNotify is for receiving CAP NEW and CAP DEL when the server's
+	// capabilities change. It's implied by CAP LS 302.
+	CapNotify = "cap-notify"
+	// CapAccountNotify is for receiving ACCOUNT when a visible User logs in
+	// or out.
+	CapAccountNotify = "account-notify"
+	// CapAccountTag is for receiving the account tag on messages from Users
+	// who are logged in.
+	CapAccountTag = "account-tag"
+	// CapLabeledResponse is for receiving the label of a command on all of
+	// its responses.
+	CapLabeledResponse = "labeled-response"
+	// CapBatch is for receiving related messages grouped in a BATCH.
+	CapBatch = "batch"
+	// CapRelayMsg is for receiving the nick of the relaying User as the
+	// draft/relaymsg tag on messages injected with RELAYMSG. Its value is
+	// the separator which relay nicks must contain.
+	CapRelayMsg = "draft/relaymsg"
+	// CapMessageRedaction is for receiving REDACT when a message is
+	// removed by a moderator.
+	CapMessageRedaction = "draft/message-redaction"
+	// CapMultiline is for sending and receiving messages of several lines as
+	// a draft/multiline BATCH. Its value advertises the limits of a batch.
+	CapMultiline = "draft/multiline"
+	// CapMessageTags is for receiving tags which aren't covered by another
+	// capability, such as the msgid of messages.
+	CapMessageTags = "message-tags"
+	// CapChannelRename is for receiving RENAME when a channel is renamed,
+	// instead of a PART and JOIN.
+	CapChannelRename = "draft/channel-rename"
+)
+
+// relayNickSeparator must appear in relay nicks, so that they can't be
+// mistaken for the nicks of connected Users.
+const relayNickSeparator = "/"
+
 // ID will normalize a name to be used as a unique identifier for comparison.
 func ID(s string) string {
 	return strings.ToLower(s)
 }
 
+// CaseMapping selects how nicks and channel names are folded to compare them
+// case-insensitively. It's advertised as CASEMAPPING in RPL_ISUPPORT.
+type CaseMapping string
+
+const (
+	// CaseMappingASCII folds only the letters A to Z.
+	CaseMappingASCII CaseMapping = "ascii"
+	// CaseMappingRFC1459 also folds the characters []\~ to {}|^, as in
+	// RFC 1459.
+	CaseMappingRFC1459 CaseMapping = "rfc1459"
+)
+
+// Fold returns the name in lowercase according to the case mapping. Any other
+// CaseMapping, including the empty one, folds with Unicode rules like ID.
+func (m CaseMapping) Fold(name string) string {
+	if m != CaseMappingASCII && m != CaseMappingRFC1459 {
+		return ID(name)
+	}
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			b[i] = c + 'a' - 'A'
+		case m != CaseMappingRFC1459:
+		case c == '[':
+			b[i] = '{'
+		case c == ']':
+			b[i] = '}'
+		case c == '\\':
+			b[i] = '|'
+		case c == '~':
+			b[i] = '^'
+		}
+	}
+	return string(b)
+}
+
+// IsChannelName returns whether the name has a channel prefix.
+func IsChannelName(name string) bool {
+	return name != "" && strings.IndexByte("#&+!", name[0]) >= 0
+}
+
 type Prefixer interface {
 	// Prefix returns a prefix configuration for the origin of the message.
 	Prefix() *irc.Prefix
@@ -36,6 +264,9 @@ type Server interface {
 	// Motd is the Message of the Day for the server.
 	Motd() []string
 
+	// Config returns the configuration of the server.
+	Config() ServerConfig
+
 	// Connect starts the handshake for a new user, blocks until it's completed or failed with an error.
 	Connect(*User) error
 
@@ -49,40 +280,277 @@ type Server interface {
 	// Returns whether the rename was was successful.
 	RenameUser(*User, string) bool
 
-	// Channel gets or creates a new channel with the given name.
+	// SetAccount associates the User with an account name, or logs them out
+	// if the name is empty.
+	SetAccount(*User, string)
+
+	// Channel gets or creates a new channel with the given name, publishing
+	// NewChanEvent if it's created. Use HasChannel for lookups which
+	// shouldn't have side effects.
 	Channel(string) Channel
 
-	// HasChannel returns an existing Channel with a given name.
+	// HasChannel returns an existing Channel with a given name. It never
+	// creates a Channel.
 	HasChannel(string) (Channel, bool)
 
+	// Channels returns a slice of all the existing Channels, sorted by ID.
+	Channels() []Channel
+
+	// Register gets or creates a channel with the given name which is kept
+	// even while it's empty, rather than being discarded.
+	Register(string) Channel
+
 	// UnlinkChannel removes the channel from the server's storage if it
 	// exists. Once removed, the server is free to create a fresh channel with
 	// the same ID. The server is not responsible for evicting members of an
 	// unlinked channel.
 	UnlinkChannel(Channel)
+
+	// CloseChannel evicts all the members of the channel and unlinks it.
+	CloseChannel(Channel)
+
+	// Ban refuses connections from Users who match the nick!user@host mask,
+	// and disconnects the matching Users who are already connected.
+	Ban(mask string, reason string)
+
+	// Unban removes a ban, returns whether it existed.
+	Unban(mask string) bool
+
+	// Caps returns the capabilities supported by the server, mapped to their
+	// CAP LS 302 values.
+	Caps() map[string]string
+
+	// SetCap adds or updates a supported capability and notifies the users
+	// who negotiated cap-notify.
+	SetCap(name string, value string)
+
+	// DelCap removes a supported capability and notifies the users who
+	// negotiated cap-notify.
+	DelCap(name string)
+}
+
+// UserLister is implemented by Servers which can list their Users.
+type UserLister interface {
+	// Users returns a slice of all the connected Users, sorted by ID.
+	Users() []*User
+}
+
+// ChannelFinder is implemented by Servers which can look up Channels by a
+// name or a mask.
+type ChannelFinder interface {
+	// LookupChannel returns an existing Channel with a given name, or nil
+	// if there is none. It never creates a Channel.
+	LookupChannel(string) Channel
+
+	// FindChannels returns a slice of the existing Channels whose names
+	// match the mask, as in MatchMask, sorted by ID.
+	FindChannels(mask string) []Channel
+}
+
+// ChannelRenamer is implemented by Servers which can rename Channels.
+type ChannelRenamer interface {
+	// RenameChannel changes the name of an existing channel, keeping its
+	// members and state. Members who negotiated draft/channel-rename are
+	// sent a RENAME, and the others a PART of the old name followed by a
+	// JOIN of the new one. Returns ErrChannelExists if the new name is
+	// taken.
+	RenameChannel(oldName string, newName string) error
+}
+
+// serverUsers returns the Users of the Server, or the members of its
+// Channels if it can't list them.
+func serverUsers(s Server) []*User {
+	if ul, ok := s.(UserLister); ok {
+		return ul.Users()
+	}
+	users := []*User{}
+	seen := map[*User]struct{}{}
+	for _, ch := range s.Channels() {
+		for _, u := range ch.Users() {
+			if _, ok := seen[u]; !ok {
+				seen[u] = struct{}{}
+				users = append(users, u)
+			}
+		}
+	}
+	return users
+}
+
+// findChannels returns the Channels of the Server whose names match the mask.
+func findChannels(s Server, mask string) []Channel {
+	if cf, ok := s.(ChannelFinder); ok {
+		return cf.FindChannels(mask)
+	}
+	channels := []Channel{}
+	for _, ch := range s.Channels() {
+		if MatchMask(mask, ch.String()) {
+			channels = append(channels, ch)
+		}
+	}
+	return channels
 }
 
 // ServerConfig produces a Server setup with configuration options.
 type ServerConfig struct {
-	// Name is used as the prefix for the server.
+	// Name is used as the prefix for the server. Names which fail
+	// ValidateServerName are replaced by the default. (default: go-irckit)
 	Name string
+	// Prefix overrides the prefix on messages from the server, such as to
+	// show a fully-qualified hostname while Name stays short. It's called
+	// for each message. (default: Name)
+	Prefix func() *irc.Prefix
 	// Version string of the server (default: go-irckit).
 	Version string
+	// NetworkName is advertised as NETWORK in RPL_ISUPPORT. It can't contain
+	// spaces. (default: Name)
+	NetworkName string
+	// WelcomeMessage is the text of RPL_WELCOME, which is followed by the
+	// User's full prefix. (default: "Welcome to the <NetworkName> IRC
+	// Network" if NetworkName is set, otherwise "Welcome!")
+	WelcomeMessage string
 	// Motd is the message of the day for the server, list of message lines where each line should be max 80 chars.
 	Motd []string
 	// InviteOnly prevents regular users from joining and making new channels.
 	InviteOnly bool
+	// Opers maps operator names to their passwords, for the OPER command.
+	Opers map[string]string
+	// CertAuthenticator maps the SHA-256 fingerprint of a TLS client
+	// certificate, in hex, to an account. Users presenting a certificate it
+	// accepts are logged in when they register, without SASL.
+	CertAuthenticator func(fingerprint string) (account string, ok bool)
+	// CaseMapping is how nicks and channel names are compared, unless
+	// Normalize is set. Names are displayed as they were given, while
+	// lookups ignore case. (default: Unicode lowercase, not advertised)
+	CaseMapping CaseMapping
+	// Normalize overrides how nicks and channel names are normalized for
+	// lookups, such as to fold accented characters. Channels created by
+	// NewChannel must return IDs normalized with it. (default: the Fold of
+	// CaseMapping)
+	Normalize func(name string) string
 	// MaxNickLen is the maximum length for a NICK value (default: 32)
 	MaxNickLen int
+	// MaxMsgLen is the maximum length of the text of a message sent to a
+	// channel or user, in bytes. There is no limit if zero.
+	MaxMsgLen int
+	// MsgLenPolicy is applied to messages which exceed MaxMsgLen.
+	// (default: TruncateMsg)
+	MsgLenPolicy MsgLenPolicy
+	// MaxTopicLen is the maximum length of a channel topic, in bytes, which
+	// is advertised as TOPICLEN in RPL_ISUPPORT. There is no limit if zero.
+	MaxTopicLen int
+	// TopicLenPolicy is applied to topics which exceed MaxTopicLen.
+	// (default: TruncateMsg)
+	TopicLenPolicy MsgLenPolicy
+	// MaxLineLen is the maximum length of a received line, including tags.
+	// Users who exceed it are disconnected. (default: 4608)
+	MaxLineLen int
+	// UTF8Only advertises UTF8ONLY and rejects messages with parameters,
+	// such as nicks, channel names and text, which aren't valid UTF-8.
+	UTF8Only bool
+	// CloakHost, if set, replaces the resolved host of a connecting User
+	// before it's used in any prefix. The real host is still retained.
+	CloakHost func(host string) string
+	// AllowCIDRs, if set, restricts connections to addresses in one of the
+	// ranges. Connections from unknown addresses are refused.
+	AllowCIDRs []*net.IPNet
+	// DenyCIDRs refuses connections from addresses in any of the ranges,
+	// before registration.
+	DenyCIDRs []*net.IPNet
+	// WebIRCPassword is the secret shared with trusted gateways (such as
+	// webchat front-ends) which may use WEBIRC to supply the real host of
+	// their clients. WEBIRC is ignored if empty.
+	WebIRCPassword string
+	// MaxNickChanges is the number of NICK commands a User can send within
+	// NickChangeWindow, beyond which they're refused with ERR_NICKTOOFAST.
+	// There is no limit if zero.
+	MaxNickChanges int
+	// NickChangeWindow is the period over which MaxNickChanges applies.
+	// (default: 1m)
+	NickChangeWindow time.Duration
+	// LogPrefix is prepended to the debug log lines of the server's
+	// connections, to tell apart several servers in one process.
+	LogPrefix string
+	// RawLog, if set, receives every line sent to and received from the
+	// server's connections, as "<prefix><user> -> <line>" for sent lines
+	// and "<-" for received ones, for debugging the protocol.
+	RawLog io.Writer
+	// AccessLog, if set, is called with each command received from a User,
+	// both during and after registration. It's called before the command
+	// is handled, and blocks the User's connection until it returns.
+	AccessLog func(AccessLogEntry)
+	// OperOverride lets operators join channels regardless of their key
+	// (+k) and limit (+l). Other operators are sent a notice whenever it
+	// makes a difference.
+	OperOverride bool
+	// PartAll makes a PART without any channels leave every channel the User
+	// is on. Otherwise it's rejected with ERR_NEEDMOREPARAMS.
+	PartAll bool
+	// Caps are the capabilities advertised by CAP LS, mapped to their values
+	// (which can be empty), in addition to the ones implemented by the server.
+	Caps map[string]string
 
 	// Publisher to use. If nil, a new SyncPublisher will be used.
 	Publisher Publisher
 	// DiscardEmpty setting will start a goroutine to discard empty channels.
 	DiscardEmpty bool
+	// KeepEmptyChannels keeps every channel while it's empty, as if it was
+	// created with Register, even if DiscardEmpty is set.
+	KeepEmptyChannels bool
 	// NewChannel overrides the constructor for a new Channel in a given Server and Name.
 	NewChannel func(s Server, name string) Channel
+	// NewUser overrides the constructor for a new User from a network
+	// connection, which is used by ConnectNet and ConnectLoopback. It can
+	// wrap the connection or fill in the User before the handshake.
+	// (default: NewUserNet)
+	NewUser func(c net.Conn) *User
+	// PingInterval is how long a connection can be quiet before the server
+	// sends a PING. Pings are disabled if negative. (default: 60s)
+	PingInterval time.Duration
+	// PingTimeout is how long to wait for a reply to a PING before
+	// disconnecting. (default: 30s)
+	PingTimeout time.Duration
+	// WriteTimeout is how long a write to a User's connection can block
+	// before the connection is considered dead and the User is
+	// disconnected. Applies to Conns created by NewUserNet. Disabled if
+	// negative. (default: 30s)
+	WriteTimeout time.Duration
+	// HandshakeTimeout is how long a connection has to register before it's
+	// closed. Disabled if negative. (default: 60s)
+	HandshakeTimeout time.Duration
+	// NotifyCorrespondents, if set, sends NICK changes to the Users who have
+	// exchanged private messages with the User, in addition to the ones who
+	// share a channel with them.
+	NotifyCorrespondents bool
+	// AutoAway, if set, marks Users as away after they have been idle for
+	// the duration, until their next message.
+	AutoAway time.Duration
+	// AutoAwayMsg is the away message of idle Users. (default: "Idle")
+	AutoAwayMsg string
+	// MaxAwayLen is the maximum length of an away message set with AWAY.
+	// Longer ones are truncated with "...". Disabled if negative.
+	// (default: 200)
+	MaxAwayLen int
+	// ChannelStore, if set, saves the state of channels which are discarded
+	// for being empty, and restores it when they're recreated.
+	ChannelStore ChannelStore
 	// Commands is the handler registry to use (default: DefaultCommands())
 	Commands Commands
+	// OnShutdown, if set, enables the operator-only DIE and RESTART
+	// commands, which call it with whether a restart was requested. It's up
+	// to the callback to actually stop the process.
+	OnShutdown func(restart bool)
+	// OnRehash, if set, enables the operator-only REHASH command, which
+	// calls it to reload the configuration.
+	OnRehash func() error
+	// OfflineStore, if set, queues private messages for nicks which are not
+	// connected and replays them when they next connect.
+	OfflineStore OfflineStore
+	// DeliveryReceipts reports the outcome of labeled private messages to
+	// users: the labeled ACK is only sent once the message is written to the
+	// target, and a FAIL is sent instead if the target is gone or the write
+	// fails. Requires the labeled-response capability. Only PRIVMSG gets
+	// receipts, since NOTICE must never be answered automatically.
+	DeliveryReceipts bool
 }
 
 func (c ServerConfig) Server() Server {
@@ -92,6 +560,9 @@ func (c ServerConfig) Server() Server {
 	if c.NewChannel == nil {
 		c.NewChannel = NewChannel
 	}
+	if c.NewUser == nil {
+		c.NewUser = NewUserNet
+	}
 	if c.Commands == nil {
 		c.Commands = DefaultCommands()
 	}
@@ -99,25 +570,103 @@ func (c ServerConfig) Server() Server {
 	if c.Version == "" {
 		c.Version = defaultVersion
 	}
+	c.Name = strings.TrimSpace(c.Name)
 	if c.Name == "" {
-		c.Name = "go-irckit"
+		c.Name = defaultServerName
+	} else if err := ValidateServerName(c.Name); err != nil {
+		logger.Warningf("%s, using %q instead", err, defaultServerName)
+		c.Name = defaultServerName
+	}
+	if strings.ContainsAny(c.NetworkName, " \r\n\x00") {
+		logger.Warningf("invalid network name %q: must not contain spaces, using %q instead", c.NetworkName, c.Name)
+		c.NetworkName = ""
+	}
+	if c.WelcomeMessage == "" {
+		if c.NetworkName != "" {
+			c.WelcomeMessage = fmt.Sprintf("Welcome to the %s IRC Network", c.NetworkName)
+		} else {
+			c.WelcomeMessage = "Welcome!"
+		}
+	}
+	if c.NetworkName == "" {
+		c.NetworkName = c.Name
 	}
 	if c.MaxNickLen == 0 {
 		c.MaxNickLen = 32
 	}
+	if c.PingInterval == 0 {
+		c.PingInterval = defaultPingInterval
+	}
+	if c.PingTimeout == 0 {
+		c.PingTimeout = defaultPingTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if c.MaxAwayLen == 0 {
+		c.MaxAwayLen = defaultMaxAwayLen
+	}
+	// Truncated text must have room for the suffix.
+	for _, max := range []*int{&c.MaxMsgLen, &c.MaxTopicLen, &c.MaxAwayLen} {
+		if *max > 0 && *max < len(truncatedSuffix) {
+			logger.Warningf("length limit %d is too short, using %d instead", *max, len(truncatedSuffix))
+			*max = len(truncatedSuffix)
+		}
+	}
+	if c.Normalize == nil {
+		c.Normalize = c.CaseMapping.Fold
+	}
+	if c.AutoAwayMsg == "" {
+		c.AutoAwayMsg = "Idle"
+	}
+	if c.MaxLineLen == 0 {
+		c.MaxLineLen = defaultMaxLineLen
+	}
+	if c.NickChangeWindow == 0 {
+		c.NickChangeWindow = defaultNickChangeWindow
+	}
+	if c.RawLog != nil {
+		c.RawLog = &syncWriter{w: c.RawLog}
+	}
+
+	caps := map[string]string{
+		CapNotify:           "",
+		CapAccountNotify:    "",
+		CapAccountTag:       "",
+		CapLabeledResponse:  "",
+		CapBatch:            "",
+		CapRelayMsg:         relayNickSeparator,
+		CapMessageRedaction: "",
+		CapMultiline:        fmt.Sprintf("max-bytes=%d,max-lines=%d", multilineMaxBytes, multilineMaxLines),
+		CapMessageTags:      "",
+		CapChannelRename:    "",
+	}
+	for name, value := range c.Caps {
+		caps[name] = value
+	}
 
 	srv := &server{
 		config:    c,
-		users:     map[string]*User{},
-		channels:  map[string]Channel{},
+		users:     newUserStore(),
+		channels:  newChannelStore(),
+		caps:      caps,
+		bans:      map[string]string{},
 		created:   time.Now(),
+		done:      make(chan struct{}),
 		commands:  c.Commands,
 		Publisher: c.Publisher,
 	}
 	if c.DiscardEmpty {
 		srv.channelEvents = make(chan Event, 1)
+		srv.watched = map[Channel]chan Event{}
 		go srv.cleanupEmpty()
 	}
+	if c.AutoAway > 0 {
+		go srv.autoAway()
+	}
 
 	return srv
 }
@@ -127,16 +676,64 @@ func NewServer(name string) Server {
 	return ServerConfig{Name: name}.Server()
 }
 
+// AccessLogEntry describes a command received from a User, for
+// ServerConfig.AccessLog.
+type AccessLogEntry struct {
+	Time    time.Time
+	User    *User
+	Command string
+	// Params of the command, including the trailing parameter, unless it
+	// carries credentials (such as PASS or OPER), in which case it's nil
+	// and Redacted is set.
+	Params   []string
+	Redacted bool
+}
+
+// redactedCommands carry credentials, so their parameters are not logged.
+var redactedCommands = map[string]bool{
+	irc.PASS:         true,
+	irc.AUTHENTICATE: true,
+	irc.OPER:         true,
+	cmdWebIRC:        true,
+}
+
+// accessLog passes the command to the AccessLog callback, if there is one.
+func (s *server) accessLog(u *User, msg *irc.Message) {
+	if s.config.AccessLog == nil {
+		return
+	}
+	entry := AccessLogEntry{
+		Time:     time.Now(),
+		User:     u,
+		Command:  msg.Command,
+		Redacted: redactedCommands[msg.Command],
+	}
+	if !entry.Redacted {
+		entry.Params = append([]string{}, msg.Params...)
+		if msg.Trailing != "" || msg.EmptyTrailing {
+			entry.Params = append(entry.Params, msg.Trailing)
+		}
+	}
+	s.config.AccessLog(entry)
+}
+
 type server struct {
 	created  time.Time
 	config   ServerConfig
 	commands Commands
 
+	users    *userStore
+	channels *channelStore
+
 	sync.RWMutex
 	count         int
-	users         map[string]*User
-	channels      map[string]Channel
+	caps          map[string]string
+	bans          map[string]string // Normalized masks to reasons
 	channelEvents chan Event
+	watched       map[Channel]chan Event // Per-channel subscriptions forwarded to channelEvents
+
+	closeOnce sync.Once
+	done      chan struct{}
 
 	Publisher
 }
@@ -149,29 +746,46 @@ func (s *server) Motd() []string {
 	return s.config.Motd
 }
 
+func (s *server) Config() ServerConfig {
+	return s.config
+}
+
 func (s *server) Close() error {
 	// TODO: Send notice or something?
 	// TODO: Clear channels?
-	s.Lock()
-	for _, u := range s.users {
+	s.closeOnce.Do(func() { close(s.done) })
+	for _, u := range s.users.all() {
 		u.Close()
 	}
 	s.Publisher.Close()
-	s.Unlock()
 	return nil
 }
 
 // Prefix returns the server's command prefix string.
 func (s *server) Prefix() *irc.Prefix {
+	if s.config.Prefix != nil {
+		return s.config.Prefix()
+	}
 	return &irc.Prefix{Name: s.config.Name}
 }
 
 // HasUser returns whether a given user is in the server.
 func (s *server) HasUser(nick string) (*User, bool) {
-	s.RLock()
-	u, exists := s.users[ID(nick)]
-	s.RUnlock()
-	return u, exists
+	return s.users.get(s.id(nick))
+}
+
+// id normalizes a nick or channel name for lookups.
+func (s *server) id(name string) string {
+	return s.config.Normalize(name)
+}
+
+// Users returns a slice of all the connected Users, sorted by ID.
+func (s *server) Users() []*User {
+	users := s.users.all()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID() < users[j].ID()
+	})
+	return users
 }
 
 // Rename will attempt to rename the given user's Nick if it's available.
@@ -180,9 +794,13 @@ func (s *server) RenameUser(u *User, newNick string) bool {
 		newNick = newNick[:s.config.MaxNickLen]
 	}
 
-	s.Lock()
-	if _, exists := s.users[ID(newNick)]; exists {
-		s.Unlock()
+	oldPrefix := u.Prefix()
+	// Changing only the case of the nick is allowed, but not keeping it.
+	newID := s.id(newNick)
+	ok := newNick != oldPrefix.Name && s.users.rename(u.ID(), newID, u, func() {
+		u.setNick(newNick, newID)
+	})
+	if !ok {
 		u.Encode(&irc.Message{
 			Prefix:   s.Prefix(),
 			Command:  irc.ERR_NICKNAMEINUSE,
@@ -192,105 +810,519 @@ func (s *server) RenameUser(u *User, newNick string) bool {
 		return false
 	}
 
-	delete(s.users, u.ID())
-	oldPrefix := u.Prefix()
-	u.Nick = newNick
-	s.users[u.ID()] = u
-	s.Unlock()
-
 	changeMsg := &irc.Message{
 		Prefix:  oldPrefix,
 		Command: irc.NICK,
 		Params:  []string{newNick},
 	}
-	u.Encode(changeMsg)
+	u.relay(u, changeMsg)
+	s.notifySeen(u, changeMsg)
+	return true
+}
+
+// notifySeen sends a message from the User to the other Users who should be
+// notified of changes to them, as in seenBy.
+func (s *server) notifySeen(u *User, msg *irc.Message) {
+	if !s.config.NotifyCorrespondents {
+		u.NotifySeen(msg)
+		return
+	}
+	for _, other := range s.seenBy(u) {
+		other.relay(u, msg)
+	}
+}
+
+// seenBy returns the other Users who should be notified of changes to the
+// User: the ones who share a channel with them, and their correspondents if
+// NotifyCorrespondents is set.
+func (s *server) seenBy(u *User) []*User {
+	users := u.VisibleTo()
+	if !s.config.NotifyCorrespondents {
+		return users
+	}
+	seen := make(map[*User]struct{}, len(users))
+	for _, other := range users {
+		seen[other] = struct{}{}
+	}
+	for _, other := range u.Correspondents() {
+		if _, dupe := seen[other]; !dupe {
+			users = append(users, other)
+		}
+	}
+	return users
+}
+
+// certAuth logs the User into the account which CertAuthenticator maps their
+// client certificate to, unless they're logged in already.
+func (s *server) certAuth(u *User) {
+	auth := s.config.CertAuthenticator
+	if auth == nil || u.Account() != "" {
+		return
+	}
+	fp := u.CertFingerprint()
+	if fp == "" {
+		return
+	}
+	account, ok := auth(fp)
+	if !ok {
+		return
+	}
+	s.SetAccount(u, account)
+	u.Encode(&irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  rplLoggedIn,
+		Params:   []string{u.Nick, u.Prefix().String(), account},
+		Trailing: "You are now logged in as " + account,
+	})
+}
+
+// SetAccount changes the account of the User, sending ACCOUNT to the users
+// who can see them and negotiated account-notify.
+func (s *server) SetAccount(u *User, account string) {
+	u.Lock()
+	u.account = account
+	u.Unlock()
+	name := account
+	if name == "" {
+		name = "*"
+	}
+	msg := &irc.Message{
+		Prefix:  u.Prefix(),
+		Command: cmdAccount,
+		Params:  []string{name},
+	}
 	for _, other := range u.VisibleTo() {
-		other.Encode(changeMsg)
+		if other.HasCap(CapAccountNotify) {
+			other.notify(nil, msg)
+		}
 	}
-	return true
 }
 
 // HasChannel returns whether a given channel already exists.
 func (s *server) HasChannel(name string) (Channel, bool) {
-	s.RLock()
-	ch, exists := s.channels[ID(name)]
-	s.RUnlock()
-	return ch, exists
+	return s.channels.get(s.id(name))
+}
+
+// LookupChannel returns the channel with the given name, or nil if it doesn't
+// exist.
+func (s *server) LookupChannel(name string) Channel {
+	ch, _ := s.channels.get(s.id(name))
+	return ch
+}
+
+// Channels returns a slice of all the existing Channels, sorted by ID.
+func (s *server) Channels() []Channel {
+	channels := s.channels.all()
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].ID() < channels[j].ID()
+	})
+	return channels
+}
+
+// FindChannels returns a slice of the existing Channels whose names match the
+// mask, sorted by ID.
+func (s *server) FindChannels(mask string) []Channel {
+	channels := []Channel{}
+	for _, ch := range s.Channels() {
+		if MatchMask(mask, ch.String()) {
+			channels = append(channels, ch)
+		}
+	}
+	return channels
 }
 
 // Channel returns an existing or new channel with the give name.
 func (s *server) Channel(name string) Channel {
-	s.Lock()
-	id := ID(name)
-	ch, ok := s.channels[id]
-	if !ok {
-		newFn := s.config.NewChannel
-		ch = newFn(s, name)
-		id = ch.ID()
-		s.channels[id] = ch
-		s.Unlock()
+	ch, created := s.channels.getOrCreate(s.id(name), func() Channel {
+		ch := s.config.NewChannel(s, name)
+		if kc, ok := ch.(keepEmptyChannel); ok && s.config.KeepEmptyChannels {
+			kc.SetKeepEmpty(true)
+		}
+		if store := s.config.ChannelStore; store != nil {
+			if sc, ok := ch.(stateChannel); ok {
+				if state, ok := store.Load(ch.ID()); ok {
+					sc.SetState(state)
+				}
+			}
+		}
+		return ch
+	})
+	if created {
 		if s.config.DiscardEmpty {
-			ch.Subscribe(s.channelEvents)
+			s.watch(ch)
 		}
 		s.Publish(&event{NewChanEvent, s, ch, nil, nil})
-	} else {
-		s.Unlock()
 	}
 	return ch
 }
 
-// cleanupEmpty receives Channel candidates for cleaning up and removes them if they're empty. (Blocking)
+// autoAway periodically marks Users who have been idle for longer than
+// AutoAway as away, until the server is closed. (Blocking)
+func (s *server) autoAway() {
+	interval := s.config.AutoAway / 2
+	if interval < minAutoAwayInterval {
+		interval = minAutoAwayInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			since := now.Add(-s.config.AutoAway)
+			for _, u := range s.users.all() {
+				if u.idleAway(s.config.AutoAwayMsg, since) {
+					u.notify(nil, awayReply(s, u))
+				}
+			}
+		}
+	}
+}
+
+// Register gets or creates a channel with the given name which is kept even
+// while it's empty, rather than being discarded.
+func (s *server) Register(name string) Channel {
+	ch := s.Channel(name)
+	if kc, ok := ch.(keepEmptyChannel); ok {
+		kc.SetKeepEmpty(true)
+	}
+	return ch
+}
+
+// watch subscribes to the events of a new Channel for cleanupEmpty. It uses a
+// dedicated channel, since closing the Channel will close its subscribers.
+func (s *server) watch(ch Channel) {
+	events := make(chan Event, 1)
+	s.Lock()
+	s.watched[ch] = events
+	s.Unlock()
+	ch.Subscribe(events)
+	go s.forwardChannelEvents(events)
+}
+
+// unwatch stops forwarding the events of a Channel which was removed from the
+// server.
+func (s *server) unwatch(ch Channel) {
+	s.Lock()
+	events, ok := s.watched[ch]
+	delete(s.watched, ch)
+	s.Unlock()
+	// Closing the Channel already closed its subscription.
+	if ok && ch.Unsubscribe(events) {
+		close(events)
+	}
+}
+
+// forwardChannelEvents passes the events of a Channel on to cleanupEmpty,
+// until the Channel or the server is closed. (Blocking)
+func (s *server) forwardChannelEvents(events <-chan Event) {
+	for {
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				return
+			}
+			select {
+			case s.channelEvents <- evt:
+			case <-s.done:
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// cleanupEmpty receives Channel candidates for cleaning up and removes them if they're empty, until the server is closed. (Blocking)
 func (s *server) cleanupEmpty() {
-	for evt := range s.channelEvents {
-		if evt.Kind() != EmptyChanEvent {
-			continue
+	for {
+		var evt Event
+		select {
+		case evt = <-s.channelEvents:
+		case <-s.done:
+			return
 		}
-		ch := evt.Channel()
-		s.Lock()
-		if s.channels[ch.ID()] != ch {
-			// Not the same channel anymore, already been replaced.
-			s.Unlock()
+		if evt.Kind() != EmptyChanEvent {
 			continue
 		}
-		if ch.Len() != 0 {
-			// Not empty.
-			s.Unlock()
-			continue
+		// Skip if it's not the same channel anymore (already been replaced),
+		// or if it's no longer empty.
+		removed := s.channels.removeIf(evt.Channel(), func(ch Channel) bool {
+			if ch.Len() != 0 {
+				return false
+			}
+			if kc, ok := ch.(keepEmptyChannel); ok && kc.KeepEmpty() {
+				return false
+			}
+			if store := s.config.ChannelStore; store != nil {
+				if sc, ok := ch.(stateChannel); ok {
+					store.Save(ch.ID(), sc.State())
+				}
+			}
+			return true
+		})
+		if removed {
+			s.unwatch(evt.Channel())
+			s.Publish(&event{DestroyChanEvent, s, evt.Channel(), nil, nil})
 		}
-		delete(s.channels, ch.ID())
-		s.Unlock()
 	}
 }
 
 // UnlinkChannel unlinks the channel from the server's storage, returns whether it existed.
 func (s *server) UnlinkChannel(ch Channel) {
+	if s.channels.removeIf(ch, func(Channel) bool { return true }) {
+		if s.config.DiscardEmpty {
+			s.unwatch(ch)
+		}
+		s.Publish(&event{DestroyChanEvent, s, ch, nil, nil})
+	}
+}
+
+// CloseChannel evicts all the members of the channel, unlinks it and publishes
+// a CloseChanEvent.
+func (s *server) CloseChannel(ch Channel) {
+	ch.Close()
+	s.UnlinkChannel(ch)
+	s.Publish(&event{CloseChanEvent, s, ch, nil, nil})
+}
+
+// RenameChannel changes the name of an existing channel, notifying its
+// members.
+func (s *server) RenameChannel(oldName string, newName string) error {
+	return s.renameChannel(s, oldName, newName, "")
+}
+
+// channelRenamer is implemented by Servers which can rename a channel on behalf
+// of a User, giving a reason.
+type channelRenamer interface {
+	renameChannel(from Prefixer, oldName string, newName string, reason string) error
+}
+
+// renameChannel changes the name of an existing channel on behalf of from,
+// notifying its members with the reason.
+func (s *server) renameChannel(from Prefixer, oldName string, newName string, reason string) error {
+	if !IsChannelName(newName) {
+		return ErrInvalidChannelName
+	}
+	ch, exists := s.HasChannel(oldName)
+	if !exists {
+		return ErrNoSuchChannel
+	}
+	rc, ok := ch.(renameChannel)
+	if !ok {
+		return ErrNoSuchChannel
+	}
+	oldName = ch.String()
+	if !s.channels.rename(ch.ID(), s.id(newName), ch, func() { rc.SetName(newName) }) {
+		return ErrChannelExists
+	}
+
+	renamed := &irc.Message{
+		Prefix:   from.Prefix(),
+		Command:  cmdRename,
+		Params:   []string{oldName, newName},
+		Trailing: reason,
+	}
+	part := "Channel renamed to " + newName
+	if reason != "" {
+		part += ": " + reason
+	}
+	by, _ := from.(*User)
+	for _, u := range ch.Users() {
+		if u.HasCap(CapChannelRename) {
+			u.encodeFrom(by, nil, renamed)
+			continue
+		}
+		u.encodeFrom(by, nil, &irc.Message{
+			Prefix:   u.Prefix(),
+			Command:  irc.PART,
+			Params:   []string{oldName},
+			Trailing: part,
+		})
+		u.encodeFrom(by, nil, s.rejoin(u, ch)...)
+	}
+	return nil
+}
+
+// rejoin returns the replies which introduce the User to a channel they're
+// already in: their JOIN, the topic and the names.
+func (s *server) rejoin(u *User, ch Channel) []*irc.Message {
+	r := []*irc.Message{{
+		Prefix:  u.Prefix(),
+		Command: irc.JOIN,
+		Params:  []string{ch.String()},
+	}}
+	if topic := ch.Topic(); topic != "" {
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_TOPIC,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: topic,
+		})
+	}
+	return append(r, s.names(u, ch.String())...)
+}
+
+// Caps returns a copy of the capabilities supported by the server.
+func (s *server) Caps() map[string]string {
+	s.RLock()
+	caps := make(map[string]string, len(s.caps))
+	for name, value := range s.caps {
+		caps[name] = value
+	}
+	s.RUnlock()
+	return caps
+}
+
+// SetCap adds or updates a supported capability, sending CAP NEW to users who
+// negotiated cap-notify.
+func (s *server) SetCap(name string, value string) {
+	s.Lock()
+	s.caps[name] = value
+	s.Unlock()
+	s.notifyCap(capNew, name, value)
+}
+
+// DelCap removes a supported capability, sending CAP DEL to users who
+// negotiated cap-notify and disabling it for everyone else.
+func (s *server) DelCap(name string) {
 	s.Lock()
-	chStored := s.channels[ch.ID()]
-	r := chStored == ch
-	if r {
-		delete(s.channels, ch.ID())
+	if _, ok := s.caps[name]; !ok {
+		s.Unlock()
+		return
 	}
+	delete(s.caps, name)
 	s.Unlock()
+	for _, u := range s.users.all() {
+		u.delCap(name)
+	}
+	s.notifyCap(capDel, name, "")
+}
+
+func (s *server) notifyCap(subcommand string, name string, value string) {
+	for _, u := range s.users.all() {
+		if !u.HasCap(CapNotify) {
+			continue
+		}
+		// Only clients which gave CAP LS 302 expect values.
+		u.notify(nil, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.CAP,
+			Params:   []string{u.Nick, subcommand},
+			Trailing: formatCap(name, value, u.capLSVersion() >= 302),
+		})
+	}
+}
+
+// formatCap renders a capability for CAP LS, including the value if withValue.
+func formatCap(name string, value string, withValue bool) string {
+	if !withValue || value == "" {
+		return name
+	}
+	return name + "=" + value
+}
+
+// formatCaps renders a sorted, space-separated list of capabilities.
+func formatCaps(caps map[string]string, withValues bool) string {
+	r := make([]string, 0, len(caps))
+	for name, value := range caps {
+		r = append(r, formatCap(name, value, withValues))
+	}
+	sort.Strings(r)
+	return strings.Join(r, " ")
 }
 
 // Connect starts the handshake for a new User and returns when complete or failed.
 func (s *server) Connect(u *User) error {
+	u.logPrefix = s.config.LogPrefix
+	u.rawLog = s.config.RawLog
+	if c, ok := u.Conn.(lineLimiter); ok {
+		c.setMaxLineLen(s.config.MaxLineLen)
+	}
+	if c, ok := u.Conn.(writeTimeouter); ok && s.config.WriteTimeout > 0 {
+		c.setWriteTimeout(s.config.WriteTimeout)
+	}
+	stop := s.startHandshakeTimer(u)
 	err := s.handshake(u)
+	if stop() && err != nil {
+		err = ErrHandshakeTimeout
+	}
 	if err != nil {
+		if err == ErrLineTooLong {
+			s.tooLong(u)
+		}
 		u.Close()
-		return err
+		herr := &HandshakeError{Host: u.RealHost(), Err: err}
+		logger.Infof("%s", herr)
+		return herr
+	}
+	if store := s.config.OfflineStore; store != nil {
+		msgs := store.Drain(u.Nick)
+		for _, msg := range msgs {
+			msg.Params = []string{u.Nick}
+		}
+		u.Encode(msgs...)
 	}
 	go s.handle(u)
 	s.Publish(&event{ConnectEvent, s, nil, u, nil})
 	return nil
 }
 
+// startHandshakeTimer closes the User's connection if it doesn't register
+// within HandshakeTimeout, which fails the pending Decode in the handshake.
+// The returned stop func ends the timer and reports whether it had fired.
+func (s *server) startHandshakeTimer(u *User) (stop func() bool) {
+	if s.config.HandshakeTimeout <= 0 {
+		return func() bool { return false }
+	}
+	var mu sync.Mutex
+	done, timedOut := false, false
+	timer := time.AfterFunc(s.config.HandshakeTimeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			return
+		}
+		timedOut = true
+		u.Conn.Close()
+	})
+	return func() bool {
+		timer.Stop()
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		return timedOut
+	}
+}
+
 // Quit will remove the user from all channels and disconnect.
 func (s *server) Quit(u *User, message string) {
+	if !s.users.remove(u.ID(), u) {
+		// Already gone
+		go u.Close()
+		return
+	}
+	if message == "" {
+		message = defaultCloseMsg
+	}
+	msg := &irc.Message{
+		Prefix:   u.Prefix(),
+		Command:  irc.QUIT,
+		Trailing: message,
+	}
+	s.notifySeen(u, msg)
+	for _, ch := range u.Channels() {
+		if k, ok := ch.(Kicker); ok {
+			k.Remove(u)
+		} else {
+			ch.Part(u, message)
+		}
+	}
+	for _, other := range u.Correspondents() {
+		other.delCorrespondent(u)
+	}
 	go u.Close()
-	s.Lock()
-	delete(s.users, u.ID())
-	s.Unlock()
 }
 
 func (s *server) guestNick() string {
@@ -303,9 +1335,7 @@ func (s *server) guestNick() string {
 
 // Len returns the number of users connected to the server.
 func (s *server) Len() int {
-	s.RLock()
-	defer s.RUnlock()
-	return len(s.users)
+	return s.users.len()
 }
 
 func (s *server) welcome(u *User) error {
@@ -314,7 +1344,7 @@ func (s *server) welcome(u *User) error {
 			Prefix:   s.Prefix(),
 			Command:  irc.RPL_WELCOME,
 			Params:   []string{u.Nick},
-			Trailing: fmt.Sprintf("Welcome! %s", u.Prefix()),
+			Trailing: fmt.Sprintf("%s %s", s.config.WelcomeMessage, u.Prefix()),
 		},
 		&irc.Message{
 			Prefix:   s.Prefix(),
@@ -334,6 +1364,12 @@ func (s *server) welcome(u *User) error {
 			Params:   []string{u.Nick},
 			Trailing: fmt.Sprintf("%s %s o o", s.config.Name, s.config.Version),
 		},
+		&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  rplISupport,
+			Params:   append([]string{u.Nick}, s.isupport()...),
+			Trailing: "are supported by this server",
+		},
 		&irc.Message{
 			Prefix:   s.Prefix(),
 			Command:  irc.RPL_LUSERCLIENT,
@@ -348,53 +1384,74 @@ func (s *server) welcome(u *User) error {
 	return CmdMotd(s, u, nil)
 }
 
-// names lists all names for a given channel
+// names lists all names for the given channels, with an RPL_ENDOFNAMES for
+// each.
 func (s *server) names(u *User, channels ...string) []*irc.Message {
-	// TODO: Support full list?
-	r := []*irc.Message{}
-	for _, channel := range channels {
-		ch, exists := s.HasChannel(channel)
-		if !exists {
-			continue
-		}
-		// FIXME: This needs to be broken up into multiple messages to fit <510 chars
-		msg := irc.Message{
-			Prefix:   s.Prefix(),
-			Command:  irc.RPL_NAMREPLY,
-			Params:   []string{u.Nick, "=", channel},
-			Trailing: strings.Join(ch.Names(), " "),
-		}
-		r = append(r, &msg)
-	}
-	endParams := []string{u.Nick}
-	if len(channels) == 1 {
-		endParams = append(endParams, channels[0])
-	}
-	r = append(r, &irc.Message{
-		Prefix:   s.Prefix(),
-		Params:   endParams,
-		Command:  irc.RPL_ENDOFNAMES,
-		Trailing: "End of /NAMES list.",
-	})
-	return r
+	return channelNames(s, u, channels)
 }
 
 func (s *server) handle(u *User) {
-	var partMsg string
-	defer s.Quit(u, partMsg)
+	var quitMsg string
+	defer func() { s.Quit(u, quitMsg) }()
+
+	if s.config.PingInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go s.pinger(u, done)
+	}
 
 	for {
-		msg, err := u.Decode()
+		tags, msg, err := u.DecodeTags()
+		if err == ErrLineTooLong {
+			s.tooLong(u)
+			quitMsg = "Request too long"
+			return
+		}
 		if err != nil {
-			logger.Errorf("handle decode error for %s: %s", u.ID(), err.Error())
+			if existing, _ := s.users.get(u.ID()); existing != u {
+				// Already quit, such as by QUIT, which closed the connection.
+				return
+			}
+			if err == io.EOF {
+				logger.Infof("connection closed by %s", u.ID())
+				quitMsg = "Connection closed"
+			} else {
+				logger.Errorf("handle decode error for %s: %s", u.ID(), err.Error())
+				quitMsg = "Read error"
+			}
+			// The connection may well be dead, but try to say goodbye.
+			u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERROR,
+				Trailing: "Closing link",
+			})
 			return
 		}
 		if msg == nil {
 			// Ignore empty messages
 			continue
 		}
+		s.accessLog(u, msg)
+		if s.rejectInvalidUTF8(u, msg) {
+			continue
+		}
+		if msg.Command != irc.PING && msg.Command != irc.PONG && u.touch() {
+			u.Encode(awayReply(s, u))
+		}
+		if s.receiveBatch(u, tags, msg) {
+			continue
+		}
 
-		err = s.commands.Run(s, u, msg)
+		label := tags["label"]
+		if label != "" && u.HasCap(CapLabeledResponse) {
+			u.startLabel()
+			err = s.commands.Run(s, u, msg)
+			if labelErr := u.endLabel(s, label); err == nil {
+				err = labelErr
+			}
+		} else {
+			err = s.commands.Run(s, u, msg)
+		}
 		if err == ErrUnknownCommand {
 			// TODO: Emit event?
 		} else if err != nil {
@@ -404,26 +1461,263 @@ func (s *server) handle(u *User) {
 	}
 }
 
+// rejectInvalidUTF8 replies with an error and returns true if UTF8Only is set
+// and msg isn't valid UTF-8.
+func (s *server) rejectInvalidUTF8(u *User, msg *irc.Message) bool {
+	if !s.config.UTF8Only || validUTF8(msg) {
+		return false
+	}
+	nick := u.Prefix().Name
+	if nick == "" {
+		nick = "*"
+	}
+	u.Encode(&irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  errUnknownError,
+		Params:   []string{nick, msg.Command},
+		Trailing: "Message rejected, your IRC software MUST use UTF-8 encoding on this network",
+	})
+	return true
+}
+
+// isupport returns the RPL_ISUPPORT tokens which describe the server.
+func (s *server) isupport() []string {
+	tokens := []string{
+		"CHANMODES=," + channelKeyModes + "," + channelParamModes + "," + channelFlags,
+		"ELIST=TU",
+		"NETWORK=" + s.config.NetworkName,
+		"PREFIX=(" + memberModes + ")" + memberPrefixes,
+		fmt.Sprintf("SILENCE=%d", maxSilence),
+	}
+	if s.config.MaxTopicLen > 0 {
+		tokens = append(tokens, fmt.Sprintf("TOPICLEN=%d", s.config.MaxTopicLen))
+	}
+	if s.config.CaseMapping != "" {
+		tokens = append([]string{"CASEMAPPING=" + string(s.config.CaseMapping)}, tokens...)
+	}
+	if s.config.UTF8Only {
+		tokens = append(tokens, "UTF8ONLY")
+	}
+	return tokens
+}
+
+// pinger sends a PING to the User whenever they've been quiet for
+// PingInterval, and disconnects them if nothing is received within
+// PingTimeout, until done is closed. (Blocking)
+func (s *server) pinger(u *User, done <-chan struct{}) {
+	timer := time.NewTimer(s.config.PingInterval)
+	defer timer.Stop()
+
+	var pinged time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.done:
+			return
+		case <-timer.C:
+		}
+
+		last := u.lastReceived()
+		if !pinged.IsZero() && !last.After(pinged) {
+			logger.Infof("ping timeout for %s, disconnecting", u.ID())
+			u.notify(nil, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERROR,
+				Trailing: "Ping timeout",
+			})
+			s.Quit(u, "Ping timeout")
+			return
+		}
+		if idle := time.Since(last); idle < s.config.PingInterval {
+			pinged = time.Time{}
+			timer.Reset(s.config.PingInterval - idle)
+			continue
+		}
+		pinged = time.Now()
+		u.sentPing(s.Name(), pinged)
+		u.notify(nil, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.PING,
+			Trailing: s.Name(),
+		})
+		timer.Reset(s.config.PingTimeout)
+	}
+}
+
+// tooLong notifies the User that they're being disconnected for exceeding the
+// maximum line length.
+func (s *server) tooLong(u *User) {
+	logger.Infof("line too long from %s, disconnecting", u.ID())
+	u.Encode(&irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.ERROR,
+		Trailing: "Request too long",
+	})
+}
+
 func (s *server) add(u *User) (ok bool) {
+	return s.users.add(u.ID(), u)
+}
+
+// Ban refuses connections from Users who match the mask, and disconnects the
+// matching Users who are already connected.
+func (s *server) Ban(mask string, reason string) {
+	mask = strings.ToLower(normalizeMask(mask))
 	s.Lock()
-	defer s.Unlock()
+	s.bans[mask] = reason
+	s.Unlock()
 
-	id := u.ID()
-	if _, exists := s.users[id]; exists {
-		return false
+	for _, u := range s.users.all() {
+		if matchesBan(u, mask) {
+			s.banned(u, reason)
+			s.Quit(u, "Banned")
+		}
 	}
+}
 
-	s.users[id] = u
+// Unban removes a ban, returns whether it existed.
+func (s *server) Unban(mask string) bool {
+	mask = strings.ToLower(normalizeMask(mask))
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.bans[mask]; !ok {
+		return false
+	}
+	delete(s.bans, mask)
 	return true
 }
 
+// isBanned returns whether the User matches a ban, along with its reason.
+func (s *server) isBanned(u *User) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	for mask, reason := range s.bans {
+		if matchesBan(u, mask) {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// matchesBan returns whether the User matches the mask, by either their
+// visible or their real host.
+func matchesBan(u *User, mask string) bool {
+	prefix := u.Prefix()
+	if MatchMask(mask, prefix.String()) {
+		return true
+	}
+	prefix.Host = u.RealHost()
+	return MatchMask(mask, prefix.String())
+}
+
+// banned notifies the User that they're being disconnected for being banned.
+func (s *server) banned(u *User, reason string) {
+	logger.Infof("banned user %s, disconnecting", u.ID())
+	text := "You are banned"
+	if reason != "" {
+		text += " (" + reason + ")"
+	}
+	u.notify(nil, &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.ERROR,
+		Trailing: text,
+	})
+}
+
+// allowedIP returns whether connections from the address are allowed by
+// AllowCIDRs and DenyCIDRs.
+func (s *server) allowedIP(ip net.IP) bool {
+	for _, n := range s.config.DenyCIDRs {
+		if ip != nil && n.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.config.AllowCIDRs) == 0 {
+		return true
+	}
+	for _, n := range s.config.AllowCIDRs {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// refused tells the User that their address is not allowed to connect.
+func (s *server) refused(u *User) {
+	logger.Infof("refused connection from %s", u.IP())
+	u.Encode(&irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.ERROR,
+		Trailing: "Closing link: " + u.IP() + " (Connection refused)",
+	})
+}
+
+// setHost assigns the real host of the User, cloaking it if configured.
+func (s *server) setHost(u *User, host string) {
+	u.Lock()
+	u.realHost = host
+	u.Unlock()
+	if s.config.CloakHost != nil {
+		host = s.config.CloakHost(host)
+	}
+	u.Set("", "", "", host)
+}
+
+// webIRC overrides the User's host with the one supplied by a trusted gateway:
+// WEBIRC <password> <gateway> <hostname> <ip>
+// Spoofing attempts with the wrong password are ignored. Returns
+// ErrInvalidWebIRC if the gateway gives an IP which doesn't parse.
+func (s *server) webIRC(u *User, msg *irc.Message) error {
+	if s.config.WebIRCPassword == "" || len(msg.Params) < 4 {
+		return nil
+	}
+	if msg.Params[0] != s.config.WebIRCPassword {
+		logger.Warningf("WEBIRC password mismatch from %s (gateway %s)", u.RealHost(), msg.Params[1])
+		return nil
+	}
+	ip := net.ParseIP(msg.Params[3])
+	if ip == nil {
+		logger.Warningf("WEBIRC invalid IP %q from %s (gateway %s)", msg.Params[3], u.RealHost(), msg.Params[1])
+		u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERROR,
+			Trailing: "Invalid WEBIRC IP address",
+		})
+		return ErrInvalidWebIRC
+	}
+	s.setHost(u, msg.Params[2])
+	u.Lock()
+	u.ip = ip.String()
+	u.Unlock()
+	return nil
+}
+
 func (s *server) handshake(u *User) error {
+	// Check the address before resolving it, so that refused connections
+	// don't cost a lookup. Conns without one are checked by their host.
+	ip := remoteIP(u.Conn)
+	u.Lock()
+	u.ip = ip
+	u.Unlock()
+	if ip != "" && !s.allowedIP(net.ParseIP(ip)) {
+		s.refused(u)
+		return ErrRefused
+	}
+
 	// Assign host
-	u.Host = u.ResolveHost()
+	s.setHost(u, u.ResolveHost())
+	if ip == "" && !s.allowedIP(net.ParseIP(u.IP())) {
+		s.refused(u)
+		return ErrRefused
+	}
+
+	// Registration is suspended while capabilities are being negotiated.
+	negotiating := false
 
 	// Read messages until we filled in USER details.
-	for i := handshakeMsgTolerance; i > 0; i-- {
-		// Consume N messages then give up.
+	for attempts := handshakeMsgTolerance; attempts > 0; {
 		msg, err := u.Decode()
 		if err != nil {
 			return err
@@ -432,7 +1726,17 @@ func (s *server) handshake(u *User) error {
 			// Empty message, ignore.
 			continue
 		}
+		s.accessLog(u, msg)
+		switch msg.Command {
+		case irc.NICK, irc.USER, irc.PASS:
+			// Give up after N attempts to register.
+			attempts--
+		}
 
+		if len(msg.Params) < 1 && msg.Command == irc.NICK {
+			u.Encode(noNicknameGiven(s, u))
+			continue
+		}
 		if len(msg.Params) < 1 {
 			u.Encode(&irc.Message{
 				Prefix:  s.Prefix(),
@@ -441,21 +1745,42 @@ func (s *server) handshake(u *User) error {
 			})
 			continue
 		}
+		if s.rejectInvalidUTF8(u, msg) {
+			continue
+		}
 
 		switch msg.Command {
 		case irc.NICK:
-			u.Nick = msg.Params[0]
+			u.setNick(msg.Params[0], s.id(msg.Params[0]))
 		case irc.USER:
-			u.User = msg.Params[0]
-			u.Real = msg.Trailing
+			u.Set("", msg.Params[0], msg.Trailing, "")
+		case cmdWebIRC:
+			if err := s.webIRC(u, msg); err != nil {
+				return err
+			}
+		case irc.CAP:
+			switch strings.ToUpper(msg.Params[0]) {
+			case irc.CAP_LS, irc.CAP_REQ:
+				negotiating = true
+			case irc.CAP_END:
+				negotiating = false
+			}
+			if err := CmdCap(s, u, msg); err != nil {
+				return err
+			}
 		}
 
-		if u.Nick == "" || u.User == "" {
-			// Wait for both to be set before proceeding
+		if u.Nick == "" || u.User == "" || negotiating {
+			// Wait for both to be set (and CAP END) before proceeding
 			continue
 		}
 		if len(u.Nick) > s.config.MaxNickLen {
-			u.Nick = u.Nick[:s.config.MaxNickLen]
+			nick := u.Nick[:s.config.MaxNickLen]
+			u.setNick(nick, s.id(nick))
+		}
+		if reason, ok := s.isBanned(u); ok {
+			s.banned(u, reason)
+			return ErrBanned
 		}
 
 		ok := s.add(u)
@@ -464,14 +1789,18 @@ func (s *server) handshake(u *User) error {
 				&irc.Message{
 					Prefix:   s.Prefix(),
 					Command:  irc.ERR_NICKNAMEINUSE,
-					Params:   []string{u.Nick},
+					Params:   []string{"*", u.Nick},
 					Trailing: "Nickname is already in use",
 				},
 			)
+			// Wait for another NICK, rather than retrying the same one on
+			// every message.
+			u.clearNick()
 			continue
 		}
 
+		s.certAuth(u)
 		return s.welcome(u)
 	}
-	return ErrHandshakeFailed
+	return ErrTooManyAttempts
 }
@@ -1,8 +1,12 @@
 package irckit
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sorcix/irc"
 )
@@ -10,54 +14,77 @@ import (
 func DefaultCommands() Commands {
 	cmds := commands{}
 
+	cmds.Add(Handler{Command: irc.AWAY, Call: CmdAway})
+	cmds.Add(Handler{Command: irc.CAP, Call: CmdCap, MinParams: 1})
+	cmds.Add(Handler{Command: cmdCheck, Call: CmdCheck, MinParams: 1})
+	cmds.Add(Handler{Command: irc.DIE, Call: CmdDie})
+	cmds.Add(Handler{Command: cmdIdleChannels, Call: CmdIdleChannels, MinParams: 1})
+	cmds.Add(Handler{Command: irc.INVITE, Call: CmdInvite, MinParams: 2})
 	cmds.Add(Handler{Command: irc.ISON, Call: CmdIson, MinParams: 1})
 	cmds.Add(Handler{Command: irc.JOIN, Call: CmdJoin, MinParams: 1})
+	cmds.Add(Handler{Command: irc.KICK, Call: CmdKick, MinParams: 2})
+	cmds.Add(Handler{Command: cmdKline, Call: CmdKline, MinParams: 1})
+	cmds.Add(Handler{Command: irc.LIST, Call: CmdList})
+	cmds.Add(Handler{Command: irc.MODE, Call: CmdMode, MinParams: 1})
 	cmds.Add(Handler{Command: irc.MOTD, Call: CmdMotd})
-	cmds.Add(Handler{Command: irc.NAMES, Call: CmdNames, MinParams: 1})
-	cmds.Add(Handler{Command: irc.NICK, Call: CmdNick, MinParams: 1})
-	cmds.Add(Handler{Command: irc.PART, Call: CmdPart, MinParams: 1})
+	cmds.Add(Handler{Command: irc.NAMES, Call: CmdNames})
+	cmds.Add(Handler{Command: irc.NICK, Call: CmdNick})
+	cmds.Add(Handler{Command: irc.OPER, Call: CmdOper, MinParams: 2})
+	cmds.Add(Handler{Command: irc.PART, Call: CmdPart})
 	cmds.Add(Handler{Command: irc.PING, Call: CmdPing})
-	cmds.Add(Handler{Command: irc.PRIVMSG, Call: CmdPrivMsg, MinParams: 1})
+	cmds.Add(Handler{Command: irc.PONG, Call: CmdPong})
+	cmds.Add(Handler{Command: irc.PRIVMSG, Call: CmdPrivMsg})
 	cmds.Add(Handler{Command: irc.QUIT, Call: CmdQuit})
+	cmds.Add(Handler{Command: irc.REHASH, Call: CmdRehash})
+	cmds.Add(Handler{Command: cmdRelayMsg, Call: CmdRelayMsg, MinParams: 2})
+	cmds.Add(Handler{Command: cmdRename, Call: CmdRename, MinParams: 2})
+	cmds.Add(Handler{Command: irc.RESTART, Call: CmdRestart})
+	cmds.Add(Handler{Command: cmdSajoin, Call: CmdSajoin, MinParams: 2})
+	cmds.Add(Handler{Command: cmdSanick, Call: CmdSanick, MinParams: 2})
+	cmds.Add(Handler{Command: cmdSilence, Call: CmdSilence})
+	cmds.Add(Handler{Command: irc.TOPIC, Call: CmdTopic, MinParams: 1})
+	cmds.Add(Handler{Command: cmdUnkline, Call: CmdUnkline, MinParams: 1})
+	cmds.Add(Handler{Command: cmdUserIP, Call: CmdUserIP, MinParams: 1})
 	cmds.Add(Handler{Command: irc.WHO, Call: CmdWho, MinParams: 1})
+	cmds.Add(Handler{Command: irc.WHOIS, Call: CmdWhois, MinParams: 1})
 
 	// (Sync this list with https://github.com/shazow/go-irckit/issues/11)
 	//
 	// Commands left to implement:
 	// - [ ] ADMIN
-	// - [ ] AWAY
+	// - [x] AWAY
 	// - [ ] CNOTICE
 	// - [ ] CPRIVMSG
 	// - [ ] CONNECT
-	// - [ ] DIE
+	// - [x] DIE
 	// - [ ] ENCAP
 	// - [ ] ERROR
 	// - [ ] HELP
 	// - [ ] INFO
-	// - [ ] INVITE
+	// - [x] INVITE
 	// - [x] ISON
 	// - [x] JOIN
-	// - [ ] KICK
+	// - [x] KICK
 	// - [ ] KILL
 	// - [ ] KNOCK
 	// - [ ] LINKS
-	// - [ ] LIST
+	// - [x] LIST
 	// - [ ] LUSERS
-	// - [ ] MODE
+	// - [x] MODE
 	// - [x] MOTD
 	// - [x] NAMES
 	// - [ ] NAMESX
 	// - [x] NICK
 	// - [ ] NOTICE
-	// - [ ] OPER
+	// - [x] OPER
 	// - [x] PART
 	// - [ ] PASS
 	// - [x] PING
 	// - [x] PONG
 	// - [x] PRIVMSG
 	// - [x] QUIT
-	// - [ ] REHASH
-	// - [ ] RESTART
+	// - [x] REHASH
+	// - [x] RESTART
 	// - [ ] RULES
 	// - [ ] SERVER
 	// - [ ] SERVICE
@@ -65,34 +92,145 @@ func DefaultCommands() Commands {
 	// - [ ] SQUERY
 	// - [ ] SQUIT
 	// - [ ] SETNAME
-	// - [ ] SILENCE
+	// - [x] SILENCE
 	// - [ ] STATS
 	// - [ ] SUMMON
 	// - [ ] TIME
-	// - [ ] TOPIC
+	// - [x] TOPIC
 	// - [ ] TRACE
 	// - [ ] UHNAMES
 	// - [ ] USER
 	// - [ ] USERHOST
-	// - [ ] USERIP
+	// - [x] USERIP
 	// - [ ] USERS
 	// - [ ] VERSION
 	// - [ ] WALLOPS
 	// - [ ] WATCH
 	// - [x] WHO
-	// - [ ] WHOIS
+	// - [x] WHOIS
 	// - [ ] WHOWAS
 
 	return &cmds
 }
 
-// CmdPart is a handler for the /PART command.
+// CmdAway is a handler for the /AWAY command.
+func CmdAway(s Server, u *User, msg *irc.Message) error {
+	away := msg.Trailing
+	if away == "" && len(msg.Params) > 0 {
+		away = msg.Params[0]
+	}
+	if max := s.Config().MaxAwayLen; max > 0 {
+		away = limitText(away, max)
+	}
+	u.SetAway(away)
+	return u.Encode(awayReply(s, u))
+}
+
+// awayReply returns the reply which confirms the away status of the User.
+func awayReply(s Server, u *User) *irc.Message {
+	if u.Away() == "" {
+		return &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_UNAWAY,
+			Params:   []string{u.Nick},
+			Trailing: "You are no longer marked as being away",
+		}
+	}
+	return &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.RPL_NOWAWAY,
+		Params:   []string{u.Nick},
+		Trailing: "You have been marked as being away",
+	}
+}
+
+// CmdCap is a handler for the /CAP command.
+func CmdCap(s Server, u *User, msg *irc.Message) error {
+	nick := u.Nick
+	if nick == "" {
+		nick = "*"
+	}
+	subcommand := strings.ToUpper(msg.Params[0])
+	reply := &irc.Message{
+		Prefix:  s.Prefix(),
+		Command: irc.CAP,
+		Params:  []string{nick, subcommand},
+	}
+
+	switch subcommand {
+	case irc.CAP_LS:
+		version := u.capLSVersion()
+		if len(msg.Params) > 1 {
+			if v, err := strconv.Atoi(msg.Params[1]); err == nil {
+				version = u.raiseCapVersion(v)
+			}
+		}
+		if version >= 302 {
+			u.addCap(CapNotify)
+		}
+		reply.Trailing = formatCaps(s.Caps(), version >= 302)
+	case irc.CAP_LIST:
+		reply.Trailing = strings.Join(u.Caps(), " ")
+	case irc.CAP_REQ:
+		req := msg.Trailing
+		if req == "" && len(msg.Params) > 1 {
+			req = msg.Params[1]
+		}
+		reply.Trailing = req
+
+		// Requests are atomic: either all of them are ACK'd or none are.
+		supported := s.Caps()
+		names := strings.Fields(req)
+		for _, name := range names {
+			if _, ok := supported[strings.TrimPrefix(name, "-")]; !ok {
+				reply.Params[1] = irc.CAP_NAK
+				return u.Encode(reply)
+			}
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, "-") {
+				u.delCap(name[1:])
+			} else {
+				u.addCap(name)
+			}
+		}
+		reply.Params[1] = irc.CAP_ACK
+	case irc.CAP_END:
+		return nil
+	default:
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  errInvalidCapCmd,
+			Params:   []string{nick, msg.Params[0]},
+			Trailing: "Invalid CAP command",
+		})
+	}
+	return u.Encode(reply)
+}
+
+// CmdPart is a handler for the /PART command. A PART without channels leaves
+// all of them if ServerConfig.PartAll is set.
 func CmdPart(s Server, u *User, msg *irc.Message) error {
 	// TODO: Handle 0
+	if len(msg.Params) == 0 {
+		if !s.Config().PartAll {
+			return u.Encode(&irc.Message{
+				Prefix:  s.Prefix(),
+				Command: irc.ERR_NEEDMOREPARAMS,
+				Params:  []string{msg.Command},
+			})
+		}
+		channels := u.Channels()
+		sort.Slice(channels, func(i, j int) bool { return channels[i].ID() < channels[j].ID() })
+		for _, ch := range channels {
+			ch.Part(u, msg.Trailing)
+		}
+		return nil
+	}
 	channels := strings.Split(msg.Params[0], ",")
 	for _, chName := range channels {
 		ch, exists := s.HasChannel(chName)
-		if !exists {
+		if !exists || !visibleTo(ch, u) {
 			u.Encode(&irc.Message{
 				Prefix:   s.Prefix(),
 				Command:  irc.ERR_NOSUCHCHANNEL,
@@ -106,12 +244,20 @@ func CmdPart(s Server, u *User, msg *irc.Message) error {
 	return nil
 }
 
-// CmdQuit is a handler for the /QUIT command.
+// defaultQuitMsg is the QUIT reason when the client doesn't give one.
+const defaultQuitMsg = "Client Quit"
+
+// CmdQuit is a handler for the /QUIT command. The reason is sent to the
+// User's peers, and the User is disconnected.
 func CmdQuit(s Server, u *User, msg *irc.Message) error {
+	reason := msg.Trailing
+	if reason == "" {
+		reason = defaultQuitMsg
+	}
 	u.Encode(&irc.Message{
 		Prefix:   u.Prefix(),
 		Command:  irc.QUIT,
-		Trailing: msg.Trailing,
+		Trailing: reason,
 	})
 	u.Encode(&irc.Message{
 		Prefix:   s.Prefix(),
@@ -119,6 +265,7 @@ func CmdQuit(s Server, u *User, msg *irc.Message) error {
 		Trailing: "You will be missed.",
 	})
 	s.Publish(&event{QuitEvent, s, nil, u, msg})
+	s.Quit(u, reason)
 	return nil
 }
 
@@ -132,6 +279,81 @@ func CmdPing(s Server, u *User, msg *irc.Message) error {
 	})
 }
 
+// CmdInvite is a handler for the /INVITE command.
+func CmdInvite(s Server, u *User, msg *irc.Message) error {
+	// INVITE <nick> <channel>
+	nick, chName := msg.Params[0], msg.Params[1]
+	target, exists := s.HasUser(nick)
+	if !exists {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHNICK,
+			Params:   []string{u.Nick, nick},
+			Trailing: "No such nick/channel",
+		})
+	}
+	ch, exists := s.HasChannel(chName)
+	if !exists || !visibleTo(ch, u) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHCHANNEL,
+			Params:   []string{u.Nick, chName},
+			Trailing: "No such channel",
+		})
+	}
+	if !ch.HasUser(u) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOTONCHANNEL,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: "You're not on that channel",
+		})
+	}
+	if ch.HasUser(target) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_USERONCHANNEL,
+			Params:   []string{u.Nick, target.Nick, ch.String()},
+			Trailing: "is already on channel",
+		})
+	}
+
+	if err := ch.Invite(u, target); err != nil {
+		return err
+	}
+	s.Publish(&targetEvent{event{InviteEvent, s, ch, u, &irc.Message{
+		Prefix:  u.Prefix(),
+		Command: irc.INVITE,
+		Params:  []string{target.Nick, ch.String()},
+	}}, target})
+	r := []*irc.Message{{
+		Prefix:  s.Prefix(),
+		Command: irc.RPL_INVITING,
+		Params:  []string{u.Nick, target.Nick, ch.String()},
+	}}
+	if away := target.Away(); away != "" {
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_AWAY,
+			Params:   []string{u.Nick, target.Nick},
+			Trailing: away,
+		})
+	}
+	return u.Encode(r...)
+}
+
+// CmdPong is a handler for the /PONG command, which answers a PING from the
+// server. Receiving it keeps the connection alive, and a matching token
+// records the User's lag.
+func CmdPong(s Server, u *User, msg *irc.Message) error {
+	token := msg.Trailing
+	if token == "" && len(msg.Params) > 0 {
+		token = msg.Params[len(msg.Params)-1]
+	}
+	u.receivedPong(token, time.Now())
+	return nil
+}
+
 // CmdJoin is a handler for the /JOIN command.
 func CmdJoin(s Server, u *User, msg *irc.Message) error {
 	// TODO: Handle invite-only
@@ -143,13 +365,81 @@ func CmdJoin(s Server, u *User, msg *irc.Message) error {
 		})
 	*/
 	channels := strings.Split(msg.Params[0], ",")
-	for _, channel := range channels {
-		// XXX: Handle no create permission.
-		ch := s.Channel(channel)
-		err := ch.Join(u)
-		if err == nil {
-			s.Publish(&event{JoinEvent, s, ch, u, msg})
+	// Keys are matched to the channels by position.
+	var keys []string
+	if len(msg.Params) > 1 {
+		keys = strings.Split(msg.Params[1], ",")
+	}
+	for i, channel := range channels {
+		key := ""
+		if i < len(keys) {
+			key = keys[i]
+		}
+		if err := join(s, u, msg, channel, key, maxForwards); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxForwards is the number of times a JOIN will follow channel forwards, to
+// avoid loops.
+const maxForwards = 3
+
+// join introduces the User to the named channel, with the key for its +k
+// mode. If the channel can't be joined, the User is forwarded to the channel
+// set by its +f mode instead, up to depth times.
+func join(s Server, u *User, msg *irc.Message, name string, key string, depth int) error {
+	// XXX: Handle no create permission.
+	ch := s.Channel(name)
+	var overridden []byte
+	if operOverride(s, u) && !ch.HasUser(u) {
+		if chKey, ok := ch.Mode(ModeKey); ok && chKey != key {
+			overridden = append(overridden, ModeKey)
+		}
+		if limit, ok := ch.Mode(ModeLimit); ok {
+			if n, _ := strconv.Atoi(limit); ch.Len() >= n {
+				overridden = append(overridden, ModeLimit)
+			}
+		}
+	}
+	var err error
+	if kc, ok := ch.(keyChannel); ok {
+		err = kc.JoinKey(u, key)
+	} else {
+		err = ch.Join(u)
+	}
+	switch err {
+	case nil:
+		if len(overridden) > 0 {
+			noticeOpers(s, fmt.Sprintf("%s overrode +%s to join %s", u.Nick, overridden, ch))
+		}
+		s.Publish(&event{JoinEvent, s, ch, u, msg})
+		return nil
+	case ErrChannelFull, ErrBadKey:
+		if target, ok := ch.Mode(ModeForward); ok && depth > 0 {
+			u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  errLinkChannel,
+				Params:   []string{u.Nick, ch.String(), target},
+				Trailing: "Forwarding to another channel",
+			})
+			return join(s, u, msg, target, "", depth-1)
+		}
+		if err == ErrBadKey {
+			return u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_BADCHANNELKEY,
+				Params:   []string{u.Nick, ch.String()},
+				Trailing: "Cannot join channel (+k)",
+			})
 		}
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_CHANNELISFULL,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: "Cannot join channel (+l)",
+		})
 	}
 	return nil
 }
@@ -186,36 +476,93 @@ func CmdMotd(s Server, u *User, _ *irc.Message) error {
 
 // CmdNames is a handler for the /NAMES command.
 func CmdNames(s Server, u *User, msg *irc.Message) error {
-	// TODO: Handle multiple channels? Queries?
-	channels := msg.Params
+	if len(msg.Params) == 0 {
+		return u.Encode(allNames(s, u)...)
+	}
+	// NAMES <channels> <server> asks the named server; we can only answer
+	// for ourselves.
+	if len(msg.Params) > 1 && !strings.EqualFold(msg.Params[1], s.Name()) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHSERVER,
+			Params:   []string{u.Nick, msg.Params[1]},
+			Trailing: "No such server",
+		})
+	}
+	channels := strings.Split(msg.Params[0], ",")
+	return u.Encode(channelNames(s, u, channels)...)
+}
 
-	// TODO: Support full list?
+// channelNames returns the replies to NAMES for the given channels: the
+// members of each channel visible to the User, each followed by its own
+// RPL_ENDOFNAMES.
+func channelNames(s Server, u *User, channels []string) []*irc.Message {
 	r := []*irc.Message{}
 	for _, channel := range channels {
-		ch, exists := s.HasChannel(channel)
-		if !exists {
+		if ch, exists := s.HasChannel(channel); exists && visibleTo(ch, u) {
+			// Reply with the name as the channel was created.
+			channel = ch.String()
+			// FIXME: This needs to be broken up into multiple messages to fit <510 chars
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.RPL_NAMREPLY,
+				Params:   []string{u.Nick, namesType(ch), channel},
+				Trailing: strings.Join(namesWithPrefix(ch), " "),
+			})
+		}
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_ENDOFNAMES,
+			Params:   []string{u.Nick, channel},
+			Trailing: "End of /NAMES list.",
+		})
+	}
+	return r
+}
+
+// allNames returns the replies to NAMES without parameters: the members of
+// every channel visible to the User, followed by the "*" group of Users who
+// are not on any of them.
+func allNames(s Server, u *User) []*irc.Message {
+	r := []*irc.Message{}
+	listed := map[*User]struct{}{}
+	for _, ch := range s.Channels() {
+		if _, private := ch.Mode(ModePrivate); private && !ch.HasUser(u) {
+			continue
+		}
+		if !visibleTo(ch, u) {
 			continue
 		}
-		// FIXME: This needs to be broken up into multiple messages to fit <510 chars
-		msg := irc.Message{
+		for _, member := range ch.Users() {
+			listed[member] = struct{}{}
+		}
+		r = append(r, &irc.Message{
 			Prefix:   s.Prefix(),
 			Command:  irc.RPL_NAMREPLY,
-			Params:   []string{u.Nick, "=", channel},
-			Trailing: strings.Join(ch.Names(), " "),
+			Params:   []string{u.Nick, namesType(ch), ch.String()},
+			Trailing: strings.Join(namesWithPrefix(ch), " "),
+		})
+	}
+	rest := []string{}
+	for _, other := range serverUsers(s) {
+		if _, ok := listed[other]; !ok {
+			rest = append(rest, other.Nick)
 		}
-		r = append(r, &msg)
 	}
-	endParams := []string{u.Nick}
-	if len(channels) == 1 {
-		endParams = append(endParams, channels[0])
+	if len(rest) > 0 {
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_NAMREPLY,
+			Params:   []string{u.Nick, "*", "*"},
+			Trailing: strings.Join(rest, " "),
+		})
 	}
-	r = append(r, &irc.Message{
+	return append(r, &irc.Message{
 		Prefix:   s.Prefix(),
-		Params:   endParams,
 		Command:  irc.RPL_ENDOFNAMES,
+		Params:   []string{u.Nick, "*"},
 		Trailing: "End of /NAMES list.",
 	})
-	return u.Encode(r...)
 }
 
 // CmdWho is a handler for the /WHO command.
@@ -233,7 +580,7 @@ func CmdWho(s Server, u *User, msg *irc.Message) error {
 
 	// TODO: Handle arbitrary masks, not just channels
 	ch, exists := s.HasChannel(mask)
-	if !exists {
+	if !exists || !visibleTo(ch, u) {
 		return u.Encode(endMsg)
 	}
 
@@ -252,53 +599,1388 @@ func CmdWho(s Server, u *User, msg *irc.Message) error {
 	return u.Encode(r...)
 }
 
-// CmdIson is a handler for the /ISON command.
-func CmdIson(s Server, u *User, msg *irc.Message) error {
-	nicks := msg.Params
-	on := make([]string, 0, len(nicks))
-	for _, nick := range nicks {
-		if _, ok := s.HasUser(nick); ok {
-			on = append(on, nick)
+// CmdWhois is a handler for the /WHOIS command.
+func CmdWhois(s Server, u *User, msg *irc.Message) error {
+	// WHOIS [<server>] <nick>[,<nick>]
+	nicks := msg.Params[len(msg.Params)-1]
+
+	r := []*irc.Message{}
+	for _, nick := range strings.Split(nicks, ",") {
+		other, exists := s.HasUser(nick)
+		if !exists {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_NOSUCHNICK,
+				Params:   []string{u.Nick, nick},
+				Trailing: "No such nick/channel",
+			})
+			continue
+		}
+		prefix := other.Prefix()
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_WHOISUSER,
+			Params:   []string{u.Nick, prefix.Name, prefix.User, prefix.Host, "*"},
+			Trailing: other.RealName(),
+		})
+		channels := []string{}
+		for _, ch := range other.Channels() {
+			if visibleTo(ch, u) {
+				channels = append(channels, ch.String())
+			}
+		}
+		if len(channels) > 0 {
+			sort.Strings(channels)
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.RPL_WHOISCHANNELS,
+				Params:   []string{u.Nick, prefix.Name},
+				Trailing: strings.Join(channels, " "),
+			})
+		}
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_WHOISSERVER,
+			Params:   []string{u.Nick, prefix.Name, s.Name()},
+			Trailing: s.Config().Version,
+		})
+		if away := other.Away(); away != "" {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.RPL_AWAY,
+				Params:   []string{u.Nick, prefix.Name},
+				Trailing: away,
+			})
+		}
+		if other.IsOper() {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.RPL_WHOISOPERATOR,
+				Params:   []string{u.Nick, prefix.Name},
+				Trailing: "is an IRC operator",
+			})
+		}
+		if other.Secure() {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  rplWhoisSecure,
+				Params:   []string{u.Nick, prefix.Name},
+				Trailing: "is using a secure connection",
+			})
+		}
+		if fp := other.CertFingerprint(); fp != "" && (other == u || u.IsOper()) {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  rplWhoisCertFP,
+				Params:   []string{u.Nick, prefix.Name},
+				Trailing: "has client certificate fingerprint " + fp,
+			})
+		}
+		if u.IsOper() {
+			// Operators see through host cloaking.
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  rplWhoisHost,
+				Params:   []string{u.Nick, prefix.Name},
+				Trailing: fmt.Sprintf("is connecting from *@%s %s", other.RealHost(), other.IP()),
+			})
 		}
+		idle := time.Since(other.LastActive()) / time.Second
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_WHOISIDLE,
+			Params:   []string{u.Nick, prefix.Name, strconv.Itoa(int(idle)), strconv.FormatInt(other.signon.Unix(), 10)},
+			Trailing: "seconds idle, signon time",
+		})
 	}
+	r = append(r, &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.RPL_ENDOFWHOIS,
+		Params:   []string{u.Nick, nicks},
+		Trailing: "End of /WHOIS list",
+	})
+	return u.Encode(r...)
+}
 
-	return u.Encode(
-		&irc.Message{
-			Prefix:   s.Prefix(),
-			Command:  irc.RPL_ISON,
-			Params:   []string{u.Nick},
-			Trailing: strings.Join(on, " "),
-		},
-	)
+// CmdList is a handler for the /LIST command.
+func CmdList(s Server, u *User, msg *irc.Message) error {
+	var channels []Channel
+	filter := listFilter{moreUsers: -1}
+	if len(msg.Params) > 0 {
+		var names []string
+		for _, item := range strings.Split(msg.Params[0], ",") {
+			if !filter.parse(item) {
+				names = append(names, item)
+			}
+		}
+		for _, name := range names {
+			if strings.ContainsAny(name, "*?") {
+				channels = append(channels, findChannels(s, name)...)
+			} else if ch, exists := s.HasChannel(name); exists {
+				channels = append(channels, ch)
+			}
+		}
+		if len(names) == 0 {
+			channels = s.Channels()
+		}
+	} else {
+		channels = s.Channels()
+	}
+
+	r := make([]*irc.Message, 0, len(channels)+1)
+	now := time.Now()
+	for _, ch := range channels {
+		if !visibleTo(ch, u) || !filter.match(ch, now) {
+			continue
+		}
+		name, topic := ch.String(), ch.Topic()
+		if _, private := ch.Mode(ModePrivate); private && !ch.HasUser(u) {
+			name, topic = "Prv", ""
+		}
+		r = append(r, &irc.Message{
+			Prefix:        s.Prefix(),
+			Command:       irc.RPL_LIST,
+			Params:        []string{u.Nick, name, strconv.Itoa(ch.Len())},
+			Trailing:      topic,
+			EmptyTrailing: topic == "",
+		})
+	}
+	r = append(r, &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.RPL_LISTEND,
+		Params:   []string{u.Nick},
+		Trailing: "End of /LIST",
+	})
+	return u.Encode(r...)
 }
 
-// CmdPrivMsg is a handler for the /PRIVMSG command.
-func CmdPrivMsg(s Server, u *User, msg *irc.Message) error {
-	query := msg.Params[0]
-	if toChan, exists := s.HasChannel(query); exists {
-		toChan.Message(u, msg.Trailing)
-		s.Publish(&event{ChanMsgEvent, s, toChan, u, msg})
-	} else if toUser, exists := s.HasUser(query); exists {
-		s.Publish(&event{UserMsgEvent, s, nil, u, msg})
-		toUser.Encode(&irc.Message{
-			Prefix:   u.Prefix(),
-			Command:  irc.PRIVMSG,
-			Params:   []string{toUser.Nick},
-			Trailing: msg.Trailing,
+// listFilter holds the ELIST conditions of a LIST command. The bounds are
+// exclusive, and zero upper bounds are unset.
+type listFilter struct {
+	moreUsers, lessUsers int
+	// Bounds on how long ago the topic was set.
+	minTopicAge, maxTopicAge time.Duration
+}
+
+// parse adds the condition if item is an ELIST filter: ">N" or "<N" for the
+// number of users, or "T>N" or "T<N" for the topic being set more or less
+// than N minutes ago. Returns false if item is not a filter.
+func (f *listFilter) parse(item string) bool {
+	topic := strings.HasPrefix(item, "T") || strings.HasPrefix(item, "t")
+	if topic {
+		item = item[1:]
+	}
+	if item == "" || (item[0] != '>' && item[0] != '<') {
+		return false
+	}
+	n, err := strconv.Atoi(item[1:])
+	if err != nil || n < 0 {
+		return false
+	}
+	switch {
+	case topic && item[0] == '>':
+		f.minTopicAge = time.Duration(n) * time.Minute
+	case topic:
+		f.maxTopicAge = time.Duration(n) * time.Minute
+	case item[0] == '>':
+		f.moreUsers = n
+	default:
+		f.lessUsers = n
+	}
+	return true
+}
+
+// match returns whether the channel satisfies the conditions of the filter.
+func (f *listFilter) match(ch Channel, now time.Time) bool {
+	if n := ch.Len(); n <= f.moreUsers || (f.lessUsers > 0 && n >= f.lessUsers) {
+		return false
+	}
+	if f.minTopicAge == 0 && f.maxTopicAge == 0 {
+		return true
+	}
+	sc, ok := ch.(stateChannel)
+	if !ok {
+		return false
+	}
+	set := sc.State().TopicTime
+	if set.IsZero() {
+		return false
+	}
+	age := now.Sub(set)
+	return age > f.minTopicAge && (f.maxTopicAge == 0 || age < f.maxTopicAge)
+}
+
+// CmdMode is a handler for the /MODE command.
+func CmdMode(s Server, u *User, msg *irc.Message) error {
+	target := msg.Params[0]
+	if !IsChannelName(target) {
+		return userMode(s, u, target)
+	}
+
+	ch, exists := s.HasChannel(target)
+	if !exists || !visibleTo(ch, u) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHCHANNEL,
+			Params:   []string{u.Nick, target},
+			Trailing: "No such channel",
 		})
-	} else {
+	}
+	if len(msg.Params) < 2 {
+		modes := strings.Fields(ch.Modes())
+		if !ch.HasUser(u) {
+			hideKey(ch, modes)
+		}
+		return u.Encode(&irc.Message{
+			Prefix:  s.Prefix(),
+			Command: irc.RPL_CHANNELMODEIS,
+			Params:  append([]string{u.Nick, ch.String()}, modes...),
+		})
+	}
+	listQuery := len(msg.Params) == 2 && (msg.Params[1] == "I" || msg.Params[1] == "+I")
+	if !ch.HasUser(u) && !(listQuery && u.IsOper()) {
 		return u.Encode(&irc.Message{
 			Prefix:   s.Prefix(),
-			Command:  irc.ERR_NOSUCHNICK,
-			Params:   msg.Params,
-			Trailing: "No such nick/channel",
+			Command:  irc.ERR_NOTONCHANNEL,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: "You're not on that channel",
 		})
 	}
-	return nil
+	if listQuery {
+		return u.Encode(inviteList(s, u, ch)...)
+	}
+
+	if !isChannelOp(ch, u) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_CHANOPRIVSNEEDED,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: "You're not channel operator",
+		})
+	}
+
+	var r []*irc.Message
+	var changes []byte
+	var changeArgs []string
+	var sign byte
+	set := true
+	record := func(mode byte, param string) {
+		want := byte('-')
+		if set {
+			want = '+'
+		}
+		if sign != want {
+			sign = want
+			changes = append(changes, sign)
+		}
+		changes = append(changes, mode)
+		if param != "" {
+			changeArgs = append(changeArgs, param)
+		}
+	}
+	args := msg.Params[2:]
+	if msg.Trailing != "" || msg.EmptyTrailing {
+		args = append(args[:len(args):len(args)], msg.Trailing)
+	}
+	for _, mode := range []byte(msg.Params[1]) {
+		param := ""
+		switch {
+		case mode == '+' || mode == '-':
+			set = mode == '+'
+			continue
+		case strings.IndexByte(memberModes, mode) >= 0:
+			if len(args) == 0 {
+				r = append(r, &irc.Message{
+					Prefix:   s.Prefix(),
+					Command:  irc.ERR_NEEDMOREPARAMS,
+					Params:   []string{u.Nick, msg.Command},
+					Trailing: fmt.Sprintf("Mode %c requires a parameter", mode),
+				})
+				continue
+			}
+			target, reply := memberMode(s, u, ch, mode, set, args[0])
+			args = args[1:]
+			if reply != nil {
+				r = append(r, reply)
+			} else if target != nil {
+				record(mode, target.Nick)
+			}
+			continue
+		case strings.IndexByte(channelFlags, mode) >= 0:
+		case strings.IndexByte(channelKeyModes, mode) >= 0 && !set:
+			// The key is given when unsetting too, but it's not checked.
+			if len(args) > 0 {
+				args = args[1:]
+			}
+		case strings.IndexByte(channelParamModes+channelKeyModes, mode) >= 0:
+			if !set {
+				break
+			}
+			if len(args) == 0 || args[0] == "" {
+				// An empty key would make the channel unjoinable.
+				if len(args) > 0 {
+					args = args[1:]
+				}
+				r = append(r, &irc.Message{
+					Prefix:   s.Prefix(),
+					Command:  irc.ERR_NEEDMOREPARAMS,
+					Params:   []string{u.Nick, msg.Command},
+					Trailing: fmt.Sprintf("Mode %c requires a parameter", mode),
+				})
+				continue
+			}
+			var ok bool
+			param, ok = modeParam(s, ch, mode, args[0])
+			args = args[1:]
+			if !ok {
+				continue
+			}
+		default:
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_UNKNOWNMODE,
+				Params:   []string{u.Nick, string(mode)},
+				Trailing: fmt.Sprintf("is unknown mode char to me for %s", ch),
+			})
+			continue
+		}
+		if old, ok := ch.Mode(mode); ok == set && old == param {
+			// Already in effect
+			continue
+		}
+		if set {
+			ch.SetMode(mode, param)
+		} else {
+			ch.UnsetMode(mode)
+		}
+		record(mode, param)
+	}
+
+	if len(changes) > 0 {
+		modeMsg := &irc.Message{
+			Prefix:  u.Prefix(),
+			Command: irc.MODE,
+			Params:  append([]string{ch.String(), string(changes)}, changeArgs...),
+		}
+		for _, to := range ch.Users() {
+			to.relay(u, modeMsg)
+		}
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	return u.Encode(r...)
 }
 
-// CmdNick is a handler for the /NICK command.
+// memberMode sets or unsets a status mode of the member with the given nick on
+// behalf of the User, who needs the same status or a higher one, and at least
+// channel operator. Operators may change any status. Returns the member if
+// their status changed, or an error reply.
+func memberMode(s Server, u *User, ch Channel, mode byte, set bool, nick string) (*User, *irc.Message) {
+	mc, ok := ch.(memberModeChannel)
+	if !ok {
+		return nil, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_UNKNOWNMODE,
+			Params:   []string{u.Nick, string(mode)},
+			Trailing: fmt.Sprintf("is unknown mode char to me for %s", ch),
+		}
+	}
+	required := mode
+	if !hasRank(string(mode), ModeOp) {
+		required = ModeOp
+	}
+	if !u.IsOper() && !hasRank(mc.MemberModes(u), required) {
+		return nil, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_CHANOPRIVSNEEDED,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: "You're not channel operator",
+		}
+	}
+	target, exists := s.HasUser(nick)
+	if !exists {
+		return nil, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHNICK,
+			Params:   []string{u.Nick, nick},
+			Trailing: "No such nick/channel",
+		}
+	}
+	changed, err := mc.SetMemberMode(target, mode, set)
+	if err != nil {
+		return nil, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_USERNOTINCHANNEL,
+			Params:   []string{u.Nick, target.Nick, ch.String()},
+			Trailing: "They aren't on that channel",
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return target, nil
+}
+
+// inviteList returns the replies to MODE +I, listing the pending invites of
+// the channel.
+func inviteList(s Server, u *User, ch Channel) []*irc.Message {
+	r := []*irc.Message{}
+	if ic, ok := ch.(inviteChannel); ok {
+		for _, nick := range ic.Invited() {
+			r = append(r, &irc.Message{
+				Prefix:  s.Prefix(),
+				Command: irc.RPL_INVITELIST,
+				Params:  []string{u.Nick, ch.String(), nick},
+			})
+		}
+	}
+	return append(r, &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.RPL_ENDOFINVITELIST,
+		Params:   []string{u.Nick, ch.String()},
+		Trailing: "End of channel invite list",
+	})
+}
+
+// hideKey replaces the key among the modes of the channel, as returned by
+// Modes, so that it's not revealed to non-members.
+func hideKey(ch Channel, modes []string) {
+	i := 1
+	for _, mode := range []byte(strings.TrimPrefix(modes[0], "+")) {
+		param, _ := ch.Mode(mode)
+		if param == "" {
+			continue
+		}
+		if mode == ModeKey && i < len(modes) {
+			modes[i] = "*"
+			return
+		}
+		i++
+	}
+}
+
+// modeParam validates and normalizes the parameter for setting a channel
+// mode.
+func modeParam(s Server, ch Channel, mode byte, param string) (string, bool) {
+	switch mode {
+	case ModeLimit:
+		n, err := strconv.Atoi(param)
+		if err != nil || n <= 0 {
+			return "", false
+		}
+		return strconv.Itoa(n), true
+	case ModeForward:
+		if !IsChannelName(param) {
+			return "", false
+		}
+		if other, _ := s.HasChannel(param); other == ch {
+			return "", false
+		}
+		return param, true
+	case ModeKey:
+		// Keys are separated by commas in JOIN.
+		if strings.IndexByte(param, ',') >= 0 {
+			return "", false
+		}
+		return param, true
+	}
+	return param, true
+}
+
+// userMode handles /MODE for a user target. User modes can't be changed yet,
+// so the current ones are always returned.
+func userMode(s Server, u *User, nick string) error {
+	if target, _ := s.HasUser(nick); target != u {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_USERSDONTMATCH,
+			Params:   []string{u.Nick},
+			Trailing: "Cant change mode for other users",
+		})
+	}
+	modes := "+"
+	if u.IsOper() {
+		modes += "o"
+	}
+	return u.Encode(&irc.Message{
+		Prefix:  s.Prefix(),
+		Command: irc.RPL_UMODEIS,
+		Params:  []string{u.Nick, modes},
+	})
+}
+
+// CmdIson is a handler for the /ISON command.
+func CmdIson(s Server, u *User, msg *irc.Message) error {
+	nicks := msg.Params
+	on := make([]string, 0, len(nicks))
+	for _, nick := range nicks {
+		if _, ok := s.HasUser(nick); ok {
+			on = append(on, nick)
+		}
+	}
+
+	return u.Encode(
+		&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_ISON,
+			Params:   []string{u.Nick},
+			Trailing: strings.Join(on, " "),
+		},
+	)
+}
+
+// CmdPrivMsg is a handler for the /PRIVMSG command.
+func CmdPrivMsg(s Server, u *User, msg *irc.Message) error {
+	if len(msg.Params) == 0 {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NORECIPIENT,
+			Params:   []string{u.Nick},
+			Trailing: fmt.Sprintf("No recipient given (%s)", msg.Command),
+		})
+	}
+	text := msg.Trailing
+	if text == "" && len(msg.Params) > 1 {
+		// Single word messages can be sent without a trailing prefix.
+		text = msg.Params[1]
+	}
+	if text == "" {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOTEXTTOSEND,
+			Params:   []string{u.Nick},
+			Trailing: "No text to send",
+		})
+	}
+
+	if config := s.Config(); config.MaxMsgLen > 0 && len(text) > config.MaxMsgLen {
+		if config.MsgLenPolicy == RejectMsg {
+			return u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  errInputTooLong,
+				Params:   []string{u.Nick},
+				Trailing: "Input line was too long",
+			})
+		}
+		text = limitText(text, config.MaxMsgLen)
+	}
+
+	return deliverMsg(s, u, msg, []string{text}, nil)
+}
+
+// deliverMsg delivers the texts of a PRIVMSG from the User to its target,
+// replying to the User if they couldn't be delivered. With lines, the texts
+// were joined from a draft/multiline batch, which is delivered as one.
+func deliverMsg(s Server, u *User, msg *irc.Message, texts []string, lines []multilineLine) error {
+	// NOTICE must never be answered automatically, so only PRIVMSG gets
+	// receipts.
+	receipts := msg.Command == irc.PRIVMSG && s.Config().DeliveryReceipts && u.isLabeling()
+	query := msg.Params[0]
+	if i := strings.IndexByte(query, '@'); i > 0 && !IsChannelName(query) {
+		// Targets of the form nick@server must name this server, otherwise
+		// there's no such nick here.
+		if server := query[i+1:]; !strings.EqualFold(server, s.Name()) {
+			return u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_NOSUCHNICK,
+				Params:   []string{u.Nick, msg.Params[0]},
+				Trailing: "No such nick/channel",
+			})
+		}
+		query = query[:i]
+	}
+	// The messages which are published, one per text of a batch.
+	published := []*irc.Message{msg}
+	if lines != nil {
+		published = make([]*irc.Message, 0, len(texts))
+		for _, text := range texts {
+			published = append(published, &irc.Message{
+				Prefix:   u.Prefix(),
+				Command:  msg.Command,
+				Params:   []string{msg.Params[0]},
+				Trailing: text,
+			})
+		}
+	}
+
+	if toChan, exists := s.HasChannel(query); exists {
+		if mc, ok := toChan.(multilineChannel); ok && lines != nil {
+			mc.messageMultiline(u, lines)
+		} else {
+			for _, text := range texts {
+				toChan.Message(u, text)
+			}
+		}
+		for _, m := range published {
+			s.Publish(&event{ChanMsgEvent, s, toChan, u, m})
+		}
+	} else if toUser, exists := s.HasUser(query); exists {
+		for _, m := range published {
+			s.Publish(&event{UserMsgEvent, s, nil, u, m})
+		}
+		if toUser.silenced(u) {
+			return nil
+		}
+		u.addCorrespondent(toUser)
+		toUser.addCorrespondent(u)
+		var err error
+		if lines != nil {
+			err = toUser.relayMultiline(u, newMsgID(), toUser.Nick, lines)
+		} else {
+			err = toUser.relayMsg(u, newMsgID(), &irc.Message{
+				Prefix:   u.Prefix(),
+				Command:  irc.PRIVMSG,
+				Params:   []string{toUser.Nick},
+				Trailing: texts[0],
+			})
+		}
+		if err != nil && receipts {
+			return u.Encode(failDelivery(s, msg.Command, "DELIVERY_FAILED", toUser.Nick, "Message could not be delivered"))
+		}
+		if away := toUser.Away(); away != "" {
+			return u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.RPL_AWAY,
+				Params:   []string{u.Nick, toUser.Nick},
+				Trailing: away,
+			})
+		}
+	} else {
+		for _, m := range published {
+			s.Publish(&event{UndeliveredMsgEvent, s, nil, u, m})
+		}
+		if store := s.Config().OfflineStore; store != nil && !IsChannelName(query) {
+			queued := true
+			for _, text := range texts {
+				queued = store.Store(query, &irc.Message{
+					Prefix:   u.Prefix(),
+					Command:  irc.PRIVMSG,
+					Params:   []string{query},
+					Trailing: text,
+				}) && queued
+			}
+			if queued {
+				return nil
+			}
+		}
+		if receipts {
+			return u.Encode(failDelivery(s, msg.Command, "NO_SUCH_TARGET", query, "No such nick/channel"))
+		}
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHNICK,
+			Params:   msg.Params,
+			Trailing: "No such nick/channel",
+		})
+	}
+	return nil
+}
+
+// failDelivery returns a FAIL reply for a private message which couldn't be
+// delivered to target, when DeliveryReceipts is set.
+func failDelivery(s Server, command string, code string, target string, text string) *irc.Message {
+	return &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  cmdFail,
+		Params:   []string{command, code, target},
+		Trailing: text,
+	}
+}
+
+// CmdTopic is a handler for the /TOPIC command.
+func CmdTopic(s Server, u *User, msg *irc.Message) error {
+	chName := msg.Params[0]
+	ch, exists := s.HasChannel(chName)
+	if !exists || !visibleTo(ch, u) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHCHANNEL,
+			Params:   []string{u.Nick, chName},
+			Trailing: "No such channel",
+		})
+	}
+
+	if len(msg.Params) < 2 && msg.Trailing == "" && !msg.EmptyTrailing {
+		// Query
+		if topic := ch.Topic(); topic != "" {
+			return u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.RPL_TOPIC,
+				Params:   []string{u.Nick, ch.String()},
+				Trailing: topic,
+			})
+		}
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_NOTOPIC,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: "No topic is set",
+		})
+	}
+
+	text := msg.Trailing
+	if text == "" && len(msg.Params) > 1 {
+		text = msg.Params[1]
+	}
+	if config := s.Config(); config.MaxTopicLen > 0 && len(text) > config.MaxTopicLen {
+		if config.TopicLenPolicy == RejectMsg {
+			return u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  errInputTooLong,
+				Params:   []string{u.Nick},
+				Trailing: "Input line was too long",
+			})
+		}
+		text = limitText(text, config.MaxTopicLen)
+	}
+	switch err := ch.SetTopic(u, text); err {
+	case nil:
+		return nil
+	case ErrNotOnChannel:
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOTONCHANNEL,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: "You're not on that channel",
+		})
+	case ErrNoPrivileges:
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_CHANOPRIVSNEEDED,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: "You're not channel operator",
+		})
+	default:
+		return err
+	}
+}
+
+// CmdKick is a handler for the /KICK command.
+func CmdKick(s Server, u *User, msg *irc.Message) error {
+	chName := msg.Params[0]
+	ch, exists := s.HasChannel(chName)
+	if !exists || !visibleTo(ch, u) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHCHANNEL,
+			Params:   []string{u.Nick, chName},
+			Trailing: "No such channel",
+		})
+	}
+
+	var r []*irc.Message
+	for _, nick := range strings.Split(msg.Params[1], ",") {
+		target, exists := s.HasUser(nick)
+		if !exists {
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_NOSUCHNICK,
+				Params:   []string{u.Nick, nick},
+				Trailing: "No such nick/channel",
+			})
+			continue
+		}
+		err := ErrNoPrivileges
+		if k, ok := ch.(Kicker); ok {
+			err = k.Kick(u, target, msg.Trailing)
+		}
+		switch err {
+		case nil:
+		case ErrNotOnChannel:
+			return u.Encode(append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_NOTONCHANNEL,
+				Params:   []string{u.Nick, ch.String()},
+				Trailing: "You're not on that channel",
+			})...)
+		case ErrNoPrivileges:
+			return u.Encode(append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_CHANOPRIVSNEEDED,
+				Params:   []string{u.Nick, ch.String()},
+				Trailing: "You're not channel operator",
+			})...)
+		case ErrUserNotOnChannel:
+			r = append(r, &irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  irc.ERR_USERNOTINCHANNEL,
+				Params:   []string{u.Nick, target.Nick, ch.String()},
+				Trailing: "They aren't on that channel",
+			})
+		default:
+			return err
+		}
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	return u.Encode(r...)
+}
+
+// CmdNick is a handler for the /NICK command.
 func CmdNick(s Server, u *User, msg *irc.Message) error {
+	if len(msg.Params) == 0 {
+		return u.Encode(noNicknameGiven(s, u))
+	}
+	if max := s.Config().MaxNickChanges; max > 0 {
+		wait := u.nickChange(time.Now(), max, s.Config().NickChangeWindow)
+		if wait > 0 {
+			return u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  errNickTooFast,
+				Params:   []string{u.Nick, msg.Params[0]},
+				Trailing: fmt.Sprintf("Nick change too fast. Please wait %d seconds.", (wait+time.Second-1)/time.Second),
+			})
+		}
+	}
 	s.RenameUser(u, msg.Params[0])
 	return nil
 }
+
+// noNicknameGiven returns the ERR_NONICKNAMEGIVEN reply to a NICK without a
+// nick.
+func noNicknameGiven(s Server, u *User) *irc.Message {
+	nick := u.Nick
+	if nick == "" {
+		nick = "*"
+	}
+	return &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.ERR_NONICKNAMEGIVEN,
+		Params:   []string{nick},
+		Trailing: "No nickname given",
+	}
+}
+
+// CmdOper is a handler for the /OPER command.
+func CmdOper(s Server, u *User, msg *irc.Message) error {
+	name, password := msg.Params[0], msg.Params[1]
+	expected, ok := s.Config().Opers[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_PASSWDMISMATCH,
+			Params:   []string{u.Nick},
+			Trailing: "Password incorrect",
+		})
+	}
+	u.SetOper(true)
+	return u.Encode(
+		&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.RPL_YOUREOPER,
+			Params:   []string{u.Nick},
+			Trailing: "You are now an IRC operator",
+		},
+		&irc.Message{
+			Prefix:  s.Prefix(),
+			Command: irc.MODE,
+			Params:  []string{u.Nick, "+o"},
+		},
+	)
+}
+
+// operOverride returns whether the User bypasses the restrictions of
+// channels, as an operator with ServerConfig.OperOverride set.
+func operOverride(s Server, u *User) bool {
+	return u.IsOper() && s.Config().OperOverride
+}
+
+// noticeOpers sends a server notice to every operator.
+func noticeOpers(s Server, text string) {
+	for _, other := range serverUsers(s) {
+		if !other.IsOper() {
+			continue
+		}
+		other.notify(nil, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.NOTICE,
+			Params:   []string{other.Nick},
+			Trailing: "*** Notice -- " + text,
+		})
+	}
+}
+
+// errNoPrivileges returns the reply for a User who is not an operator.
+func errNoPrivileges(s Server, u *User) *irc.Message {
+	return &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.ERR_NOPRIVILEGES,
+		Params:   []string{u.Nick},
+		Trailing: "Permission Denied- You're not an IRC operator",
+	}
+}
+
+func errUnknownCommand(s Server, u *User, command string) *irc.Message {
+	return &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.ERR_UNKNOWNCOMMAND,
+		Params:   []string{u.Nick, command},
+		Trailing: "Unknown command",
+	}
+}
+
+// CmdSanick is a handler for the /SANICK command, which lets an operator
+// change the Nick of another User.
+func CmdSanick(s Server, u *User, msg *irc.Message) error {
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	nick, newNick := msg.Params[0], msg.Params[1]
+	target, exists := s.HasUser(nick)
+	if !exists {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHNICK,
+			Params:   []string{u.Nick, nick},
+			Trailing: "No such nick/channel",
+		})
+	}
+	if other, exists := s.HasUser(newNick); exists && other != target {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NICKNAMEINUSE,
+			Params:   []string{u.Nick, newNick},
+			Trailing: "Nickname is already in use",
+		})
+	}
+	if !s.RenameUser(target, newNick) {
+		return nil
+	}
+	return target.encodeFrom(u, nil, &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.NOTICE,
+		Params:   []string{target.Nick},
+		Trailing: fmt.Sprintf("Your nick was changed by %s", u.Nick),
+	})
+}
+
+// CmdSajoin is a handler for the /SAJOIN command, which lets an operator make
+// another User join a channel.
+func CmdSajoin(s Server, u *User, msg *irc.Message) error {
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	nick := msg.Params[0]
+	target, exists := s.HasUser(nick)
+	if !exists {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHNICK,
+			Params:   []string{u.Nick, nick},
+			Trailing: "No such nick/channel",
+		})
+	}
+	return CmdJoin(s, target, &irc.Message{
+		Prefix:  target.Prefix(),
+		Command: irc.JOIN,
+		Params:  msg.Params[1:2],
+	})
+}
+
+// CmdSilence is a handler for the /SILENCE command, which maintains a list of
+// masks whose messages are dropped before they are delivered to the User.
+func CmdSilence(s Server, u *User, msg *irc.Message) error {
+	if len(msg.Params) == 0 {
+		list := u.silenceList()
+		r := make([]*irc.Message, 0, len(list)+1)
+		for _, mask := range list {
+			r = append(r, &irc.Message{
+				Prefix:  s.Prefix(),
+				Command: rplSileList,
+				Params:  []string{u.Nick, u.Nick, mask},
+			})
+		}
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  rplEndOfSileList,
+			Params:   []string{u.Nick},
+			Trailing: "End of Silence List",
+		})
+		return u.Encode(r...)
+	}
+
+	arg := msg.Params[0]
+	add := true
+	switch arg[0] {
+	case '-':
+		add = false
+		fallthrough
+	case '+':
+		arg = arg[1:]
+	}
+	if arg == "" {
+		return nil
+	}
+	mask := normalizeMask(arg)
+
+	if add {
+		if !u.addSilence(mask) {
+			if len(u.silenceList()) < maxSilence {
+				// Already on the list
+				return nil
+			}
+			return u.Encode(&irc.Message{
+				Prefix:   s.Prefix(),
+				Command:  errSileListFull,
+				Params:   []string{u.Nick, mask},
+				Trailing: "Your silence list is full",
+			})
+		}
+		mask = "+" + mask
+	} else {
+		if !u.delSilence(mask) {
+			return nil
+		}
+		mask = "-" + mask
+	}
+	return u.Encode(&irc.Message{
+		Prefix:  u.Prefix(),
+		Command: cmdSilence,
+		Params:  []string{mask},
+	})
+}
+
+// CmdDie is a handler for the /DIE command, which lets an operator shut down
+// the server through the OnShutdown callback.
+func CmdDie(s Server, u *User, msg *irc.Message) error {
+	return shutdown(s, u, msg, false)
+}
+
+// CmdRestart is a handler for the /RESTART command, which lets an operator
+// restart the server through the OnShutdown callback.
+func CmdRestart(s Server, u *User, msg *irc.Message) error {
+	return shutdown(s, u, msg, true)
+}
+
+func shutdown(s Server, u *User, msg *irc.Message, restart bool) error {
+	onShutdown := s.Config().OnShutdown
+	if onShutdown == nil {
+		return u.Encode(errUnknownCommand(s, u, msg.Command))
+	}
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	logger.Infof("%s requested by %s", msg.Command, u.ID())
+	onShutdown(restart)
+	return nil
+}
+
+// CmdRehash is a handler for the /REHASH command, which lets an operator
+// reload the configuration through the OnRehash callback.
+func CmdRehash(s Server, u *User, msg *irc.Message) error {
+	onRehash := s.Config().OnRehash
+	if onRehash == nil {
+		return u.Encode(errUnknownCommand(s, u, msg.Command))
+	}
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	logger.Infof("%s requested by %s", msg.Command, u.ID())
+	if err := onRehash(); err != nil {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  errUnknownError,
+			Params:   []string{u.Nick, msg.Command},
+			Trailing: fmt.Sprintf("Rehash failed: %s", err),
+		})
+	}
+	return u.Encode(&irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.RPL_REHASHING,
+		Params:   []string{u.Nick, s.Name()},
+		Trailing: "Rehashing",
+	})
+}
+
+// CmdKline is a handler for the /KLINE command, which lets an operator ban a
+// nick!user@host mask from the server.
+func CmdKline(s Server, u *User, msg *irc.Message) error {
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	mask := normalizeMask(msg.Params[0])
+	s.Ban(mask, msg.Trailing)
+	return u.Encode(&irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.NOTICE,
+		Params:   []string{u.Nick},
+		Trailing: fmt.Sprintf("Added K-Line for %s", mask),
+	})
+}
+
+// CmdUnkline is a handler for the /UNKLINE command, which lets an operator
+// remove a ban.
+func CmdUnkline(s Server, u *User, msg *irc.Message) error {
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	mask := normalizeMask(msg.Params[0])
+	text := fmt.Sprintf("Removed K-Line for %s", mask)
+	if !s.Unban(mask) {
+		text = fmt.Sprintf("No K-Line for %s", mask)
+	}
+	return u.Encode(&irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.NOTICE,
+		Params:   []string{u.Nick},
+		Trailing: text,
+	})
+}
+
+// CmdRelayMsg is a handler for the /RELAYMSG command, which lets an operator
+// on a channel send a message to it from a relay nick without a connection,
+// such as a bridge representing a remote user.
+func CmdRelayMsg(s Server, u *User, msg *irc.Message) error {
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	ch, exists := s.HasChannel(msg.Params[0])
+	if !exists || !ch.HasUser(u) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOTONCHANNEL,
+			Params:   []string{u.Nick, msg.Params[0]},
+			Trailing: "You're not on that channel",
+		})
+	}
+	nick := msg.Params[1]
+	if !isRelayNick(nick) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_ERRONEUSNICKNAME,
+			Params:   []string{u.Nick, nick},
+			Trailing: fmt.Sprintf("Relay nick must contain %q", relayNickSeparator),
+		})
+	}
+	text := msg.Trailing
+	if text == "" && len(msg.Params) > 2 {
+		text = msg.Params[2]
+	}
+	if text == "" {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOTEXTTOSEND,
+			Params:   []string{u.Nick},
+			Trailing: "No text to send",
+		})
+	}
+
+	relayed := &irc.Message{
+		Prefix:   &irc.Prefix{Name: nick, User: "relay", Host: s.Name()},
+		Command:  irc.PRIVMSG,
+		Params:   []string{ch.String()},
+		Trailing: text,
+	}
+	logger.Debugf("%s relayed a message to %s as %s", u.ID(), ch.ID(), nick)
+	for _, to := range ch.Users() {
+		if to == u {
+			continue
+		}
+		var tags Tags
+		if to.HasCap(CapRelayMsg) {
+			tags = Tags{CapRelayMsg: u.Nick}
+		}
+		to.encodeFrom(u, tags, relayed)
+	}
+	return nil
+}
+
+// isRelayNick returns whether nick can be used with RELAYMSG: it must contain
+// the relay separator between two non-empty parts, and none of the characters
+// which are reserved in nicks and prefixes.
+func isRelayNick(nick string) bool {
+	i := strings.Index(nick, relayNickSeparator)
+	if i <= 0 || i+len(relayNickSeparator) >= len(nick) {
+		return false
+	}
+	if IsChannelName(nick) {
+		return false
+	}
+	return !strings.ContainsAny(nick, " ,:!@*?\r\n\x00")
+}
+
+// maxUserIPNicks is the number of nicks which a USERIP command can query.
+const maxUserIPNicks = 5
+
+// CmdIdleChannels is a handler for the /IDLECHANNELS command, which lets an
+// operator list the channels without messages for at least the given
+// duration, such as "24h", and close them if CLOSE follows.
+func CmdIdleChannels(s Server, u *User, msg *irc.Message) error {
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	age, err := time.ParseDuration(msg.Params[0])
+	if err != nil || age <= 0 {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.NOTICE,
+			Params:   []string{u.Nick},
+			Trailing: "Invalid duration: " + msg.Params[0],
+		})
+	}
+	closeIdle := len(msg.Params) > 1 && strings.EqualFold(msg.Params[1], "CLOSE")
+
+	r := []*irc.Message{}
+	now := time.Now()
+	for _, ch := range idleChannels(s, age, now) {
+		text := fmt.Sprintf("%s idle %s", ch, now.Sub(ch.(activeChannel).LastActive()).Round(time.Second))
+		if closeIdle {
+			s.CloseChannel(ch)
+			text = "Closed " + text
+		}
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.NOTICE,
+			Params:   []string{u.Nick},
+			Trailing: text,
+		})
+	}
+	r = append(r, &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.NOTICE,
+		Params:   []string{u.Nick},
+		Trailing: "End of " + cmdIdleChannels,
+	})
+	return u.Encode(r...)
+}
+
+// idleChannels returns the channels which have had no messages for at least
+// age, sorted by ID. Channels which don't keep track of their activity are
+// never idle.
+func idleChannels(s Server, age time.Duration, now time.Time) []Channel {
+	channels := []Channel{}
+	for _, ch := range s.Channels() {
+		if ac, ok := ch.(activeChannel); ok && now.Sub(ac.LastActive()) >= age {
+			channels = append(channels, ch)
+		}
+	}
+	return channels
+}
+
+// CmdRename is a handler for the /RENAME command of draft/channel-rename,
+// which lets a channel operator rename the channel.
+func CmdRename(s Server, u *User, msg *irc.Message) error {
+	oldName, newName := msg.Params[0], msg.Params[1]
+	ch, exists := s.HasChannel(oldName)
+	if !exists || !visibleTo(ch, u) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHCHANNEL,
+			Params:   []string{u.Nick, oldName},
+			Trailing: "No such channel",
+		})
+	}
+	if !isChannelOp(ch, u) {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_CHANOPRIVSNEEDED,
+			Params:   []string{u.Nick, ch.String()},
+			Trailing: "You're not channel operator",
+		})
+	}
+
+	var err error
+	if r, ok := s.(channelRenamer); ok {
+		err = r.renameChannel(u, oldName, newName, msg.Trailing)
+	} else if r, ok := s.(ChannelRenamer); ok {
+		err = r.RenameChannel(oldName, newName)
+	} else {
+		err = ErrNoSuchChannel
+	}
+	fail := func(code string, text string) error {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  cmdFail,
+			Params:   []string{cmdRename, code, oldName, newName},
+			Trailing: text,
+		})
+	}
+	switch err {
+	case nil:
+		return nil
+	case ErrChannelExists:
+		return fail("CHANNEL_NAME_IN_USE", "Channel already exists")
+	case ErrInvalidChannelName, ErrNoSuchChannel:
+		return fail("CANNOT_RENAME", "Channel can't be renamed")
+	}
+	return err
+}
+
+// CmdCheck is a handler for the /CHECK command, which lets an operator list
+// every member of a channel, regardless of its visibility, along with their
+// real host, address and idle time. Each member is described by a NOTICE:
+// nick!user@host realhost ip idle <seconds>
+func CmdCheck(s Server, u *User, msg *irc.Message) error {
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	ch, exists := s.HasChannel(msg.Params[0])
+	if !exists {
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.ERR_NOSUCHCHANNEL,
+			Params:   []string{u.Nick, msg.Params[0]},
+			Trailing: "No such channel",
+		})
+	}
+	members := ch.Users()
+	sort.Slice(members, func(i, j int) bool { return members[i].ID() < members[j].ID() })
+
+	r := make([]*irc.Message, 0, len(members)+1)
+	for _, other := range members {
+		idle := time.Since(other.LastActive()) / time.Second
+		r = append(r, &irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.NOTICE,
+			Params:   []string{u.Nick},
+			Trailing: fmt.Sprintf("%s %s %s idle %d", other.Prefix(), other.RealHost(), other.IP(), idle),
+		})
+	}
+	r = append(r, &irc.Message{
+		Prefix:   s.Prefix(),
+		Command:  irc.NOTICE,
+		Params:   []string{u.Nick},
+		Trailing: "End of CHECK " + ch.String(),
+	})
+	return u.Encode(r...)
+}
+
+// CmdUserIP is a handler for the /USERIP command, which lets an operator look
+// up the addresses which Users connected from, regardless of cloaking. Replies
+// are formatted like RPL_USERHOST: nick[*]=(+|-)user@ip
+func CmdUserIP(s Server, u *User, msg *irc.Message) error {
+	if !u.IsOper() {
+		return u.Encode(errNoPrivileges(s, u))
+	}
+	nicks := msg.Params
+	if msg.Trailing != "" {
+		nicks = append(nicks[:len(nicks):len(nicks)], msg.Trailing)
+	}
+	if len(nicks) > maxUserIPNicks {
+		nicks = nicks[:maxUserIPNicks]
+	}
+	replies := []string{}
+	for _, nick := range nicks {
+		other, ok := s.HasUser(nick)
+		if !ok {
+			continue
+		}
+		oper, away := "", "+"
+		if other.IsOper() {
+			oper = "*"
+		}
+		if other.Away() != "" {
+			away = "-"
+		}
+		replies = append(replies, fmt.Sprintf("%s%s=%s%s@%s", other.Nick, oper, away, other.User, other.IP()))
+	}
+	return u.Encode(&irc.Message{
+		Prefix:        s.Prefix(),
+		Command:       rplUserIP,
+		Params:        []string{u.Nick},
+		Trailing:      strings.Join(replies, " "),
+		EmptyTrailing: len(replies) == 0,
+	})
+}
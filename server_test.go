@@ -1,7 +1,15 @@
 package irckit
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
 	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,11 +20,39 @@ const testServerName = "testserver"
 
 var expectTimeout = time.Second * 1
 
+func receiveReply(t *testing.T, conn *mockConn) *irc.Message {
+	select {
+	case msg := <-conn.send:
+		return msg
+	case <-time.After(expectTimeout):
+		t.Fatal("timed out waiting for reply")
+	}
+	return nil
+}
+
+// receiveUntil consumes replies up to and including the given command.
+func receiveUntil(t *testing.T, conn *mockConn, command string) *irc.Message {
+	for {
+		if msg := receiveReply(t, conn); msg.Command == command {
+			return msg
+		}
+	}
+}
+
+// receiveWelcome consumes the welcome burst, up to the end of the MOTD.
+func receiveWelcome(t *testing.T, conn *mockConn) {
+	receiveUntil(t, conn, irc.RPL_ENDOFMOTD)
+}
+
 func expectReply(t *testing.T, conn *mockConn, expect string) {
 	select {
 	case msg := <-conn.send:
-		if !regexp.MustCompile(expect).MatchString(msg.String()) {
-			t.Errorf("\ngot\t\t%q\nwant\t%q", msg, expect)
+		line := msg.String()
+		if tags := conn.Tags(msg); len(tags) > 0 {
+			line = "@" + tags.String() + " " + line
+		}
+		if !regexp.MustCompile(expect).MatchString(line) {
+			t.Errorf("\ngot\t\t%q\nwant\t%q", line, expect)
 		}
 	case <-time.After(expectTimeout):
 		t.Fatalf("timed out waiting for %q", expect)
@@ -53,6 +89,42 @@ func TestServerWelcome(t *testing.T) {
 	expectEvent(t, events, ConnectEvent)
 }
 
+func TestServerPrefix(t *testing.T) {
+	srv := ServerConfig{
+		Name: testServerName,
+		Prefix: func() *irc.Prefix {
+			return &irc.Prefix{Name: "irc.example.com"}
+		},
+	}.Server()
+	defer srv.Close()
+
+	c := NewConnMock("foohost", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectReply(t, c, "^:irc.example.com 001 foo :")
+	receiveWelcome(t, c)
+
+	c.receive <- irc.ParseMessage("PING :hello")
+	expectReply(t, c, "^:irc.example.com PONG ")
+}
+
+func TestServerNoNicknameGiven(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK")
+	expectReply(t, c, "^:testserver 431 \\* :No nickname given$")
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	receiveWelcome(t, c)
+
+	c.receive <- irc.ParseMessage("NICK")
+	expectReply(t, c, "^:testserver 431 foo :No nickname given$")
+}
+
 func TestServerMultiUser(t *testing.T) {
 	events := make(chan Event, 10)
 	srv := ServerConfig{
@@ -79,6 +151,7 @@ func TestServerMultiUser(t *testing.T) {
 	expectReply(t, c1, ":testserver 002 foo :Your host is .*")
 	expectReply(t, c1, ":testserver 003 foo :This server was created .*")
 	expectReply(t, c1, ":testserver 004 foo :.*")
+	expectReply(t, c1, ":testserver 005 foo .*SILENCE=32.* :are supported by this server")
 	expectReply(t, c1, ":testserver 251 foo :There are 1 users and 0 services on 1 server.")
 	expectReply(t, c1, ":testserver 375 foo :- testserver Message of the Day -")
 	expectReply(t, c1, ":testserver 372 foo :- I serve, therefore I am.")
@@ -87,6 +160,7 @@ func TestServerMultiUser(t *testing.T) {
 	expectReply(t, c2, ":testserver 002 baz :Your host is .*")
 	expectReply(t, c2, ":testserver 003 baz :This server was created .*")
 	expectReply(t, c2, ":testserver 004 baz :.*")
+	expectReply(t, c2, ":testserver 005 baz .*SILENCE=32.* :are supported by this server")
 	expectReply(t, c2, ":testserver 251 baz :There are 2 users and 0 services on 1 server.")
 	expectReply(t, c2, ":testserver 375 baz :- testserver Message of the Day -")
 	expectReply(t, c2, ":testserver 372 baz :- I serve, therefore I am.")
@@ -94,7 +168,7 @@ func TestServerMultiUser(t *testing.T) {
 
 	c1.receive <- irc.ParseMessage("JOIN #chat")
 	expectReply(t, c1, ":foo!root@client1 JOIN #chat")
-	expectReply(t, c1, ":testserver 353 foo = #chat :foo")
+	expectReply(t, c1, ":testserver 353 foo = #chat :@foo")
 	expectReply(t, c1, ":testserver 366 foo #chat :End of /NAMES list.")
 	expectEvent(t, events, NewChanEvent)
 	expectEvent(t, events, JoinEvent)
@@ -104,13 +178,15 @@ func TestServerMultiUser(t *testing.T) {
 		t.Errorf("expected #chat to be len 1; got: %v", channel.Users())
 	}
 
-	channel.Topic(srv, "so topical")
+	channel.SetTopic(nil, "so topical")
 	expectReply(t, c1, ":testserver TOPIC #chat :so topical")
+	expectEvent(t, events, TopicEvent)
 
 	c2.receive <- irc.ParseMessage("JOIN #chat")
 	expectReply(t, c2, ":baz!root@client2 JOIN #chat")
 	expectReply(t, c2, ":testserver 332 baz #chat :so topical")
-	expectReply(t, c2, ":testserver 353 baz = #chat :baz foo")
+	expectReply(t, c2, ":testserver 333 baz #chat testserver \\d+")
+	expectReply(t, c2, ":testserver 353 baz = #chat :@foo baz")
 	expectReply(t, c2, ":testserver 366 baz #chat :End of /NAMES list.")
 	expectEvent(t, events, JoinEvent)
 
@@ -142,7 +218,10 @@ func TestServerMultiUser(t *testing.T) {
 
 	c2.receive <- irc.ParseMessage("PRIVMSG #chat :hello")
 	expectReply(t, c1, ":baz!root@client2 PRIVMSG #chat :hello")
-	expectEvent(t, events, ChanMsgEvent)
+	evt := expectEvent(t, events, ChanMsgEvent)
+	if msg := evt.Message(); msg == nil || msg.Command != irc.PRIVMSG || msg.Params[0] != "#chat" || msg.Trailing != "hello" {
+		t.Errorf("expected the raw PRIVMSG in the event; got %v", msg)
+	}
 	// Note: baz doesn't get an echo back here
 	c1.receive <- irc.ParseMessage("PRIVMSG baz :sup?")
 	expectReply(t, c2, ":foo_!root@client1 PRIVMSG baz :sup?")
@@ -162,7 +241,7 @@ func TestServerMultiUser(t *testing.T) {
 
 	c2.receive <- irc.ParseMessage("JOIN #blah")
 	expectReply(t, c2, ":baz!root@client2 JOIN #blah")
-	expectReply(t, c2, ":testserver 353 baz = #blah :baz")
+	expectReply(t, c2, ":testserver 353 baz = #blah :@baz")
 	expectReply(t, c2, ":testserver 366 baz #blah :End of /NAMES list.")
 	expectEvent(t, events, NewChanEvent)
 	expectEvent(t, events, JoinEvent)
@@ -191,3 +270,3155 @@ func TestServerMultiUser(t *testing.T) {
 		t.Errorf("expected #chat to be len 1; got: %v", channel2.Users())
 	}
 }
+
+func TestServerCloakHost(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+		CloakHost: func(host string) string {
+			return "cloaked-" + host
+		},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1 := NewConnMock("10.0.0.1", 20)
+	c2 := NewConnMock("10.0.0.2", 20)
+	go srv.Connect(NewUser(c1))
+	go srv.Connect(NewUser(c2))
+
+	c1.receive <- irc.ParseMessage("NICK foo")
+	c1.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz Quux")
+	expectEvent(t, events, ConnectEvent)
+
+	expectReply(t, c1, ":testserver 001 foo :Welcome! foo!root@cloaked-10.0.0.1")
+
+	c1.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, NewChanEvent)
+	expectEvent(t, events, JoinEvent)
+	c2.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, JoinEvent)
+
+	// Drain the rest of c1's welcome burst and its own join.
+	receiveWelcome(t, c1)
+	receiveUntil(t, c1, irc.RPL_ENDOFNAMES)
+	expectReply(t, c1, ":baz!root@cloaked-10.0.0.2 JOIN #chat")
+
+	u, _ := srv.HasUser("baz")
+	if got, want := u.RealHost(), "10.0.0.2"; got != want {
+		t.Errorf("got real host %q; want %q", got, want)
+	}
+
+	// Only operators see the real host in WHOIS.
+	c2.receive <- irc.ParseMessage("WHOIS foo")
+	for {
+		msg := receiveReply(t, c2)
+		if msg.Command == rplWhoisHost {
+			t.Errorf("unexpected real host for a regular user: %s", msg)
+		}
+		if msg.Command == irc.RPL_ENDOFWHOIS {
+			break
+		}
+	}
+	c1.receive <- irc.ParseMessage("OPER admin hunter2")
+	receiveUntil(t, c1, irc.MODE)
+	c1.receive <- irc.ParseMessage("WHOIS baz")
+	msg := receiveUntil(t, c1, rplWhoisHost)
+	if got, want := msg.String(), ":testserver 378 foo baz :is connecting from *@10.0.0.2 10.0.0.2"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestServerWebIRC(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:           testServerName,
+		WebIRCPassword: "hunter2",
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1 := NewConnMock("gateway", 20)
+	c2 := NewConnMock("gateway", 20)
+	go srv.Connect(NewUser(c1))
+	go srv.Connect(NewUser(c2))
+
+	c1.receive <- irc.ParseMessage("WEBIRC hunter2 webchat client.example.com 10.0.0.1")
+	c1.receive <- irc.ParseMessage("NICK foo")
+	c1.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	expectReply(t, c1, ":testserver 001 foo :Welcome! foo!root@client.example.com")
+
+	c2.receive <- irc.ParseMessage("WEBIRC wrong webchat spoofed.example.com 10.0.0.2")
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz Quux")
+	expectEvent(t, events, ConnectEvent)
+	expectReply(t, c2, ":testserver 001 baz :Welcome! baz!root@gateway")
+
+	// Addresses which aren't IPs are rejected.
+	c3 := NewConnMock("gateway", 20)
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Connect(NewUser(c3)) }()
+	c3.receive <- irc.ParseMessage("WEBIRC hunter2 webchat spoofed.example.com *!*@evil")
+	expectReply(t, c3, "^:testserver ERROR :Invalid WEBIRC IP address$")
+	if err := <-errs; !errors.Is(err, ErrInvalidWebIRC) {
+		t.Errorf("got %v; want ErrInvalidWebIRC", err)
+	}
+}
+
+func TestServerCapNegotiation(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name: testServerName,
+		Caps: map[string]string{"sasl": "PLAIN"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+
+	c.receive <- irc.ParseMessage("CAP LS 302")
+	expectReply(t, c, ":testserver CAP \\* LS :account-notify account-tag batch cap-notify draft/channel-rename draft/message-redaction draft/multiline=max-bytes=4096,max-lines=24 draft/relaymsg=/ labeled-response message-tags sasl=PLAIN")
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	c.receive <- irc.ParseMessage("CAP REQ :sasl bogus")
+	expectReply(t, c, ":testserver CAP foo NAK :sasl bogus")
+	c.receive <- irc.ParseMessage("CAP REQ :sasl")
+	expectReply(t, c, ":testserver CAP foo ACK :sasl")
+	c.receive <- irc.ParseMessage("CAP END")
+	expectEvent(t, events, ConnectEvent)
+	expectReply(t, c, ":testserver 001 foo :Welcome! .*")
+
+	u, _ := srv.HasUser("foo")
+	if !u.HasCap("sasl") || !u.HasCap(CapNotify) {
+		t.Errorf("expected sasl and cap-notify to be negotiated; got: %v", u.Caps())
+	}
+
+	// Drain the rest of the welcome burst.
+	receiveWelcome(t, c)
+
+	srv.SetCap("away-notify", "")
+	expectReply(t, c, ":testserver CAP foo NEW :away-notify")
+	srv.DelCap("sasl")
+	expectReply(t, c, ":testserver CAP foo DEL :sasl")
+	if u.HasCap("sasl") {
+		t.Errorf("expected sasl to be removed; got: %v", u.Caps())
+	}
+
+	// Clients which didn't give CAP LS 302 get the names without values.
+	c2 := NewConnMock("client2", 20)
+	go srv.Connect(NewUser(c2))
+	c2.receive <- irc.ParseMessage("CAP LS")
+	expectReply(t, c2, ":testserver CAP \\* LS :.* draft/multiline draft/relaymsg ")
+	c2.receive <- irc.ParseMessage("CAP REQ :cap-notify")
+	expectReply(t, c2, ":testserver CAP \\* ACK :cap-notify")
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz Quux")
+	c2.receive <- irc.ParseMessage("CAP END")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c2)
+
+	srv.SetCap("sasl", "PLAIN")
+	expectReply(t, c, ":testserver CAP foo NEW :sasl=PLAIN$")
+	expectReply(t, c2, ":testserver CAP baz NEW :sasl$")
+}
+
+func TestServerHandshakeCapTolerance(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+
+	// CAP negotiation doesn't count towards the handshake tolerance, however
+	// long it takes.
+	for i := 0; i < handshakeMsgTolerance+5; i++ {
+		c.receive <- irc.ParseMessage("CAP LS 302")
+		expectReply(t, c, ":testserver CAP \\* LS :")
+	}
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	c.receive <- irc.ParseMessage("CAP END")
+	expectEvent(t, events, ConnectEvent)
+	expectReply(t, c, ":testserver 001 foo :Welcome! .*")
+}
+
+func TestServerHandshakeTolerance(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	c := NewConnMock("client", handshakeMsgTolerance+1)
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Connect(NewUser(c)) }()
+
+	for i := 0; i < handshakeMsgTolerance; i++ {
+		c.receive <- irc.ParseMessage("NICK")
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrHandshakeFailed) {
+			t.Errorf("got %v; want ErrHandshakeFailed", err)
+		}
+		if !errors.Is(err, ErrTooManyAttempts) {
+			t.Errorf("got %v; want cause ErrTooManyAttempts", err)
+		}
+		var herr *HandshakeError
+		if !errors.As(err, &herr) || herr.Host != "client" {
+			t.Errorf("got %#v; want HandshakeError for host client", err)
+		}
+	case <-time.After(expectTimeout):
+		t.Fatal("timed out waiting for the handshake to fail")
+	}
+}
+
+func TestServerAccountNotify(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1 := NewConnMock("client1", 20)
+	c2 := NewConnMock("client2", 20)
+	go srv.Connect(NewUser(c1))
+	go srv.Connect(NewUser(c2))
+
+	c1.receive <- irc.ParseMessage("NICK foo")
+	c1.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	c2.receive <- irc.ParseMessage("CAP REQ :account-notify account-tag")
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz Quux")
+	c2.receive <- irc.ParseMessage("CAP END")
+	expectEvent(t, events, ConnectEvent)
+
+	c1.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, NewChanEvent)
+	expectEvent(t, events, JoinEvent)
+	c2.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, JoinEvent)
+
+	// Drain the CAP ACK, welcome burst and join.
+	expectReply(t, c2, ":testserver CAP \\* ACK :account-notify account-tag")
+	receiveWelcome(t, c2)
+	receiveUntil(t, c2, irc.RPL_ENDOFNAMES)
+
+	u1, _ := srv.HasUser("foo")
+	srv.SetAccount(u1, "fooaccount")
+	expectReply(t, c2, "^:foo!root@client1 ACCOUNT fooaccount$")
+
+	c1.receive <- irc.ParseMessage("PRIVMSG #chat :hello")
+	expectEvent(t, events, ChanMsgEvent)
+	expectReply(t, c2, "^@account=fooaccount :foo!root@client1 PRIVMSG #chat :hello$")
+
+	srv.SetAccount(u1, "")
+	expectReply(t, c2, "^:foo!root@client1 ACCOUNT \\*$")
+}
+
+func TestServerLabeledResponse(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+
+	c.receive <- irc.ParseMessage("CAP REQ :labeled-response batch")
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	c.receive <- irc.ParseMessage("CAP END")
+	expectEvent(t, events, ConnectEvent)
+	expectReply(t, c, ":testserver CAP \\* ACK :labeled-response batch")
+	receiveWelcome(t, c)
+
+	c.receiveLine("@label=ping1 PING :hi")
+	expectReply(t, c, "^@label=ping1 :testserver PONG testserver :hi$")
+
+	c.receiveLine("@label=nick1 NICK foo")
+	expectReply(t, c, "^@label=nick1 :testserver 433 foo :Nickname is already in use$")
+
+	c.receiveLine("@label=join1 JOIN #chat")
+	expectReply(t, c, "^@label=join1 :testserver BATCH \\+(\\w+) labeled-response$")
+	expectReply(t, c, "^@batch=\\w+ :foo!root@client JOIN #chat$")
+	expectReply(t, c, "^@batch=\\w+ :testserver 353 foo = #chat :@foo$")
+	expectReply(t, c, "^@batch=\\w+ :testserver 366 foo #chat :End of /NAMES list.$")
+	expectReply(t, c, "^:testserver BATCH -\\w+$")
+
+	c.receiveLine("@label=part1 PART #nope")
+	expectReply(t, c, "^@label=part1 :testserver 403 #nope :No such channel$")
+}
+
+func TestServerDeliveryReceipts(t *testing.T) {
+	cmds := DefaultCommands()
+	cmds.Add(Handler{Command: irc.NOTICE, Call: CmdPrivMsg})
+	srv := ServerConfig{
+		Name:             testServerName,
+		DeliveryReceipts: true,
+		Commands:         cmds,
+	}.Server()
+	defer srv.Close()
+
+	c1, c2 := NewConnMock("client1", 20), NewConnMock("client2", 20)
+	go srv.Connect(NewUser(c1))
+	c1.receive <- irc.ParseMessage("CAP REQ :labeled-response batch")
+	c1.receive <- irc.ParseMessage("NICK foo")
+	c1.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	c1.receive <- irc.ParseMessage("CAP END")
+	expectReply(t, c1, ":testserver CAP \\* ACK :labeled-response batch")
+	receiveWelcome(t, c1)
+
+	go srv.Connect(NewUser(c2))
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz")
+	receiveWelcome(t, c2)
+
+	c1.receiveLine("@label=msg1 PRIVMSG baz :hello")
+	expectReply(t, c2, "^:foo!root@client1 PRIVMSG baz :hello$")
+	expectReply(t, c1, "^@label=msg1 :testserver ACK$")
+
+	c1.receiveLine("@label=msg2 PRIVMSG nope :hello")
+	expectReply(t, c1, "^@label=msg2 :testserver FAIL PRIVMSG NO_SUCH_TARGET nope :No such nick/channel$")
+
+	// Unlabeled messages get the usual numeric.
+	c1.receive <- irc.ParseMessage("PRIVMSG nope :hello")
+	expectReply(t, c1, "^:testserver 401 nope :No such nick/channel$")
+
+	// NOTICE never gets a receipt.
+	c1.receiveLine("@label=notice1 NOTICE nope :hello")
+	expectReply(t, c1, "^@label=notice1 :testserver 401 nope :No such nick/channel$")
+}
+
+func TestServerLabeledResponseOtherSources(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	cmds := DefaultCommands()
+	cmds.Add(Handler{Command: "WAIT", Call: func(s Server, u *User, msg *irc.Message) error {
+		close(started)
+		<-release
+		return u.Encode(&irc.Message{
+			Prefix:   s.Prefix(),
+			Command:  irc.NOTICE,
+			Params:   []string{u.Nick},
+			Trailing: "done",
+		})
+	}})
+	srv := ServerConfig{
+		Name:     testServerName,
+		Commands: cmds,
+	}.Server()
+	defer srv.Close()
+
+	c1, c2 := NewConnMock("client1", 20), NewConnMock("client2", 20)
+	go srv.Connect(NewUser(c1))
+	c1.receive <- irc.ParseMessage("CAP REQ :labeled-response batch")
+	c1.receive <- irc.ParseMessage("NICK foo")
+	c1.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	c1.receive <- irc.ParseMessage("CAP END")
+	receiveWelcome(t, c1)
+	go srv.Connect(NewUser(c2))
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz")
+	receiveWelcome(t, c2)
+
+	// Messages from others are delivered during the command, unlabeled.
+	c1.receiveLine("@label=wait1 WAIT")
+	<-started
+	c2.receive <- irc.ParseMessage("PRIVMSG foo :hello")
+	expectReply(t, c1, "^:baz!root@client2 PRIVMSG foo :hello$")
+	close(release)
+	expectReply(t, c1, "^@label=wait1 :testserver NOTICE foo :done$")
+}
+
+func TestServerCloseChannel(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1 := NewConnMock("client1", 20)
+	c2 := NewConnMock("client2", 20)
+	go srv.Connect(NewUser(c1))
+	go srv.Connect(NewUser(c2))
+
+	c1.receive <- irc.ParseMessage("NICK foo")
+	c1.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz Quux")
+	expectEvent(t, events, ConnectEvent)
+
+	c1.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, NewChanEvent)
+	expectEvent(t, events, JoinEvent)
+	c2.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, JoinEvent)
+	receiveWelcome(t, c1)
+	receiveUntil(t, c1, irc.RPL_ENDOFNAMES)
+	expectReply(t, c1, "^:baz!root@client2 JOIN #chat$")
+	receiveWelcome(t, c2)
+	receiveUntil(t, c2, irc.RPL_ENDOFNAMES)
+
+	ch, _ := srv.HasChannel("#chat")
+	srv.CloseChannel(ch)
+	expectEvent(t, events, DestroyChanEvent)
+	expectEvent(t, events, CloseChanEvent)
+
+	for _, c := range []*mockConn{c1, c2} {
+		parts := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			msg := receiveReply(t, c)
+			if msg.Command != irc.PART || msg.Params[0] != "#chat" {
+				t.Errorf("expected PART #chat; got %s", msg)
+			}
+			parts[msg.Prefix.Name] = true
+		}
+		if !parts["foo"] || !parts["baz"] {
+			t.Errorf("expected PARTs for foo and baz; got %v", parts)
+		}
+	}
+
+	if _, exists := srv.HasChannel("#chat"); exists {
+		t.Error("expected #chat to be unlinked")
+	}
+	if ch.Len() != 0 {
+		t.Errorf("expected #chat to be empty; got: %v", ch.Users())
+	}
+	u1, _ := srv.HasUser("foo")
+	if len(u1.Channels()) != 0 {
+		t.Errorf("expected 0 channels for foo; got: %v", u1.Channels())
+	}
+}
+
+func TestServerCloseChannelDiscardEmpty(t *testing.T) {
+	srv := ServerConfig{
+		Name:         testServerName,
+		DiscardEmpty: true,
+	}.Server()
+	defer srv.Close()
+
+	u := NewUser(NewConnMock("client", 20))
+	u.Nick = "foo"
+
+	ch := srv.Channel("#closed")
+	ch.Join(u)
+	srv.CloseChannel(ch)
+
+	// Emptying other channels must still work after closing one.
+	other := srv.Channel("#other")
+	other.Join(u)
+	other.Part(u, "")
+
+	waitDiscarded(t, srv, "#other")
+}
+
+func TestServerDestroyChanEvent(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:         testServerName,
+		DiscardEmpty: true,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	u := NewUser(NewConnMock("client", 20))
+	u.Nick = "foo"
+
+	ch := srv.Channel("#chat")
+	expectEvent(t, events, NewChanEvent)
+	ch.Join(u)
+	ch.Part(u, "")
+	expectEvent(t, events, PartEvent)
+	evt := expectEvent(t, events, DestroyChanEvent)
+	if evt.Channel() != ch {
+		t.Errorf("got channel %v; want %v", evt.Channel(), ch)
+	}
+
+	// Unlinking the channel again is a no-op.
+	srv.UnlinkChannel(ch)
+	select {
+	case evt := <-events:
+		t.Errorf("unexpected event: %s", evt)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestServerDiscardEmptyOnce(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:         testServerName,
+		DiscardEmpty: true,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	ch := srv.Channel("#chat")
+	users := []*User{}
+	for _, nick := range []string{"foo", "baz"} {
+		u := NewUser(NewConnMock(nick+"host", 10))
+		u.Nick = nick
+		ch.Join(u)
+		users = append(users, u)
+	}
+	for _, u := range users {
+		go ch.Part(u, "")
+	}
+	waitDiscarded(t, srv, "#chat")
+
+	destroyed := 0
+	timeout := time.After(20 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case evt := <-events:
+			if evt.Kind() == DestroyChanEvent {
+				destroyed++
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if destroyed != 1 {
+		t.Errorf("got %d DestroyChanEvents; want 1", destroyed)
+	}
+}
+
+func TestServerCloseDiscardEmptyLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	srv := ServerConfig{
+		Name:         testServerName,
+		DiscardEmpty: true,
+	}.Server()
+	for _, name := range []string{"#foo", "#bar"} {
+		srv.Channel(name)
+	}
+	srv.Close()
+
+	deadline := time.Now().Add(expectTimeout)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked %d goroutines after Close", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerDiscardEmptyLeak(t *testing.T) {
+	srv := ServerConfig{
+		Name:         testServerName,
+		DiscardEmpty: true,
+	}.Server()
+	defer srv.Close()
+
+	u := NewUser(NewConnMock("client", 200))
+	u.Nick = "foo"
+
+	// Settle the server's own goroutines before counting.
+	srv.Channel("#warmup")
+	srv.UnlinkChannel(srv.Channel("#warmup"))
+	time.Sleep(10 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("#chan%d", i)
+		ch := srv.Channel(name)
+		ch.Join(u)
+		ch.Part(u, "")
+		waitDiscarded(t, srv, name)
+		srv.UnlinkChannel(srv.Channel(name))
+	}
+
+	deadline := time.Now().Add(expectTimeout)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked %d goroutines after discarding channels", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitDiscarded waits for the empty channel to be discarded by the server.
+func waitDiscarded(t *testing.T, srv Server, name string) {
+	deadline := time.Now().Add(expectTimeout)
+	for {
+		if _, exists := srv.HasChannel(name); !exists {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be discarded", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerRegisterChannel(t *testing.T) {
+	srv := ServerConfig{
+		Name:         testServerName,
+		DiscardEmpty: true,
+	}.Server()
+	defer srv.Close()
+
+	u := NewUser(NewConnMock("client", 20))
+	u.Nick = "foo"
+
+	lobby := srv.Register("#lobby")
+	lobby.Join(u)
+	lobby.Part(u, "")
+
+	// Empty an unregistered channel afterwards, to give the cleanup a
+	// chance to consider #lobby.
+	other := srv.Channel("#other")
+	other.Join(u)
+	other.Part(u, "")
+	waitDiscarded(t, srv, "#other")
+
+	if ch, exists := srv.HasChannel("#lobby"); !exists || ch != lobby {
+		t.Error("expected registered #lobby to be kept while empty")
+	}
+}
+
+func TestServerFindChannels(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	for _, name := range []string{"#b1", "#A2", "#a1"} {
+		srv.Register(name)
+	}
+	var names []string
+	for _, ch := range srv.(ChannelFinder).FindChannels("#a*") {
+		names = append(names, ch.String())
+	}
+	if got, want := strings.Join(names, " "), "#a1 #A2"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if channels := srv.(ChannelFinder).FindChannels("#c?"); len(channels) != 0 {
+		t.Errorf("expected no matches; got %v", channels)
+	}
+}
+
+func TestServerKeepEmptyChannels(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:              testServerName,
+		DiscardEmpty:      true,
+		KeepEmptyChannels: true,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	u := NewUser(NewConnMock("client", 20))
+	u.Nick = "foo"
+
+	lobby := srv.Channel("#lobby")
+	expectEvent(t, events, NewChanEvent)
+	lobby.Join(u)
+	lobby.Part(u, "")
+	expectEvent(t, events, PartEvent)
+
+	// Give the cleanup a chance to consider #lobby.
+	select {
+	case evt := <-events:
+		t.Errorf("unexpected event: %s", evt)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if ch, exists := srv.HasChannel("#lobby"); !exists || ch != lobby {
+		t.Error("expected #lobby to be kept while empty")
+	}
+}
+
+func TestServerChannelStore(t *testing.T) {
+	srv := ServerConfig{
+		Name:         testServerName,
+		DiscardEmpty: true,
+		ChannelStore: MemoryChannelStore(),
+	}.Server()
+	defer srv.Close()
+
+	u := NewUser(NewConnMock("client", 20))
+	u.Nick = "foo"
+
+	ch := srv.Channel("#chat")
+	ch.Join(u)
+	if err := ch.SetTopic(u, "Persistent topic"); err != nil {
+		t.Fatal(err)
+	}
+	modes := map[byte]string{ModeSecret: "", ModeLimit: "10", ModeForward: "#overflow", ModeKey: "hunter2"}
+	for mode, param := range modes {
+		ch.SetMode(mode, param)
+	}
+	ch.Part(u, "")
+	waitDiscarded(t, srv, "#chat")
+
+	ch = srv.Channel("#Chat")
+	if got, want := ch.Topic(), "Persistent topic"; got != want {
+		t.Errorf("got topic %q; want %q", got, want)
+	}
+	for mode, want := range modes {
+		if got, ok := ch.Mode(mode); !ok || got != want {
+			t.Errorf("got mode %c %q (set: %v); want %q", mode, got, ok, want)
+		}
+	}
+
+	// Closed channels are discarded without saving their state.
+	ch.SetTopic(nil, "Closing")
+	srv.CloseChannel(ch)
+	if got, want := srv.Channel("#chat").Topic(), "Persistent topic"; got != want {
+		t.Errorf("got topic %q; want %q", got, want)
+	}
+}
+
+func TestServerTopic(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1 := NewConnMock("client1", 20)
+	c2 := NewConnMock("client2", 20)
+	go srv.Connect(NewUser(c1))
+	go srv.Connect(NewUser(c2))
+
+	c1.receive <- irc.ParseMessage("NICK foo")
+	c1.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz Quux")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c1)
+	receiveWelcome(t, c2)
+
+	c1.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, NewChanEvent)
+	expectEvent(t, events, JoinEvent)
+	receiveUntil(t, c1, irc.RPL_ENDOFNAMES)
+
+	ch, _ := srv.HasChannel("#chat")
+	u1, _ := srv.HasUser("foo")
+	u2, _ := srv.HasUser("baz")
+
+	if err := ch.SetTopic(u2, "not a member"); err != ErrNotOnChannel {
+		t.Errorf("got %v; want %v", err, ErrNotOnChannel)
+	}
+	if err := ch.SetTopic(u1, "so topical"); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, c1, "^:foo!root@client1 TOPIC #chat :so topical$")
+	evt := expectEvent(t, events, TopicEvent)
+	if evt.User() != u1 {
+		t.Errorf("expected TopicEvent from foo; got: %v", evt)
+	}
+	if got := ch.Topic(); got != "so topical" {
+		t.Errorf("got topic %q; want %q", got, "so topical")
+	}
+
+	c2.receive <- irc.ParseMessage("TOPIC #chat")
+	expectReply(t, c2, "^:testserver 332 baz #chat :so topical$")
+	c2.receive <- irc.ParseMessage("TOPIC #chat :hijacked")
+	expectReply(t, c2, "^:testserver 442 baz #chat :You're not on that channel$")
+
+	c2.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, JoinEvent)
+	expectReply(t, c2, "^:baz!root@client2 JOIN #chat$")
+	expectReply(t, c2, "^:testserver 332 baz #chat :so topical$")
+	expectReply(t, c2, "^:testserver 333 baz #chat foo!root@client1 \\d+$")
+}
+
+func TestServerMaxTopicLen(t *testing.T) {
+	for _, tc := range []struct {
+		policy MsgLenPolicy
+		expect string
+	}{
+		{TruncateMsg, "^:foo!root@client TOPIC #chat :so to\\.\\.\\.$"},
+		{RejectMsg, "^:testserver 417 foo :Input line was too long$"},
+	} {
+		srv := ServerConfig{
+			Name:           testServerName,
+			MaxTopicLen:    8,
+			TopicLenPolicy: tc.policy,
+		}.Server()
+
+		c := NewConnMock("client", 20)
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK foo")
+		c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+		isupport := receiveUntil(t, c, rplISupport)
+		if !strings.Contains(isupport.String(), " TOPICLEN=8 ") {
+			t.Errorf("expected TOPICLEN in %q", isupport)
+		}
+		receiveWelcome(t, c)
+
+		c.receive <- irc.ParseMessage("JOIN #chat")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+		c.receive <- irc.ParseMessage("TOPIC #chat :so topical")
+		expectReply(t, c, tc.expect)
+		srv.Close()
+	}
+}
+
+func TestServerUndeliveredMsg(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	c.receive <- irc.ParseMessage("PRIVMSG nobody :are you there?")
+	expectReply(t, c, "^:testserver 401 nobody :No such nick/channel$")
+	evt := expectEvent(t, events, UndeliveredMsgEvent)
+	if msg := evt.Message(); msg == nil || msg.Params[0] != "nobody" || msg.Trailing != "are you there?" {
+		t.Errorf("unexpected message for event: %v", msg)
+	}
+	if evt.User() == nil || evt.User().Nick != "foo" {
+		t.Errorf("expected event from foo; got: %v", evt)
+	}
+}
+
+func TestServerOfflineStore(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:         testServerName,
+		OfflineStore: MemoryOfflineStore(10),
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1 := NewConnMock("client1", 20)
+	go srv.Connect(NewUser(c1))
+	c1.receive <- irc.ParseMessage("NICK foo")
+	c1.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c1)
+
+	c1.receive <- irc.ParseMessage("PRIVMSG Baz :ping me when you're back")
+	expectEvent(t, events, UndeliveredMsgEvent)
+	c1.receive <- irc.ParseMessage("PRIVMSG #nowhere :hello?")
+	expectEvent(t, events, UndeliveredMsgEvent)
+	expectReply(t, c1, "^:testserver 401 #nowhere :No such nick/channel$")
+
+	c2 := NewConnMock("client2", 20)
+	go srv.Connect(NewUser(c2))
+	c2.receive <- irc.ParseMessage("NICK baz")
+	c2.receive <- irc.ParseMessage("USER root 0 * :Baz Quux")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c2)
+	expectReply(t, c2, "^:foo!root@client1 PRIVMSG baz :ping me when you're back$")
+}
+
+func TestServerSanick(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+
+	baz.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, NewChanEvent)
+	expectEvent(t, events, JoinEvent)
+	qux.receive <- irc.ParseMessage("JOIN #chat")
+	expectEvent(t, events, JoinEvent)
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+	expectReply(t, baz, "^:qux!root@quxhost JOIN #chat$")
+	receiveUntil(t, qux, irc.RPL_ENDOFNAMES)
+
+	qux.receive <- irc.ParseMessage("SANICK baz bazzy")
+	expectReply(t, qux, "^:testserver 481 qux :Permission Denied- You're not an IRC operator$")
+
+	foo.receive <- irc.ParseMessage("OPER admin wrong")
+	expectReply(t, foo, "^:testserver 464 foo :Password incorrect$")
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, foo, "^:testserver 381 foo :You are now an IRC operator$")
+	expectReply(t, foo, "^:testserver MODE foo \\+o$")
+
+	foo.receive <- irc.ParseMessage("SANICK baz qux")
+	expectReply(t, foo, "^:testserver 433 foo qux :Nickname is already in use$")
+
+	foo.receive <- irc.ParseMessage("SANICK baz bazzy")
+	expectReply(t, baz, "^:baz!root@bazhost NICK bazzy$")
+	expectReply(t, baz, "^:testserver NOTICE bazzy :Your nick was changed by foo$")
+	expectReply(t, qux, "^:baz!root@bazhost NICK bazzy$")
+
+	// Only the case of the nick can be changed too.
+	foo.receive <- irc.ParseMessage("SANICK bazzy Bazzy")
+	expectReply(t, baz, "^:bazzy!root@bazhost NICK Bazzy$")
+	expectReply(t, baz, "^:testserver NOTICE Bazzy :Your nick was changed by foo$")
+	if _, ok := srv.HasUser("bazzy"); !ok {
+		t.Error("expected baz to be renamed to bazzy")
+	}
+}
+
+func TestServerSajoin(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+
+	baz.receive <- irc.ParseMessage("SAJOIN foo #support")
+	expectReply(t, baz, "^:testserver 481 baz :Permission Denied- You're not an IRC operator$")
+
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, foo, "^:testserver 381 foo :You are now an IRC operator$")
+	expectReply(t, foo, "^:testserver MODE foo \\+o$")
+
+	foo.receive <- irc.ParseMessage("SAJOIN baz #support")
+	expectEvent(t, events, NewChanEvent)
+	expectEvent(t, events, JoinEvent)
+	expectReply(t, baz, "^:baz!root@bazhost JOIN #support$")
+	expectReply(t, baz, "^:testserver 353 baz = #support :@baz$")
+	expectReply(t, baz, "^:testserver 366 baz #support :End of /NAMES list.$")
+
+	u, _ := srv.HasUser("baz")
+	if ch, _ := srv.HasChannel("#support"); ch == nil || !ch.HasUser(u) {
+		t.Error("expected baz to be in #support")
+	}
+}
+
+func TestServerSilence(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name: testServerName,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+
+	foo.receive <- irc.ParseMessage("SILENCE +Baz")
+	expectReply(t, foo, "^:foo!root@foohost SILENCE \\+Baz!\\*@\\*$")
+	foo.receive <- irc.ParseMessage("SILENCE")
+	expectReply(t, foo, "^:testserver 271 foo foo Baz!\\*@\\*$")
+	expectReply(t, foo, "^:testserver 272 foo :End of Silence List$")
+
+	baz.receive <- irc.ParseMessage("PRIVMSG foo :can you hear me?")
+	expectEvent(t, events, UserMsgEvent)
+	qux.receive <- irc.ParseMessage("PRIVMSG foo :hello")
+	expectEvent(t, events, UserMsgEvent)
+	expectReply(t, foo, "^:qux!root@quxhost PRIVMSG foo :hello$")
+	foo.receive <- irc.ParseMessage("PRIVMSG foo :note to self")
+	expectEvent(t, events, UserMsgEvent)
+	expectReply(t, foo, "^:foo!root@foohost PRIVMSG foo :note to self$")
+
+	// Channel messages are silenced too.
+	for _, c := range []*mockConn{foo, baz} {
+		c.receive <- irc.ParseMessage("JOIN #chat")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	expectEvent(t, events, NewChanEvent)
+	expectEvent(t, events, JoinEvent)
+	expectEvent(t, events, JoinEvent)
+	expectReply(t, foo, "^:baz!root@bazhost JOIN #chat$")
+	baz.receive <- irc.ParseMessage("PRIVMSG #chat :anyone?")
+	expectEvent(t, events, ChanMsgEvent)
+
+	foo.receive <- irc.ParseMessage("SILENCE -baz!*@*")
+	expectReply(t, foo, "^:foo!root@foohost SILENCE -baz!\\*@\\*$")
+	baz.receive <- irc.ParseMessage("PRIVMSG foo :how about now?")
+	expectReply(t, foo, "^:baz!root@bazhost PRIVMSG foo :how about now\\?$")
+}
+
+func TestServerPrivMsgErrors(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	c.receive <- irc.ParseMessage("PRIVMSG")
+	expectReply(t, c, "^:testserver 411 foo :No recipient given \\(PRIVMSG\\)$")
+
+	c.receive <- irc.ParseMessage("PRIVMSG foo")
+	expectReply(t, c, "^:testserver 412 foo :No text to send$")
+	c.receive <- irc.ParseMessage("PRIVMSG foo :")
+	expectReply(t, c, "^:testserver 412 foo :No text to send$")
+
+	c.receive <- irc.ParseMessage("PRIVMSG foo hi")
+	expectEvent(t, events, UserMsgEvent)
+	expectReply(t, c, "^:foo!root@client PRIVMSG foo :hi$")
+}
+
+func TestServerMaxMsgLen(t *testing.T) {
+	for _, policy := range []MsgLenPolicy{TruncateMsg, RejectMsg} {
+		events := make(chan Event, 10)
+		srv := ServerConfig{
+			Name:         testServerName,
+			MaxMsgLen:    10,
+			MsgLenPolicy: policy,
+		}.Server()
+		srv.Subscribe(events)
+
+		c := NewConnMock("client", 20)
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK foo")
+		c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+
+		c.receive <- irc.ParseMessage("PRIVMSG foo :short")
+		expectEvent(t, events, UserMsgEvent)
+		expectReply(t, c, "^:foo!root@client PRIVMSG foo :short$")
+
+		c.receive <- irc.ParseMessage("PRIVMSG foo :this is too long")
+		switch policy {
+		case TruncateMsg:
+			expectEvent(t, events, UserMsgEvent)
+			expectReply(t, c, "^:foo!root@client PRIVMSG foo :this is...$")
+		case RejectMsg:
+			expectReply(t, c, "^:testserver 417 foo :Input line was too long$")
+		}
+		srv.Close()
+	}
+}
+
+func TestServerAway(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1 := NewConnMock("client1", 20)
+	c2 := NewConnMock("client2", 20)
+	for nick, c := range map[string]*mockConn{"foo": c1, "baz": c2} {
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+
+	c2.receive <- irc.ParseMessage("AWAY :Gone fishing")
+	expectReply(t, c2, "^:testserver 306 baz :You have been marked as being away$")
+
+	c1.receive <- irc.ParseMessage("PRIVMSG baz :hello")
+	expectEvent(t, events, UserMsgEvent)
+	expectReply(t, c1, "^:testserver 301 foo baz :Gone fishing$")
+	expectReply(t, c2, "^:foo!root@client1 PRIVMSG baz :hello$")
+
+	c2.receive <- irc.ParseMessage("AWAY")
+	expectReply(t, c2, "^:testserver 305 baz :You are no longer marked as being away$")
+}
+
+func TestServerMaxAwayLen(t *testing.T) {
+	srv := ServerConfig{
+		Name:       testServerName,
+		MaxAwayLen: 10,
+	}.Server()
+	defer srv.Close()
+
+	c1 := NewConnMock("client1", 20)
+	c2 := NewConnMock("client2", 20)
+	for nick, c := range map[string]*mockConn{"foo": c1, "baz": c2} {
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		receiveWelcome(t, c)
+	}
+
+	c2.receive <- irc.ParseMessage("AWAY :Gone fishing for the weekend")
+	expectReply(t, c2, "^:testserver 306 baz :You have been marked as being away$")
+
+	c1.receive <- irc.ParseMessage("PRIVMSG baz :hello")
+	expectReply(t, c1, "^:testserver 301 foo baz :Gone fi\\.\\.\\.$")
+}
+
+func TestServerAutoAway(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:     testServerName,
+		AutoAway: 20 * time.Millisecond,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	expectReply(t, c, "^:testserver 306 foo :You have been marked as being away$")
+	u, _ := srv.HasUser("foo")
+	if got := u.Away(); got != "Idle" {
+		t.Errorf("got away %q; want %q", got, "Idle")
+	}
+
+	c.receive <- irc.ParseMessage("PRIVMSG foo :back")
+	expectReply(t, c, "^:testserver 305 foo :You are no longer marked as being away$")
+	expectEvent(t, events, UserMsgEvent)
+	expectReply(t, c, "^:foo!root@client PRIVMSG foo :back$")
+}
+
+func TestServerAutoAwayShort(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:     testServerName,
+		AutoAway: time.Nanosecond,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+	expectReply(t, c, "^:testserver 306 foo ")
+}
+
+func TestServerPrivMsgNickAtServer(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c1 := NewConnMock("client1", 20)
+	c2 := NewConnMock("client2", 20)
+	for nick, c := range map[string]*mockConn{"foo": c1, "baz": c2} {
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+
+	c1.receive <- irc.ParseMessage("PRIVMSG baz@testserver :hello")
+	expectEvent(t, events, UserMsgEvent)
+	expectReply(t, c2, "^:foo!root@client1 PRIVMSG baz :hello$")
+
+	c1.receive <- irc.ParseMessage("PRIVMSG baz@elsewhere :hello")
+	expectReply(t, c1, "^:testserver 401 foo baz@elsewhere :No such nick/channel$")
+}
+
+func TestServerDie(t *testing.T) {
+	events := make(chan Event, 10)
+	shutdowns := make(chan bool, 1)
+	srv := ServerConfig{
+		Name:       testServerName,
+		Opers:      map[string]string{"admin": "hunter2"},
+		OnShutdown: func(restart bool) { shutdowns <- restart },
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	c.receive <- irc.ParseMessage("DIE")
+	expectReply(t, c, "^:testserver 481 foo :Permission Denied- You're not an IRC operator$")
+
+	c.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, c, "^:testserver 381 foo ")
+	receiveReply(t, c)
+
+	for cmd, restart := range map[string]bool{"DIE": false, "RESTART": true} {
+		c.receive <- irc.ParseMessage(cmd)
+		select {
+		case got := <-shutdowns:
+			if got != restart {
+				t.Errorf("%s: got restart %v; want %v", cmd, got, restart)
+			}
+		case <-time.After(expectTimeout):
+			t.Fatalf("%s: timed out waiting for shutdown", cmd)
+		}
+	}
+}
+
+func TestServerDieDisabled(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	c.receive <- irc.ParseMessage("DIE")
+	expectReply(t, c, "^:testserver 421 foo DIE :Unknown command$")
+}
+
+func TestServerRehash(t *testing.T) {
+	events := make(chan Event, 10)
+	rehashErr := errors.New("bad config")
+	rehashes := 0
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+		OnRehash: func() error {
+			rehashes++
+			if rehashes > 1 {
+				return rehashErr
+			}
+			return nil
+		},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	c.receive <- irc.ParseMessage("REHASH")
+	expectReply(t, c, "^:testserver 481 foo :Permission Denied- You're not an IRC operator$")
+
+	c.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, c, "^:testserver 381 foo ")
+	receiveReply(t, c)
+
+	c.receive <- irc.ParseMessage("REHASH")
+	expectReply(t, c, "^:testserver 382 foo testserver :Rehashing$")
+	c.receive <- irc.ParseMessage("REHASH")
+	expectReply(t, c, "^:testserver 400 foo REHASH :Rehash failed: bad config$")
+
+	if rehashes != 2 {
+		t.Errorf("got %d rehashes; want 2", rehashes)
+	}
+}
+
+func TestServerBan(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	srv.Ban("*@BadHost", "Spamming")
+
+	c := NewConnMock("badhost", 20)
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Connect(NewUser(c)) }()
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectReply(t, c, "^:testserver ERROR :You are banned \\(Spamming\\)$")
+	if err := <-errs; !errors.Is(err, ErrBanned) {
+		t.Errorf("got %v; want %v", err, ErrBanned)
+	}
+	if _, exists := srv.HasUser("foo"); exists {
+		t.Error("expected banned user to be refused")
+	}
+
+	if !srv.Unban("*!*@badhost") {
+		t.Error("expected ban to exist")
+	}
+	c = NewConnMock("badhost", 20)
+	go func() { errs <- srv.Connect(NewUser(c)) }()
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	if err := <-errs; err != nil {
+		t.Errorf("got %v; want nil", err)
+	}
+}
+
+func TestServerCIDRs(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	_, denied, _ := net.ParseCIDR("10.1.0.0/16")
+	srv := ServerConfig{
+		Name:       testServerName,
+		AllowCIDRs: []*net.IPNet{allowed},
+		DenyCIDRs:  []*net.IPNet{denied},
+	}.Server()
+	defer srv.Close()
+
+	for _, host := range []string{"10.1.2.3", "192.168.0.1"} {
+		c := NewConnMock(host, 20)
+		errs := make(chan error, 1)
+		go func() { errs <- srv.Connect(NewUser(c)) }()
+		expectReply(t, c, "^:testserver ERROR :Closing link: "+host+" \\(Connection refused\\)$")
+		if err := <-errs; !errors.Is(err, ErrRefused) {
+			t.Errorf("got %v; want %v", err, ErrRefused)
+		}
+	}
+
+	c := NewConnMock("10.2.3.4", 20)
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Connect(NewUser(c)) }()
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	if err := <-errs; err != nil {
+		t.Errorf("got %v; want nil", err)
+	}
+	expectReply(t, c, "^:testserver 001 foo ")
+}
+
+// addrMockConn is a mockConn with a remote address, which records whether its
+// host was resolved.
+type addrMockConn struct {
+	*mockConn
+	addr     net.Addr
+	resolved bool
+}
+
+func (c *addrMockConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *addrMockConn) ResolveHost() string {
+	c.resolved = true
+	return c.mockConn.ResolveHost()
+}
+
+func TestServerCIDRsBeforeResolve(t *testing.T) {
+	_, denied, _ := net.ParseCIDR("10.1.0.0/16")
+	srv := ServerConfig{
+		Name:      testServerName,
+		DenyCIDRs: []*net.IPNet{denied},
+	}.Server()
+	defer srv.Close()
+
+	c := &addrMockConn{
+		mockConn: NewConnMock("denied.example.com", 20),
+		addr:     &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 6667},
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Connect(NewUser(c)) }()
+	expectReply(t, c.mockConn, "^:testserver ERROR :Closing link: 10.1.2.3 \\(Connection refused\\)$")
+	if err := <-errs; !errors.Is(err, ErrRefused) {
+		t.Errorf("got %v; want %v", err, ErrRefused)
+	}
+	if c.resolved {
+		t.Error("expected the host of a refused connection not to be resolved")
+	}
+}
+
+func TestServerKline(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+
+	baz.receive <- irc.ParseMessage("KLINE *@foohost")
+	expectReply(t, baz, "^:testserver 481 baz ")
+
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, foo, "^:testserver 381 foo ")
+	receiveReply(t, foo)
+
+	foo.receive <- irc.ParseMessage("KLINE *@bazhost :Go away")
+	expectReply(t, baz, "^:testserver ERROR :You are banned \\(Go away\\)$")
+	expectReply(t, foo, "^:testserver NOTICE foo :Added K-Line for \\*!\\*@bazhost$")
+	if _, exists := srv.HasUser("baz"); exists {
+		t.Error("expected baz to be disconnected")
+	}
+
+	foo.receive <- irc.ParseMessage("UNKLINE *@bazhost")
+	expectReply(t, foo, "^:testserver NOTICE foo :Removed K-Line for \\*!\\*@bazhost$")
+	foo.receive <- irc.ParseMessage("UNKLINE *@bazhost")
+	expectReply(t, foo, "^:testserver NOTICE foo :No K-Line for \\*!\\*@bazhost$")
+}
+
+func TestServerSecretChannels(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+
+	for _, name := range []string{"#public", "#private", "#secret"} {
+		foo.receive <- irc.ParseMessage("JOIN " + name)
+		receiveUntil(t, foo, irc.RPL_ENDOFNAMES)
+	}
+	foo.receive <- irc.ParseMessage("MODE #private +p")
+	expectReply(t, foo, "^:foo!root@foohost MODE #private \\+p$")
+	foo.receive <- irc.ParseMessage("MODE #secret +sx")
+	expectReply(t, foo, "^:foo!root@foohost MODE #secret \\+s$")
+	expectReply(t, foo, "^:testserver 472 foo x :is unknown mode char to me for #secret$")
+	foo.receive <- irc.ParseMessage("MODE #secret")
+	expectReply(t, foo, "^:testserver 324 foo #secret \\+s$")
+
+	baz.receive <- irc.ParseMessage("LIST")
+	expectReply(t, baz, "^:testserver 322 baz Prv 1 :$")
+	expectReply(t, baz, "^:testserver 322 baz #public 1 :$")
+	expectReply(t, baz, "^:testserver 323 baz :End of /LIST$")
+
+	baz.receive <- irc.ParseMessage("NAMES #secret")
+	expectReply(t, baz, "^:testserver 366 baz #secret :End of /NAMES list.$")
+	baz.receive <- irc.ParseMessage("MODE #secret")
+	expectReply(t, baz, "^:testserver 403 baz #secret :No such channel$")
+	baz.receive <- irc.ParseMessage("TOPIC #secret")
+	expectReply(t, baz, "^:testserver 403 baz #secret :No such channel$")
+	baz.receive <- irc.ParseMessage("KICK #secret foo")
+	expectReply(t, baz, "^:testserver 403 baz #secret :No such channel$")
+	baz.receive <- irc.ParseMessage("INVITE foo #secret")
+	expectReply(t, baz, "^:testserver 403 baz #secret :No such channel$")
+	baz.receive <- irc.ParseMessage("PART #secret")
+	expectReply(t, baz, "^:testserver 403 #secret :No such channel$")
+
+	foo.receive <- irc.ParseMessage("LIST")
+	expectReply(t, foo, "^:testserver 322 foo #private 1 :$")
+	expectReply(t, foo, "^:testserver 322 foo #public 1 :$")
+	expectReply(t, foo, "^:testserver 322 foo #secret 1 :$")
+	expectReply(t, foo, "^:testserver 323 foo :End of /LIST$")
+
+	foo.receive <- irc.ParseMessage("NAMES #secret")
+	expectReply(t, foo, "^:testserver 353 foo @ #secret :@foo$")
+}
+
+func TestServerNickVisibility(t *testing.T) {
+	for _, notify := range []bool{false, true} {
+		events := make(chan Event, 10)
+		srv := ServerConfig{
+			Name:                 testServerName,
+			NotifyCorrespondents: notify,
+		}.Server()
+		srv.Subscribe(events)
+
+		conns := map[string]*mockConn{}
+		for _, nick := range []string{"foo", "baz", "qux"} {
+			c := NewConnMock(nick+"host", 20)
+			conns[nick] = c
+			go srv.Connect(NewUser(c))
+			c.receive <- irc.ParseMessage("NICK " + nick)
+			c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+			expectEvent(t, events, ConnectEvent)
+			receiveWelcome(t, c)
+		}
+		foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+
+		// foo shares a channel with baz, and only exchanged messages with qux.
+		for _, c := range []*mockConn{foo, baz} {
+			c.receive <- irc.ParseMessage("JOIN #chat")
+			receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+		}
+		receiveReply(t, foo) // baz JOIN
+		qux.receive <- irc.ParseMessage("PRIVMSG foo :hi")
+		expectReply(t, foo, "^:qux!root@quxhost PRIVMSG foo :hi$")
+
+		u, _ := srv.HasUser("foo")
+		visible := u.VisibleTo()
+		if len(visible) != 1 || visible[0].Nick != "baz" {
+			t.Errorf("expected foo to be visible to baz only; got %v", visible)
+		}
+		if other, _ := srv.HasUser("qux"); len(other.VisibleTo()) != 0 {
+			t.Errorf("expected qux to be visible to nobody; got %v", other.VisibleTo())
+		}
+
+		foo.receive <- irc.ParseMessage("NICK foo_")
+		expectReply(t, foo, "^:foo!root@foohost NICK foo_$")
+		expectReply(t, baz, "^:foo!root@foohost NICK foo_$")
+
+		// Use a message from baz as a marker for whether qux was notified.
+		baz.receive <- irc.ParseMessage("PRIVMSG qux :marker")
+		if notify {
+			expectReply(t, qux, "^:foo!root@foohost NICK foo_$")
+		}
+		expectReply(t, qux, "^:baz!root@bazhost PRIVMSG qux :marker$")
+		srv.Close()
+	}
+}
+
+func TestServerName(t *testing.T) {
+	tests := map[string]string{
+		"":                 "go-irckit",
+		"  ":               "go-irckit",
+		" irc.example.com": "irc.example.com",
+		"irc_1.example":    "irc_1.example",
+		"foo!bar":          "go-irckit",
+		"two words":        "go-irckit",
+		":colon":           "go-irckit",
+		".dot":             "go-irckit",
+	}
+	for name, want := range tests {
+		srv := ServerConfig{Name: name}.Server()
+		if got := srv.Name(); got != want {
+			t.Errorf("Name %q: got %q; want %q", name, got, want)
+		}
+		if got := srv.Prefix().String(); got != want {
+			t.Errorf("Name %q: got prefix %q; want %q", name, got, want)
+		}
+		srv.Close()
+	}
+
+	if err := ValidateServerName(strings.Repeat("a", 64)); err == nil {
+		t.Error("expected an overlong name to be invalid")
+	}
+}
+
+func TestServerConcurrentRegistration(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	conns := []*mockConn{NewConnMock("client1", 20), NewConnMock("client2", 20)}
+	for _, c := range conns {
+		c := c
+		go srv.Connect(NewUser(c))
+		go func() {
+			c.receive <- irc.ParseMessage("NICK foo")
+			c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+		}()
+	}
+
+	var loser *mockConn
+	winners := 0
+	for _, c := range conns {
+		switch msg := receiveReply(t, c); msg.Command {
+		case irc.RPL_WELCOME:
+			winners++
+		case irc.ERR_NICKNAMEINUSE:
+			expectParams := []string{"*", "foo"}
+			if len(msg.Params) != 2 || msg.Params[0] != expectParams[0] || msg.Params[1] != expectParams[1] {
+				t.Errorf("got params %q; want %q", msg.Params, expectParams)
+			}
+			loser = c
+		default:
+			t.Fatalf("unexpected reply: %s", msg)
+		}
+	}
+	if winners != 1 || loser == nil {
+		t.Fatalf("expected exactly one registration to succeed; got %d", winners)
+	}
+
+	loser.receive <- irc.ParseMessage("NICK foo_")
+	expectReply(t, loser, "^:testserver 001 foo_ ")
+	for _, nick := range []string{"foo", "foo_"} {
+		if _, exists := srv.HasUser(nick); !exists {
+			t.Errorf("expected %s to be registered", nick)
+		}
+	}
+}
+
+func TestServerDecodeError(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+	for _, c := range []*mockConn{foo, baz} {
+		c.receive <- irc.ParseMessage("JOIN #chat")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	expectReply(t, foo, "^:baz!root@bazhost JOIN #chat$")
+
+	close(baz.receive)
+	expectReply(t, baz, "^:testserver ERROR :Closing link$")
+	expectReply(t, foo, "^:baz!root@bazhost QUIT :Connection closed$")
+
+	ch, _ := srv.HasChannel("#chat")
+	if names := ch.Names(); len(names) != 1 || names[0] != "foo" {
+		t.Errorf("expected only foo in #chat; got %v", names)
+	}
+	if _, exists := srv.HasUser("baz"); exists {
+		t.Error("expected baz to be gone")
+	}
+}
+
+func TestServerQuitReason(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+	for _, c := range []*mockConn{foo, baz, qux} {
+		c.receive <- irc.ParseMessage("JOIN #chat")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, baz, irc.JOIN)
+
+	baz.receive <- irc.ParseMessage("QUIT :Gone fishing")
+	expectReply(t, baz, "^:baz!root@bazhost QUIT :Gone fishing$")
+	expectReply(t, foo, "^:baz!root@bazhost QUIT :Gone fishing$")
+	if _, exists := srv.HasUser("baz"); exists {
+		t.Error("expected baz to be gone")
+	}
+
+	qux.receive <- irc.ParseMessage("QUIT")
+	expectReply(t, foo, "^:qux!root@quxhost QUIT :Client Quit$")
+}
+
+func TestServerPingTimeout(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:         testServerName,
+		PingInterval: 20 * time.Millisecond,
+		PingTimeout:  100 * time.Millisecond,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	// Replying keeps the connection alive.
+	expectReply(t, c, "^:testserver PING :testserver$")
+	c.receive <- irc.ParseMessage("PONG :testserver")
+	expectReply(t, c, "^:testserver PING :testserver$")
+
+	expectReply(t, c, "^:testserver ERROR :Ping timeout$")
+	if _, exists := srv.HasUser("foo"); exists {
+		t.Error("expected foo to be disconnected")
+	}
+}
+
+func TestServerPong(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:         testServerName,
+		PingInterval: 20 * time.Millisecond,
+		PingTimeout:  100 * time.Millisecond,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Foo Bar")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+	u, _ := srv.HasUser("foo")
+
+	// Answering each PING keeps the connection alive past the timeout.
+	start := time.Now()
+	for time.Since(start) < 200*time.Millisecond {
+		expectReply(t, c, "^:testserver PING :testserver$")
+		time.Sleep(5 * time.Millisecond)
+		c.receive <- irc.ParseMessage("PONG testserver")
+	}
+	c.receive <- irc.ParseMessage("PING :sync")
+	receiveUntil(t, c, irc.PONG)
+
+	if _, exists := srv.HasUser("foo"); !exists {
+		t.Fatal("expected foo to stay connected")
+	}
+	if lag := u.Lag(); lag < 5*time.Millisecond || lag > 100*time.Millisecond {
+		t.Errorf("got lag %v; want about 5ms", lag)
+	}
+}
+
+func TestServerChannelForward(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+
+	foo.receive <- irc.ParseMessage("JOIN #full")
+	receiveUntil(t, foo, irc.RPL_ENDOFNAMES)
+	foo.receive <- irc.ParseMessage("MODE #full +lf 1 #overflow")
+	expectReply(t, foo, "^:foo!root@foohost MODE #full \\+lf 1 #overflow$")
+	foo.receive <- irc.ParseMessage("MODE #full")
+	expectReply(t, foo, "^:testserver 324 foo #full \\+fl #overflow 1$")
+
+	baz.receive <- irc.ParseMessage("JOIN #full")
+	expectReply(t, baz, "^:testserver 470 baz #full #overflow :Forwarding to another channel$")
+	expectReply(t, baz, "^:baz!root@bazhost JOIN #overflow$")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+
+	u, _ := srv.HasUser("baz")
+	if ch, _ := srv.HasChannel("#full"); ch.HasUser(u) {
+		t.Error("expected baz not to be in #full")
+	}
+
+	// Forwards which loop back to full channels are only followed so far.
+	baz.receive <- irc.ParseMessage("MODE #overflow +lf 1 #full")
+	expectReply(t, baz, "^:baz!root@bazhost MODE #overflow \\+lf 1 #full$")
+	foo.receive <- irc.ParseMessage("PART #full")
+	receiveReply(t, foo)
+	qux := NewConnMock("quxhost", 20)
+	go srv.Connect(NewUser(qux))
+	qux.receive <- irc.ParseMessage("NICK qux")
+	qux.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+	receiveWelcome(t, qux)
+	baz.receive <- irc.ParseMessage("JOIN #full")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+	qux.receive <- irc.ParseMessage("JOIN #full")
+	expectReply(t, qux, "^:testserver 470 qux #full #overflow ")
+	expectReply(t, qux, "^:testserver 470 qux #overflow #full ")
+	expectReply(t, qux, "^:testserver 470 qux #full #overflow ")
+	expectReply(t, qux, "^:testserver 471 qux #overflow :Cannot join channel \\(\\+l\\)$")
+}
+
+func TestServerRelayMsg(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+
+	baz.receive <- irc.ParseMessage("CAP REQ :draft/relaymsg")
+	expectReply(t, baz, "^:testserver CAP baz ACK :draft/relaymsg$")
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		conns[nick].receive <- irc.ParseMessage("JOIN #bridge")
+		receiveUntil(t, conns[nick], irc.RPL_ENDOFNAMES)
+	}
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, baz, irc.JOIN)
+
+	baz.receive <- irc.ParseMessage("RELAYMSG #bridge alice/discord :hi")
+	expectReply(t, baz, "^:testserver 481 baz ")
+
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, foo, "^:testserver 381 foo ")
+	receiveReply(t, foo)
+
+	foo.receive <- irc.ParseMessage("RELAYMSG #bridge alice :hi")
+	expectReply(t, foo, "^:testserver 432 foo alice ")
+	foo.receive <- irc.ParseMessage("RELAYMSG #bridge al!ce/discord :hi")
+	expectReply(t, foo, "^:testserver 432 foo al!ce/discord ")
+	foo.receive <- irc.ParseMessage("RELAYMSG #elsewhere alice/discord :hi")
+	expectReply(t, foo, "^:testserver 442 foo #elsewhere ")
+
+	foo.receive <- irc.ParseMessage("RELAYMSG #bridge alice/discord :hello from discord")
+	expectReply(t, baz, "^@draft/relaymsg=foo :alice/discord!relay@testserver PRIVMSG #bridge :hello from discord$")
+	expectReply(t, qux, "^:alice/discord!relay@testserver PRIVMSG #bridge :hello from discord$")
+}
+
+func TestServerUTF8Only(t *testing.T) {
+	for _, utf8Only := range []bool{false, true} {
+		events := make(chan Event, 20)
+		srv := ServerConfig{Name: testServerName, UTF8Only: utf8Only}.Server()
+		srv.Subscribe(events)
+
+		conns := map[string]*mockConn{}
+		for _, nick := range []string{"foo", "baz"} {
+			c := NewConnMock(nick+"host", 20)
+			conns[nick] = c
+			go srv.Connect(NewUser(c))
+			c.receive <- irc.ParseMessage("NICK " + nick)
+			c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+			expectEvent(t, events, ConnectEvent)
+			receiveUntil(t, c, irc.RPL_MYINFO)
+			msg := receiveReply(t, c)
+			if advertised := strings.Contains(msg.String(), " UTF8ONLY "); advertised != utf8Only {
+				t.Errorf("UTF8Only=%v: got ISUPPORT %q", utf8Only, msg)
+			}
+			receiveUntil(t, c, irc.RPL_ENDOFMOTD)
+		}
+		foo, baz := conns["foo"], conns["baz"]
+
+		foo.receive <- irc.ParseMessage("PRIVMSG baz :caf\xe9")
+		if utf8Only {
+			expectReply(t, foo, "^:testserver 400 foo PRIVMSG :Message rejected")
+			foo.receive <- irc.ParseMessage("NICK f\xf6o")
+			expectReply(t, foo, "^:testserver 400 foo NICK :Message rejected")
+			foo.receive <- irc.ParseMessage("PRIVMSG baz :café")
+			expectReply(t, baz, "^:foo!root@foohost PRIVMSG baz :café$")
+		} else {
+			if msg := receiveReply(t, baz); msg.Trailing != "caf\xe9" {
+				t.Errorf("got %q, want the text passed through", msg)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestServerUserIP(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+		CloakHost: func(host string) string {
+			return "cloaked"
+		},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for i, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(fmt.Sprintf("10.0.0.%d", i+1), 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo := conns["foo"]
+
+	foo.receive <- irc.ParseMessage("USERIP baz")
+	expectReply(t, foo, "^:testserver 481 foo ")
+
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, foo, "^:testserver 381 foo ")
+	receiveReply(t, foo)
+
+	foo.receive <- irc.ParseMessage("USERIP baz nobody foo")
+	expectReply(t, foo, "^:testserver 340 foo :baz=\\+root@10\\.0\\.0\\.2 foo\\*=\\+root@10\\.0\\.0\\.1$")
+}
+
+// secureMockConn is a mockConn which claims to be encrypted.
+type secureMockConn struct {
+	*mockConn
+}
+
+func (c secureMockConn) Secure() bool { return true }
+
+func TestServerWhois(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	foo := NewConnMock("foohost", 20)
+	go srv.Connect(NewUser(secureMockConn{foo}))
+	baz := NewConnMock("bazhost", 20)
+	go srv.Connect(NewUser(baz))
+	for nick, c := range map[string]*mockConn{"foo": foo, "baz": baz} {
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+
+	baz.receive <- irc.ParseMessage("WHOIS foo")
+	expectReply(t, baz, "^:testserver 311 baz foo root foohost \\* :Real Name$")
+	expectReply(t, baz, "^:testserver 312 baz foo testserver ")
+	expectReply(t, baz, "^:testserver 671 baz foo :is using a secure connection$")
+	u, _ := srv.HasUser("foo")
+	signon := strconv.FormatInt(u.signon.Unix(), 10)
+	expectReply(t, baz, "^:testserver 317 baz foo 0 "+signon+" :seconds idle, signon time$")
+	expectReply(t, baz, "^:testserver 318 baz foo :End of /WHOIS list$")
+
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, foo, "^:testserver 381 foo ")
+	receiveReply(t, foo)
+
+	baz.receive <- irc.ParseMessage("WHOIS foo")
+	expectReply(t, baz, "^:testserver 311 baz foo ")
+	expectReply(t, baz, "^:testserver 312 baz foo ")
+	expectReply(t, baz, "^:testserver 313 baz foo :is an IRC operator$")
+	expectReply(t, baz, "^:testserver 671 baz foo ")
+	expectReply(t, baz, "^:testserver 317 baz foo ")
+	expectReply(t, baz, "^:testserver 318 baz foo ")
+
+	foo.receive <- irc.ParseMessage("WHOIS baz,nobody")
+	expectReply(t, foo, "^:testserver 311 foo baz root bazhost ")
+	expectReply(t, foo, "^:testserver 312 foo baz ")
+	expectReply(t, foo, "^:testserver 378 foo baz :is connecting from \\*@bazhost bazhost$")
+	expectReply(t, foo, "^:testserver 317 foo baz ")
+	expectReply(t, foo, "^:testserver 401 foo nobody ")
+	expectReply(t, foo, "^:testserver 318 foo baz,nobody ")
+}
+
+func TestServerNamesJoinMatch(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+
+	foo.receive <- irc.ParseMessage("JOIN #chat")
+	receiveUntil(t, foo, irc.RPL_ENDOFNAMES)
+	baz.receive <- irc.ParseMessage("JOIN #chat")
+	joined := receiveUntil(t, baz, irc.RPL_NAMREPLY)
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+
+	baz.receive <- irc.ParseMessage("NAMES #chat")
+	names := receiveUntil(t, baz, irc.RPL_NAMREPLY)
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+
+	if joined.Trailing != "@foo baz" {
+		t.Errorf("got JOIN names %q; want %q", joined.Trailing, "@foo baz")
+	}
+	if names.Trailing != joined.Trailing || strings.Join(names.Params, " ") != strings.Join(joined.Params, " ") {
+		t.Errorf("NAMES reply %q differs from JOIN reply %q", names, joined)
+	}
+}
+
+func TestServerNamesMultiple(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("foohost", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+	for _, name := range []string{"#foo", "#bar"} {
+		c.receive <- irc.ParseMessage("JOIN " + name)
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+
+	c.receive <- irc.ParseMessage("NAMES #foo,#nope,#bar")
+	expectReply(t, c, "^:testserver 353 foo = #foo :@foo$")
+	expectReply(t, c, "^:testserver 366 foo #foo :End of /NAMES list.$")
+	expectReply(t, c, "^:testserver 366 foo #nope :End of /NAMES list.$")
+	expectReply(t, c, "^:testserver 353 foo = #bar :@foo$")
+	expectReply(t, c, "^:testserver 366 foo #bar :End of /NAMES list.$")
+
+	// The second parameter names a server, not more channels.
+	c.receive <- irc.ParseMessage("NAMES #foo testserver")
+	expectReply(t, c, "^:testserver 353 foo = #foo :@foo$")
+	expectReply(t, c, "^:testserver 366 foo #foo :End of /NAMES list.$")
+	c.receive <- irc.ParseMessage("NAMES #foo #bar")
+	expectReply(t, c, "^:testserver 402 foo #bar :No such server$")
+}
+
+func TestServerPartAll(t *testing.T) {
+	for _, partAll := range []bool{false, true} {
+		events := make(chan Event, 10)
+		srv := ServerConfig{
+			Name:    testServerName,
+			PartAll: partAll,
+		}.Server()
+		srv.Subscribe(events)
+
+		c := NewConnMock("client", 20)
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK foo")
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+
+		c.receive <- irc.ParseMessage("JOIN #a,#b,#c")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+
+		c.receive <- irc.ParseMessage("PART :bye")
+		if !partAll {
+			expectReply(t, c, "^:testserver 461 PART$")
+			c.receive <- irc.ParseMessage("PART #a,#c")
+			expectReply(t, c, "^:foo!root@client PART #a$")
+			expectReply(t, c, "^:foo!root@client PART #c$")
+		} else {
+			expectReply(t, c, "^:foo!root@client PART #a :bye$")
+			expectReply(t, c, "^:foo!root@client PART #b :bye$")
+			expectReply(t, c, "^:foo!root@client PART #c :bye$")
+		}
+		srv.Close()
+	}
+}
+
+func TestServerNickChangeLimit(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:             testServerName,
+		MaxNickChanges:   2,
+		NickChangeWindow: 100 * time.Millisecond,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	c.receive <- irc.ParseMessage("NICK foo1")
+	expectReply(t, c, "^:foo!root@client NICK foo1$")
+	c.receive <- irc.ParseMessage("NICK foo2")
+	expectReply(t, c, "^:foo1!root@client NICK foo2$")
+	c.receive <- irc.ParseMessage("NICK foo3")
+	expectReply(t, c, "^:testserver 438 foo2 foo3 :Nick change too fast. Please wait 1 seconds.$")
+
+	if _, ok := srv.HasUser("foo3"); ok {
+		t.Error("throttled nick change was applied")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	c.receive <- irc.ParseMessage("NICK foo3")
+	expectReply(t, c, "^:foo2!root@client NICK foo3$")
+}
+
+func TestServerNetworkName(t *testing.T) {
+	for _, tc := range []struct {
+		config  ServerConfig
+		welcome string
+		network string
+	}{
+		{ServerConfig{Name: testServerName}, "Welcome!", "testserver"},
+		{ServerConfig{Name: testServerName, NetworkName: "ExampleNet"}, "Welcome to the ExampleNet IRC Network", "ExampleNet"},
+		{ServerConfig{Name: testServerName, NetworkName: "ExampleNet", WelcomeMessage: "Hi"}, "Hi", "ExampleNet"},
+		{ServerConfig{Name: testServerName, NetworkName: "Example Net"}, "Welcome!", "testserver"},
+	} {
+		events := make(chan Event, 10)
+		srv := tc.config.Server()
+		srv.Subscribe(events)
+
+		c := NewConnMock("client", 20)
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK foo")
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		expectReply(t, c, "^:testserver 001 foo :"+tc.welcome+" foo!root@client$")
+		receiveReply(t, c) // RPL_YOURHOST
+		receiveReply(t, c) // RPL_CREATED
+		receiveReply(t, c) // RPL_MYINFO
+		expectReply(t, c, "^:testserver 005 foo .*NETWORK="+tc.network+" .*:are supported by this server$")
+		srv.Close()
+	}
+}
+
+func TestServerLookupChannel(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	c.receive <- irc.ParseMessage("WHO #nope")
+	expectReply(t, c, "^:testserver 315 foo #nope :End of /WHO list.$")
+
+	if ch := srv.(ChannelFinder).LookupChannel("#nope"); ch != nil {
+		t.Errorf("got %v; want nil", ch)
+	}
+	if _, ok := srv.HasChannel("#nope"); ok {
+		t.Error("WHO created a channel")
+	}
+	select {
+	case evt := <-events:
+		t.Errorf("unexpected event: %v", evt)
+	default:
+	}
+
+	ch := srv.Channel("#chat")
+	expectEvent(t, events, NewChanEvent)
+	if got := srv.(ChannelFinder).LookupChannel("#CHAT"); got != ch {
+		t.Errorf("got %v; want %v", got, ch)
+	}
+}
+
+func TestServerNoImplicitChannels(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+
+	for _, tc := range []struct {
+		line  string
+		reply string
+	}{
+		{"NAMES #nope", "^:testserver 366 foo #nope :End of /NAMES list.$"},
+		{"WHO #nope", "^:testserver 315 foo #nope :End of /WHO list.$"},
+		{"PRIVMSG #nope :hi", "^:testserver 401 #nope :No such nick/channel$"},
+		{"TOPIC #nope", "^:testserver 403 foo #nope :No such channel$"},
+		{"MODE #nope", "^:testserver 403 foo #nope "},
+		{"KICK #nope foo", "^:testserver 403 foo #nope "},
+		{"PART #nope", "^:testserver 403 #nope :No such channel$"},
+	} {
+		c.receive <- irc.ParseMessage(tc.line)
+		expectReply(t, c, tc.reply)
+		if _, ok := srv.HasChannel("#nope"); ok {
+			t.Fatalf("%q created a channel", tc.line)
+		}
+	}
+	for {
+		select {
+		case evt := <-events:
+			if evt.Kind() == NewChanEvent {
+				t.Errorf("unexpected event: %v", evt)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestServerCheck(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+		CloakHost: func(host string) string {
+			return "cloaked"
+		},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for i, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(fmt.Sprintf("10.0.0.%d", i+1), 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+
+	for _, c := range []*mockConn{qux, baz} {
+		c.receive <- irc.ParseMessage("JOIN #secret")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	qux.receive <- irc.ParseMessage("MODE #secret +s")
+	receiveUntil(t, qux, irc.MODE)
+
+	foo.receive <- irc.ParseMessage("CHECK #secret")
+	expectReply(t, foo, "^:testserver 481 foo ")
+
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, foo, "^:testserver 381 foo ")
+	receiveReply(t, foo)
+
+	foo.receive <- irc.ParseMessage("CHECK #secret")
+	expectReply(t, foo, "^:testserver NOTICE foo :baz!root@cloaked 10\\.0\\.0\\.2 10\\.0\\.0\\.2 idle \\d+$")
+	expectReply(t, foo, "^:testserver NOTICE foo :qux!root@cloaked 10\\.0\\.0\\.3 10\\.0\\.0\\.3 idle \\d+$")
+	expectReply(t, foo, "^:testserver NOTICE foo :End of CHECK #secret$")
+
+	foo.receive <- irc.ParseMessage("CHECK #nope")
+	expectReply(t, foo, "^:testserver 403 foo #nope ")
+}
+
+// lockedBuffer is a bytes.Buffer which is safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServerRawLog(t *testing.T) {
+	raw := &lockedBuffer{}
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:      testServerName,
+		LogPrefix: "[test] ",
+		RawLog:    raw,
+	}.Server()
+	srv.Subscribe(events)
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+	c.receive <- irc.ParseMessage("PING :hi")
+	receiveUntil(t, c, irc.PONG)
+	srv.Close()
+
+	for _, line := range []string{
+		"[test] client <- NICK foo\n",
+		"[test] foo -> :testserver 001 foo :Welcome! foo!root@client\n",
+		"[test] foo <- PING :hi\n",
+		"[test] foo -> :testserver PONG testserver :hi\n",
+	} {
+		if !strings.Contains(raw.String(), line) {
+			t.Errorf("raw log is missing %q:\n%s", line, raw.String())
+		}
+	}
+}
+
+func TestServerAccessLog(t *testing.T) {
+	entries := make(chan AccessLogEntry, 20)
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:      testServerName,
+		Opers:     map[string]string{"admin": "hunter2"},
+		AccessLog: func(e AccessLogEntry) { entries <- e },
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("client", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("PASS secret")
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+	c.receive <- irc.ParseMessage("OPER admin hunter2")
+	receiveUntil(t, c, irc.MODE)
+	c.receive <- irc.ParseMessage("JOIN #chat")
+	receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+
+	for _, want := range []struct {
+		command  string
+		params   string
+		redacted bool
+	}{
+		{irc.PASS, "", true},
+		{irc.NICK, "foo", false},
+		{irc.USER, "root 0 * Real Name", false},
+		{irc.OPER, "", true},
+		{irc.JOIN, "#chat", false},
+	} {
+		e := <-entries
+		if e.Command != want.command || strings.Join(e.Params, " ") != want.params || e.Redacted != want.redacted {
+			t.Errorf("got %s %q (redacted %v); want %s %q (redacted %v)", e.Command, e.Params, e.Redacted, want.command, want.params, want.redacted)
+		}
+		if e.User == nil || e.Time.IsZero() {
+			t.Errorf("expected %s entry to have a User and Time", e.Command)
+		}
+	}
+}
+
+func TestServerInvite(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+
+	foo.receive <- irc.ParseMessage("JOIN #chat")
+	receiveUntil(t, foo, irc.RPL_ENDOFNAMES)
+	expectEvent(t, events, NewChanEvent)
+	expectEvent(t, events, JoinEvent)
+
+	baz.receive <- irc.ParseMessage("INVITE foo #chat")
+	expectReply(t, baz, "^:testserver 442 baz #chat ")
+
+	foo.receive <- irc.ParseMessage("INVITE baz #chat")
+	expectReply(t, foo, "^:testserver 341 foo baz #chat$")
+	expectReply(t, baz, "^:foo!root@foohost INVITE baz #chat$")
+
+	evt := expectEvent(t, events, InviteEvent)
+	if u, _ := srv.HasUser("foo"); evt.User() != u {
+		t.Errorf("got inviter %v; want foo", evt.User())
+	}
+	if evt.Channel() == nil || evt.Channel().ID() != "#chat" {
+		t.Errorf("got channel %v; want #chat", evt.Channel())
+	}
+	if msg := evt.Message(); msg == nil || msg.Params[0] != "baz" {
+		t.Errorf("got message %v; want INVITE baz #chat", msg)
+	}
+	if u, _ := srv.HasUser("baz"); evt.(TargetEvent).Target() != u {
+		t.Errorf("got target %v; want baz", evt.(TargetEvent).Target())
+	}
+
+	foo.receive <- irc.ParseMessage("INVITE foo #chat")
+	expectReply(t, foo, "^:testserver 443 foo foo #chat ")
+}
+
+func TestServerOperOverride(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:         testServerName,
+		Opers:        map[string]string{"admin": "hunter2"},
+		OperOverride: true,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+
+	foo.receive <- irc.ParseMessage("JOIN #locked")
+	receiveUntil(t, foo, irc.RPL_ENDOFNAMES)
+	foo.receive <- irc.ParseMessage("MODE #locked +k sesame")
+	expectReply(t, foo, "^:foo!root@foohost MODE #locked \\+k sesame$")
+
+	qux.receive <- irc.ParseMessage("MODE #locked")
+	expectReply(t, qux, "^:testserver 324 qux #locked \\+k \\*$")
+
+	// Non-operators need the key.
+	qux.receive <- irc.ParseMessage("JOIN #locked")
+	expectReply(t, qux, "^:testserver 475 qux #locked :Cannot join channel \\(\\+k\\)$")
+	qux.receive <- irc.ParseMessage("JOIN #locked sesame")
+	expectReply(t, qux, "^:qux!root@quxhost JOIN #locked$")
+	receiveUntil(t, qux, irc.RPL_ENDOFNAMES)
+	receiveUntil(t, foo, irc.JOIN)
+
+	for _, c := range []*mockConn{baz, qux} {
+		c.receive <- irc.ParseMessage("OPER admin hunter2")
+		receiveUntil(t, c, irc.MODE)
+	}
+
+	// Operators don't, and the others are told about it.
+	baz.receive <- irc.ParseMessage("JOIN #locked")
+	expectReply(t, qux, "^:baz!root@bazhost JOIN #locked$")
+	expectReply(t, qux, "^:testserver NOTICE qux :\\*\\*\\* Notice -- baz overrode \\+k to join #locked$")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+	if ch, _ := srv.HasChannel("#locked"); ch.Len() != 3 {
+		t.Errorf("got %d members; want 3", ch.Len())
+	}
+}
+
+func TestServerJoinKeys(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+
+	for _, ch := range []string{"#a one", "#b two"} {
+		foo.receive <- irc.ParseMessage("JOIN " + strings.Fields(ch)[0])
+		receiveUntil(t, foo, irc.RPL_ENDOFNAMES)
+		foo.receive <- irc.ParseMessage("MODE " + strings.Replace(ch, " ", " +k ", 1))
+		receiveUntil(t, foo, irc.MODE)
+	}
+
+	// Keys in the wrong positions don't match.
+	baz.receive <- irc.ParseMessage("JOIN #b,#a one,two")
+	expectReply(t, baz, "^:testserver 475 baz #b :Cannot join channel \\(\\+k\\)$")
+	expectReply(t, baz, "^:testserver 475 baz #a :Cannot join channel \\(\\+k\\)$")
+
+	// Channels past the last key get an empty one.
+	baz.receive <- irc.ParseMessage("JOIN #a,#b,#c one,two")
+	expectReply(t, baz, "^:baz!root@bazhost JOIN #a$")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+	expectReply(t, baz, "^:baz!root@bazhost JOIN #b$")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+	expectReply(t, baz, "^:baz!root@bazhost JOIN #c$")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+
+	// Keys can't be empty, which would make the channel unjoinable.
+	baz.receive <- irc.ParseMessage("MODE #c +k :")
+	expectReply(t, baz, "^:testserver 461 baz MODE :Mode k requires a parameter$")
+
+	// A wrong key forwards to the +f channel, as a full channel does.
+	foo.receive <- irc.ParseMessage("MODE #a +f #d")
+	receiveUntil(t, foo, irc.MODE)
+	baz.receive <- irc.ParseMessage("PART #a")
+	receiveUntil(t, baz, irc.PART)
+	baz.receive <- irc.ParseMessage("JOIN #a wrong")
+	expectReply(t, baz, "^:testserver 470 baz #a #d :Forwarding to another channel$")
+	expectReply(t, baz, "^:baz!root@bazhost JOIN #d$")
+
+	// Joining directly checks the key too.
+	u := NewUser(NewConnMock("quxhost", 10))
+	u.Nick = "qux"
+	if ch, _ := srv.HasChannel("#b"); ch.Join(u) != ErrBadKey {
+		t.Error("expected ErrBadKey joining #b without its key")
+	}
+}
+
+func TestServerMemberModes(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		isupport := receiveUntil(t, c, rplISupport)
+		if !strings.Contains(isupport.String(), " PREFIX=(qaov)~&@+ ") {
+			t.Errorf("expected PREFIX in %q", isupport)
+		}
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+	for _, c := range []*mockConn{foo, baz, qux} {
+		c.receive <- irc.ParseMessage("JOIN #chat")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, foo, irc.JOIN)
+
+	// Regular members can't kick, give themselves a status, set the topic or
+	// change the channel modes.
+	qux.receive <- irc.ParseMessage("TOPIC #chat :mine now")
+	expectReply(t, qux, "^:testserver 482 qux #chat :You're not channel operator$")
+	qux.receive <- irc.ParseMessage("KICK #chat foo")
+	expectReply(t, qux, "^:testserver 482 qux #chat :You're not channel operator$")
+	qux.receive <- irc.ParseMessage("MODE #chat +o qux")
+	expectReply(t, qux, "^:testserver 482 qux #chat :You're not channel operator$")
+	qux.receive <- irc.ParseMessage("MODE #chat +l 10")
+	expectReply(t, qux, "^:testserver 482 qux #chat :You're not channel operator$")
+
+	// The first member is an op, who can change the channel modes but can't
+	// give a higher status.
+	foo.receive <- irc.ParseMessage("MODE #chat +l 10")
+	expectReply(t, qux, "^:foo!root@foohost MODE #chat \\+l 10$")
+	foo.receive <- irc.ParseMessage("MODE #chat +a qux")
+	expectReply(t, foo, "^:foo!root@foohost MODE #chat \\+l 10$")
+	expectReply(t, foo, "^:testserver 482 foo #chat :You're not channel operator$")
+	foo.receive <- irc.ParseMessage("MODE #chat +q foo")
+	expectReply(t, foo, "^:testserver 482 foo #chat :You're not channel operator$")
+
+	// IRC operators can give any status.
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	receiveUntil(t, foo, irc.MODE)
+	foo.receive <- irc.ParseMessage("MODE #chat +q baz")
+	expectReply(t, qux, "^:foo!root@foohost MODE #chat \\+q baz$")
+
+	// Owners can make admins, who can't make owners.
+	baz.receive <- irc.ParseMessage("MODE #chat +a qux")
+	expectReply(t, qux, "^:baz!root@bazhost MODE #chat \\+a qux$")
+	qux.receive <- irc.ParseMessage("MODE #chat +q qux")
+	expectReply(t, qux, "^:testserver 482 qux #chat :You're not channel operator$")
+
+	// Owners and admins can set the topic.
+	baz.receive <- irc.ParseMessage("TOPIC #chat :owned")
+	expectReply(t, qux, "^:baz!root@bazhost TOPIC #chat :owned$")
+	qux.receive <- irc.ParseMessage("TOPIC #chat :administered")
+	expectReply(t, qux, "^:qux!root@quxhost TOPIC #chat :administered$")
+
+	// Admins rank above operators.
+	qux.receive <- irc.ParseMessage("MODE #chat +v foo")
+	expectReply(t, qux, "^:qux!root@quxhost MODE #chat \\+v foo$")
+	qux.receive <- irc.ParseMessage("NAMES #chat")
+	expectReply(t, qux, "^:testserver 353 qux = #chat :~baz &qux @foo$")
+	receiveUntil(t, qux, irc.RPL_ENDOFNAMES)
+	qux.receive <- irc.ParseMessage("KICK #chat foo")
+	expectReply(t, qux, "^:qux!root@quxhost KICK #chat foo :foo$")
+}
+
+func TestServerCaseMapping(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:        testServerName,
+		CaseMapping: CaseMappingRFC1459,
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"Foo[m]", "baz"} {
+		c := NewConnMock("host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		isupport := receiveUntil(t, c, rplISupport)
+		if !strings.Contains(isupport.String(), " CASEMAPPING=rfc1459 ") {
+			t.Errorf("expected CASEMAPPING in %q", isupport)
+		}
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["Foo[m]"], conns["baz"]
+
+	foo.receive <- irc.ParseMessage("JOIN #Chat[1]")
+	receiveUntil(t, foo, irc.RPL_ENDOFNAMES)
+
+	// Lookups ignore case, but the name is displayed as it was created.
+	baz.receive <- irc.ParseMessage("JOIN #chat{1}")
+	expectReply(t, baz, "^:baz!root@host JOIN #Chat\\[1\\]$")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+	baz.receive <- irc.ParseMessage("NAMES #CHAT{1}")
+	expectReply(t, baz, "^:testserver 353 baz = #Chat\\[1\\] :@Foo\\[m\\] baz$")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+	if ch := srv.(ChannelFinder).LookupChannel("#chat{1}"); ch == nil || ch.String() != "#Chat[1]" {
+		t.Errorf("got %v; want #Chat[1]", ch)
+	}
+	if u, ok := srv.HasUser("foo{M}"); !ok || u.Nick != "Foo[m]" {
+		t.Errorf("got %v; want Foo[m]", u)
+	}
+}
+
+func TestServerRenameChannel(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+	for _, c := range []*mockConn{foo, baz} {
+		c.receive <- irc.ParseMessage("JOIN #old")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	receiveUntil(t, foo, irc.JOIN)
+	foo.receive <- irc.ParseMessage("TOPIC #old :Hello")
+	for _, c := range []*mockConn{foo, baz} {
+		receiveUntil(t, c, irc.TOPIC)
+	}
+	srv.Channel("#other")
+
+	for _, tc := range []struct {
+		oldName, newName string
+		err              error
+	}{
+		{"#nope", "#new", ErrNoSuchChannel},
+		{"#old", "new", ErrInvalidChannelName},
+		{"#old", "#OTHER", ErrChannelExists},
+	} {
+		if err := srv.(ChannelRenamer).RenameChannel(tc.oldName, tc.newName); err != tc.err {
+			t.Errorf("renaming %s to %s: got %v; want %v", tc.oldName, tc.newName, err, tc.err)
+		}
+	}
+
+	if err := srv.(ChannelRenamer).RenameChannel("#OLD", "#new"); err != nil {
+		t.Fatal(err)
+	}
+	for nick, c := range map[string]*mockConn{"foo": foo, "baz": baz} {
+		expectReply(t, c, "^:"+nick+"!root@"+nick+"host PART #old :Channel renamed to #new$")
+		expectReply(t, c, "^:"+nick+"!root@"+nick+"host JOIN #new$")
+		expectReply(t, c, "^:testserver 332 "+nick+" #new :Hello$")
+		expectReply(t, c, "^:testserver 353 "+nick+" = #new :@foo baz$")
+		expectReply(t, c, "^:testserver 366 "+nick+" #new ")
+	}
+	if _, exists := srv.HasChannel("#old"); exists {
+		t.Error("expected #old to be gone")
+	}
+	ch, exists := srv.HasChannel("#new")
+	if !exists {
+		t.Fatal("expected #new to exist")
+	}
+	if ch.String() != "#new" || ch.ID() != "#new" || ch.Len() != 2 {
+		t.Errorf("got %s (%s) with %d members", ch, ch.ID(), ch.Len())
+	}
+
+	// Messages go to the renamed channel.
+	foo.receive <- irc.ParseMessage("PRIVMSG #new :hi")
+	expectReply(t, baz, "^:foo!root@foohost PRIVMSG #new :hi$")
+}
+
+func TestServerRename(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+	baz.receive <- irc.ParseMessage("CAP REQ :draft/channel-rename")
+	expectReply(t, baz, "^:testserver CAP baz ACK :draft/channel-rename$")
+	for _, c := range []*mockConn{foo, baz, qux} {
+		c.receive <- irc.ParseMessage("JOIN #old")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	srv.Channel("#other")
+
+	// Only channel operators can rename.
+	qux.receive <- irc.ParseMessage("RENAME #old #new")
+	expectReply(t, qux, "^:testserver 482 qux #old :You're not channel operator$")
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	receiveUntil(t, foo, irc.MODE)
+	foo.receive <- irc.ParseMessage("MODE #old +o baz")
+	receiveUntil(t, baz, irc.MODE)
+
+	baz.receive <- irc.ParseMessage("RENAME #old #other :Moving")
+	expectReply(t, baz, "^:testserver FAIL RENAME CHANNEL_NAME_IN_USE #old #other :Channel already exists$")
+
+	baz.receive <- irc.ParseMessage("RENAME #old #new :Moving")
+	expectReply(t, baz, "^:baz!root@bazhost RENAME #old #new :Moving$")
+	receiveUntil(t, qux, irc.MODE)
+	expectReply(t, qux, "^:qux!root@quxhost PART #old :Channel renamed to #new: Moving$")
+	expectReply(t, qux, "^:qux!root@quxhost JOIN #new$")
+	expectReply(t, qux, "^:testserver 353 qux = #new :@baz @foo qux$")
+	receiveUntil(t, qux, irc.RPL_ENDOFNAMES)
+
+	ch, exists := srv.HasChannel("#new")
+	if !exists || ch.Len() != 3 {
+		t.Fatalf("expected all members in #new; got %v", ch)
+	}
+	if _, exists := srv.HasChannel("#old"); exists {
+		t.Error("expected #old to be gone")
+	}
+}
+
+func TestServerNormalize(t *testing.T) {
+	events := make(chan Event, 10)
+	unaccent := strings.NewReplacer("é", "e", "É", "e", "ü", "u", "Ü", "u")
+	srv := ServerConfig{
+		Name: testServerName,
+		Normalize: func(name string) string {
+			return strings.ToLower(unaccent.Replace(name))
+		},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"José", "baz"} {
+		c := NewConnMock("host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	jose, baz := conns["José"], conns["baz"]
+
+	u, ok := srv.HasUser("JOSE")
+	if !ok || u.Nick != "José" {
+		t.Fatalf("got %v; want José", u)
+	}
+	if got := u.ID(); got != "jose" {
+		t.Errorf("got ID %q; want jose", got)
+	}
+	baz.receive <- irc.ParseMessage("NICK jose")
+	expectReply(t, baz, "^:testserver 433 jose :Nickname is already in use$")
+
+	jose.receive <- irc.ParseMessage("JOIN #Café")
+	receiveUntil(t, jose, irc.RPL_ENDOFNAMES)
+	baz.receive <- irc.ParseMessage("JOIN #cafe")
+	expectReply(t, baz, "^:baz!root@host JOIN #Café$")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+	if ch, exists := srv.HasChannel("#CAFÉ"); !exists || ch.Len() != 2 || ch.ID() != "#cafe" {
+		t.Errorf("expected both in #Café; got %v", ch)
+	}
+
+	baz.receive <- irc.ParseMessage("NICK Zoé")
+	expectReply(t, baz, "^:baz!root@host NICK Zoé$")
+	if u, _ := srv.HasUser("zoe"); u == nil || u.ID() != "zoe" {
+		t.Errorf("got %v; want Zoé with ID zoe", u)
+	}
+}
+
+func TestServerIdleChannels(t *testing.T) {
+	events := make(chan Event, 10)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	c := NewConnMock("foohost", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+	expectEvent(t, events, ConnectEvent)
+	receiveWelcome(t, c)
+	for _, name := range []string{"#stale", "#active"} {
+		c.receive <- irc.ParseMessage("JOIN " + name)
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+
+	c.receive <- irc.ParseMessage("IDLECHANNELS 1h")
+	expectReply(t, c, "^:testserver 481 foo ")
+	c.receive <- irc.ParseMessage("OPER admin hunter2")
+	receiveUntil(t, c, irc.MODE)
+
+	time.Sleep(100 * time.Millisecond)
+	c.receive <- irc.ParseMessage("PRIVMSG #active :still here")
+	c.receive <- irc.ParseMessage("IDLECHANNELS 100ms")
+	expectReply(t, c, "^:testserver NOTICE foo :#stale idle 0s$")
+	expectReply(t, c, "^:testserver NOTICE foo :End of IDLECHANNELS$")
+
+	c.receive <- irc.ParseMessage("IDLECHANNELS 100ms CLOSE")
+	expectReply(t, c, "^:foo!root@foohost PART #stale$")
+	expectReply(t, c, "^:testserver NOTICE foo :Closed #stale idle 0s$")
+	expectReply(t, c, "^:testserver NOTICE foo :End of IDLECHANNELS$")
+	if _, exists := srv.HasChannel("#stale"); exists {
+		t.Error("expected #stale to be closed")
+	}
+	if _, exists := srv.HasChannel("#active"); !exists {
+		t.Error("expected #active to be spared")
+	}
+}
+
+func TestServerNamesAll(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+
+	foo.receive <- irc.ParseMessage("JOIN #public")
+	receiveUntil(t, foo, irc.RPL_ENDOFNAMES)
+	qux.receive <- irc.ParseMessage("JOIN #secret")
+	receiveUntil(t, qux, irc.RPL_ENDOFNAMES)
+	qux.receive <- irc.ParseMessage("MODE #secret +s")
+	expectReply(t, qux, "^:qux!root@quxhost MODE #secret \\+s$")
+
+	baz.receive <- irc.ParseMessage("NAMES")
+	expectReply(t, baz, "^:testserver 353 baz = #public :@foo$")
+	expectReply(t, baz, "^:testserver 353 baz \\* \\* :baz qux$")
+	expectReply(t, baz, "^:testserver 366 baz \\* :End of /NAMES list.$")
+
+	qux.receive <- irc.ParseMessage("NAMES")
+	expectReply(t, qux, "^:testserver 353 qux = #public :@foo$")
+	expectReply(t, qux, "^:testserver 353 qux @ #secret :@qux$")
+	expectReply(t, qux, "^:testserver 353 qux \\* \\* :baz$")
+	expectReply(t, qux, "^:testserver 366 qux \\* :End of /NAMES list.$")
+}
+
+func TestServerListFilter(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	nicks := []string{"foo", "baz", "qux", "quux"}
+	for _, nick := range nicks {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	// #one has 1 user, #two has 2 and #three has 3.
+	for i, name := range []string{"#one", "#two", "#three"} {
+		for _, nick := range nicks[:i+1] {
+			conns[nick].receive <- irc.ParseMessage("JOIN " + name)
+			receiveUntil(t, conns[nick], irc.RPL_ENDOFNAMES)
+		}
+	}
+	c := conns["quux"]
+	c.receive <- irc.ParseMessage("TOPIC #one :hello")
+	expectReply(t, c, "^:testserver 442 quux #one ")
+	foo := conns["foo"]
+	foo.receive <- irc.ParseMessage("TOPIC #one :hello")
+	receiveUntil(t, foo, irc.TOPIC)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"LIST >1", []string{"#three", "#two"}},
+		{"LIST <3", []string{"#one", "#two"}},
+		{"LIST >1,<3", []string{"#two"}},
+		{"LIST >1,#one,#three", []string{"#three"}},
+		{"LIST #t*", []string{"#three", "#two"}},
+		{"LIST T<5", []string{"#one"}},
+		{"LIST T>5", nil},
+	}
+	for _, test := range tests {
+		c.receive <- irc.ParseMessage(test.query)
+		var got []string
+		for {
+			msg := receiveReply(t, c)
+			if msg.Command == irc.RPL_LISTEND {
+				break
+			}
+			got = append(got, msg.Params[1])
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: got %v; want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestServerInviteList(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+
+	foo.receive <- irc.ParseMessage("JOIN #chat")
+	receiveUntil(t, foo, irc.RPL_ENDOFNAMES)
+	ch, _ := srv.HasChannel("#chat")
+	fooUser, _ := srv.HasUser("foo")
+	for _, nick := range []string{"qux", "baz"} {
+		u, _ := srv.HasUser(nick)
+		if err := ch.Invite(fooUser, u); err != nil {
+			t.Fatal(err)
+		}
+		expectReply(t, conns[nick], "^:foo!root@foohost INVITE "+nick+" #chat$")
+	}
+
+	foo.receive <- irc.ParseMessage("MODE #chat +I")
+	expectReply(t, foo, "^:testserver 346 foo #chat baz$")
+	expectReply(t, foo, "^:testserver 346 foo #chat qux$")
+	expectReply(t, foo, "^:testserver 347 foo #chat :End of channel invite list$")
+
+	baz.receive <- irc.ParseMessage("JOIN #chat")
+	receiveUntil(t, baz, irc.RPL_ENDOFNAMES)
+	receiveUntil(t, foo, irc.JOIN)
+	foo.receive <- irc.ParseMessage("MODE #chat I")
+	expectReply(t, foo, "^:testserver 346 foo #chat qux$")
+	expectReply(t, foo, "^:testserver 347 foo #chat ")
+}
+
+func TestServerModeParams(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	c := NewConnMock("foohost", 20)
+	go srv.Connect(NewUser(c))
+	c.receive <- irc.ParseMessage("NICK foo")
+	c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+	receiveWelcome(t, c)
+	c.receive <- irc.ParseMessage("JOIN #chat")
+	receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+
+	// Parameterized modes require their argument.
+	c.receive <- irc.ParseMessage("MODE #chat +l")
+	expectReply(t, c, "^:testserver 461 foo MODE :Mode l requires a parameter$")
+	c.receive <- irc.ParseMessage("MODE #chat +fp")
+	expectReply(t, c, "^:foo!root@foohost MODE #chat \\+p$")
+	expectReply(t, c, "^:testserver 461 foo MODE :Mode f requires a parameter$")
+
+	// Removing modes which aren't set is a no-op.
+	c.receive <- irc.ParseMessage("MODE #chat -lf")
+	c.receive <- irc.ParseMessage("MODE #chat")
+	expectReply(t, c, "^:testserver 324 foo #chat \\+p$")
+
+	// Removing set modes clears their state.
+	c.receive <- irc.ParseMessage("MODE #chat +lf 5 #overflow")
+	expectReply(t, c, "^:foo!root@foohost MODE #chat \\+lf 5 #overflow$")
+	c.receive <- irc.ParseMessage("MODE #chat -l")
+	expectReply(t, c, "^:foo!root@foohost MODE #chat -l$")
+	c.receive <- irc.ParseMessage("MODE #chat")
+	expectReply(t, c, "^:testserver 324 foo #chat \\+fp #overflow$")
+}
+
+func TestServerKick(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := ServerConfig{
+		Name:  testServerName,
+		Opers: map[string]string{"admin": "hunter2"},
+	}.Server()
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz := conns["foo"], conns["baz"]
+	for _, c := range []*mockConn{foo, baz} {
+		c.receive <- irc.ParseMessage("JOIN #chat")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	receiveUntil(t, foo, irc.JOIN)
+
+	baz.receive <- irc.ParseMessage("KICK #chat foo")
+	expectReply(t, baz, "^:testserver 482 baz #chat :You're not channel operator$")
+
+	foo.receive <- irc.ParseMessage("OPER admin hunter2")
+	expectReply(t, foo, "^:testserver 381 foo ")
+	receiveReply(t, foo)
+
+	foo.receive <- irc.ParseMessage("KICK #chat nobody,baz :Go away")
+	expectReply(t, baz, "^:foo!root@foohost KICK #chat baz :Go away$")
+	expectReply(t, foo, "^:foo!root@foohost KICK #chat baz :Go away$")
+	expectReply(t, foo, "^:testserver 401 foo nobody ")
+
+	foo.receive <- irc.ParseMessage("KICK #chat baz")
+	expectReply(t, foo, "^:testserver 441 foo baz #chat ")
+}
+
+func TestServerRedact(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+
+	baz.receive <- irc.ParseMessage("CAP REQ :draft/message-redaction message-tags")
+	expectReply(t, baz, "^:testserver CAP baz ACK :draft/message-redaction message-tags$")
+	for _, c := range []*mockConn{foo, baz, qux} {
+		c.receive <- irc.ParseMessage("JOIN #chat")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, baz, irc.JOIN)
+
+	foo.receive <- irc.ParseMessage("PRIVMSG #chat :spam")
+	msg := receiveReply(t, baz)
+	msgid := baz.Tags(msg)["msgid"]
+	expectReply(t, qux, "^:foo!root@foohost PRIVMSG #chat :spam$")
+
+	ch, _ := srv.HasChannel("#chat")
+	ch.(Redacter).Redact("unknown")
+	ch.(Redacter).Redact(msgid)
+	expectReply(t, baz, "^:testserver REDACT #chat "+regexp.QuoteMeta(msgid)+"$")
+
+	// Members without the capability are not notified.
+	select {
+	case msg := <-qux.send:
+		t.Errorf("unexpected reply: %s", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestServerMsgID(t *testing.T) {
+	events := make(chan Event, 20)
+	srv := NewServer(testServerName)
+	srv.Subscribe(events)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		c := NewConnMock(nick+"host", 20)
+		conns[nick] = c
+		go srv.Connect(NewUser(c))
+		c.receive <- irc.ParseMessage("NICK " + nick)
+		c.receive <- irc.ParseMessage("USER root 0 * :Real Name")
+		expectEvent(t, events, ConnectEvent)
+		receiveWelcome(t, c)
+	}
+	foo, baz, qux := conns["foo"], conns["baz"], conns["qux"]
+
+	baz.receive <- irc.ParseMessage("CAP REQ :message-tags")
+	expectReply(t, baz, "^:testserver CAP baz ACK :message-tags$")
+	for _, c := range []*mockConn{foo, baz, qux} {
+		c.receive <- irc.ParseMessage("JOIN #chat")
+		receiveUntil(t, c, irc.RPL_ENDOFNAMES)
+	}
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, foo, irc.JOIN)
+	receiveUntil(t, baz, irc.JOIN)
+
+	ids := map[string]bool{}
+	for _, target := range []string{"#chat", "baz", "#chat"} {
+		foo.receive <- irc.ParseMessage("PRIVMSG " + target + " :hello")
+		msg := receiveReply(t, baz)
+		id := baz.Tags(msg)["msgid"]
+		if id == "" || ids[id] {
+			t.Errorf("expected a unique msgid for %s; got %q", msg, id)
+		}
+		ids[id] = true
+	}
+	for i := 0; i < 2; i++ {
+		expectReply(t, qux, "^:foo!root@foohost PRIVMSG #chat :hello$")
+	}
+}
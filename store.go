@@ -0,0 +1,226 @@
+package irckit
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// numShards is the number of partitions for the server's user and channel
+// storage, so that unrelated lookups don't contend on the same lock.
+const numShards = 32
+
+// shardIndex returns the shard which a normalized ID belongs to.
+func shardIndex(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % numShards)
+}
+
+type userShard struct {
+	sync.RWMutex
+	users map[string]*User
+}
+
+// userStore is a sharded map of normalized nicks to Users.
+type userStore [numShards]userShard
+
+func newUserStore() *userStore {
+	s := &userStore{}
+	for i := range s {
+		s[i].users = map[string]*User{}
+	}
+	return s
+}
+
+func (s *userStore) get(id string) (*User, bool) {
+	shard := &s[shardIndex(id)]
+	shard.RLock()
+	u, ok := shard.users[id]
+	shard.RUnlock()
+	return u, ok
+}
+
+// add stores the User under id, unless the id is already taken.
+func (s *userStore) add(id string, u *User) bool {
+	shard := &s[shardIndex(id)]
+	shard.Lock()
+	defer shard.Unlock()
+	if _, exists := shard.users[id]; exists {
+		return false
+	}
+	shard.users[id] = u
+	return true
+}
+
+// remove deletes the User stored under id, if it's the same User. Returns
+// whether it was removed.
+func (s *userStore) remove(id string, u *User) bool {
+	shard := &s[shardIndex(id)]
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.users[id] != u {
+		return false
+	}
+	delete(shard.users, id)
+	return true
+}
+
+// rename moves the User from oldID to newID, unless newID is already taken by
+// another User. The IDs are the same if only the case of the nick changes.
+// Both shards are locked for the duration, so fn can update the User
+// atomically with the move.
+func (s *userStore) rename(oldID string, newID string, u *User, fn func()) bool {
+	i, j := shardIndex(oldID), shardIndex(newID)
+	// Lock in a consistent order to avoid deadlocks.
+	first, second := &s[i], &s[j]
+	if j < i {
+		first, second = second, first
+	}
+	first.Lock()
+	defer first.Unlock()
+	if first != second {
+		second.Lock()
+		defer second.Unlock()
+	}
+
+	to := &s[j]
+	if other, exists := to.users[newID]; exists && other != u {
+		return false
+	}
+	delete(s[i].users, oldID)
+	to.users[newID] = u
+	fn()
+	return true
+}
+
+func (s *userStore) len() int {
+	n := 0
+	for i := range s {
+		shard := &s[i]
+		shard.RLock()
+		n += len(shard.users)
+		shard.RUnlock()
+	}
+	return n
+}
+
+// all returns a slice of all the stored Users.
+func (s *userStore) all() []*User {
+	users := []*User{}
+	for i := range s {
+		shard := &s[i]
+		shard.RLock()
+		for _, u := range shard.users {
+			users = append(users, u)
+		}
+		shard.RUnlock()
+	}
+	return users
+}
+
+type channelShard struct {
+	sync.RWMutex
+	channels map[string]Channel
+}
+
+// channelStore is a sharded map of normalized names to Channels.
+type channelStore [numShards]channelShard
+
+func newChannelStore() *channelStore {
+	s := &channelStore{}
+	for i := range s {
+		s[i].channels = map[string]Channel{}
+	}
+	return s
+}
+
+func (s *channelStore) get(id string) (Channel, bool) {
+	shard := &s[shardIndex(id)]
+	shard.RLock()
+	ch, ok := shard.channels[id]
+	shard.RUnlock()
+	return ch, ok
+}
+
+// getOrCreate returns the Channel stored under id, or stores a new one from
+// newFn. Returns whether the Channel was created.
+func (s *channelStore) getOrCreate(id string, newFn func() Channel) (Channel, bool) {
+	shard := &s[shardIndex(id)]
+	shard.Lock()
+	defer shard.Unlock()
+	if ch, ok := shard.channels[id]; ok {
+		return ch, false
+	}
+	ch := newFn()
+	shard.channels[id] = ch
+	return ch, true
+}
+
+// removeIf deletes the Channel if it's the one stored under its ID and ok
+// returns true while the shard is locked. Returns whether it was removed.
+func (s *channelStore) removeIf(ch Channel, ok func(Channel) bool) bool {
+	id := ch.ID()
+	shard := &s[shardIndex(id)]
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.channels[id] != ch || !ok(ch) {
+		return false
+	}
+	delete(shard.channels, id)
+	return true
+}
+
+// rename moves the Channel from oldID to newID, unless newID is taken by
+// another Channel. Both shards are locked for the duration, so fn can update
+// the Channel atomically with the move.
+func (s *channelStore) rename(oldID string, newID string, ch Channel, fn func()) bool {
+	i, j := shardIndex(oldID), shardIndex(newID)
+	// Lock in a consistent order to avoid deadlocks.
+	first, second := &s[i], &s[j]
+	if j < i {
+		first, second = second, first
+	}
+	first.Lock()
+	defer first.Unlock()
+	if first != second {
+		second.Lock()
+		defer second.Unlock()
+	}
+
+	if s[i].channels[oldID] != ch {
+		return false
+	}
+	to := &s[j]
+	if other, exists := to.channels[newID]; exists && other != ch {
+		return false
+	}
+	delete(s[i].channels, oldID)
+	to.channels[newID] = ch
+	fn()
+	return true
+}
+
+func (s *channelStore) len() int {
+	n := 0
+	for i := range s {
+		shard := &s[i]
+		shard.RLock()
+		n += len(shard.channels)
+		shard.RUnlock()
+	}
+	return n
+}
+
+// all returns a slice of all the stored Channels.
+func (s *channelStore) all() []Channel {
+	channels := []Channel{}
+	for i := range s {
+		shard := &s[i]
+		shard.RLock()
+		for _, ch := range shard.channels {
+			channels = append(channels, ch)
+		}
+		shard.RUnlock()
+	}
+	return channels
+}
@@ -0,0 +1,119 @@
+package irckit
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUserStore(t *testing.T) {
+	s := newUserStore()
+	users := map[string]*User{}
+	for i := 0; i < numShards*4; i++ {
+		u := NewUser(NewConnMock("client", 1))
+		u.Nick = fmt.Sprintf("user%d", i)
+		users[u.ID()] = u
+		if !s.add(u.ID(), u) {
+			t.Fatalf("failed to add %s", u.Nick)
+		}
+	}
+	if got, want := s.len(), len(users); got != want {
+		t.Errorf("got len %d; want %d", got, want)
+	}
+	for id, u := range users {
+		if got, ok := s.get(id); !ok || got != u {
+			t.Errorf("get(%q): got %v; want %v", id, got, u)
+		}
+	}
+
+	u := users["user1"]
+	if s.add("user1", u) {
+		t.Error("expected duplicate add to fail")
+	}
+	if s.rename("user1", "user2", u, func() {}) {
+		t.Error("expected rename to a taken nick to fail")
+	}
+	if !s.rename("user1", "renamed", u, func() { u.Nick = "renamed" }) {
+		t.Fatal("expected rename to succeed")
+	}
+	if _, ok := s.get("user1"); ok {
+		t.Error("expected old nick to be gone after rename")
+	}
+	if got, ok := s.get("renamed"); !ok || got != u {
+		t.Errorf("get(renamed): got %v; want %v", got, u)
+	}
+
+	s.remove("renamed", users["user3"])
+	if _, ok := s.get("renamed"); !ok {
+		t.Error("expected remove of a different user to be ignored")
+	}
+	s.remove("renamed", u)
+	if _, ok := s.get("renamed"); ok {
+		t.Error("expected user to be removed")
+	}
+	if got, want := len(s.all()), len(users)-1; got != want {
+		t.Errorf("got %d users; want %d", got, want)
+	}
+}
+
+func TestChannelStore(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	s := newChannelStore()
+	for i := 0; i < numShards*4; i++ {
+		name := fmt.Sprintf("#chan%d", i)
+		ch, created := s.getOrCreate(ID(name), func() Channel {
+			return NewChannel(srv, name)
+		})
+		if !created {
+			t.Fatalf("expected %s to be created", name)
+		}
+		if got, ok := s.get(ID(name)); !ok || got != ch {
+			t.Errorf("get(%q): got %v; want %v", name, got, ch)
+		}
+	}
+	if got, want := s.len(), numShards*4; got != want {
+		t.Errorf("got len %d; want %d", got, want)
+	}
+
+	ch, created := s.getOrCreate("#chan1", func() Channel {
+		t.Fatal("unexpected create for an existing channel")
+		return nil
+	})
+	if created {
+		t.Error("expected existing channel to be returned")
+	}
+	if s.removeIf(NewChannel(srv, "#chan1"), func(Channel) bool { return true }) {
+		t.Error("expected remove of a different channel to be ignored")
+	}
+	if s.removeIf(ch, func(Channel) bool { return false }) {
+		t.Error("expected remove to be skipped")
+	}
+	if !s.removeIf(ch, func(Channel) bool { return true }) {
+		t.Error("expected channel to be removed")
+	}
+	if _, ok := s.get("#chan1"); ok {
+		t.Error("expected channel to be gone")
+	}
+}
+
+func BenchmarkServerParallel(b *testing.B) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	for i := 0; i < 1000; i++ {
+		u := NewUser(NewConnMock("client", 1))
+		u.Nick = fmt.Sprintf("user%d", i)
+		srv.(*server).add(u)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			srv.Channel(fmt.Sprintf("#chan%d", i%100))
+			srv.HasUser(fmt.Sprintf("user%d", i%1000))
+			i++
+		}
+	})
+}
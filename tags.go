@@ -0,0 +1,121 @@
+package irckit
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Tags are IRCv3 message tags, sent on the wire ahead of the message:
+// @key=value;other :prefix COMMAND params
+type Tags map[string]string
+
+// TagConn is implemented by a Conn which supports sending and receiving
+// message tags. Tags are dropped when a Conn doesn't implement it.
+type TagConn interface {
+	EncodeTags(Tags, *irc.Message) error
+	DecodeTags() (Tags, *irc.Message, error)
+}
+
+var (
+	msgIDCount uint64
+	// msgIDPrefix keeps IDs unique across restarts of the server.
+	msgIDPrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+)
+
+// newMsgID returns a unique ID for the msgid tag of a message.
+func newMsgID() string {
+	return msgIDPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&msgIDCount, 1), 36)
+}
+
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+// ParseTags parses the tags portion of a line, without the leading '@'.
+func ParseTags(raw string) Tags {
+	tags := Tags{}
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			key, value = tag[:i], unescapeTag(tag[i+1:])
+		}
+		tags[key] = value
+	}
+	return tags
+}
+
+func unescapeTag(value string) string {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
+	}
+	r := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			r = append(r, c)
+			continue
+		}
+		i++
+		if i == len(value) {
+			// Trailing backslash is dropped.
+			break
+		}
+		switch value[i] {
+		case ':':
+			r = append(r, ';')
+		case 's':
+			r = append(r, ' ')
+		case 'r':
+			r = append(r, '\r')
+		case 'n':
+			r = append(r, '\n')
+		default:
+			r = append(r, value[i])
+		}
+	}
+	return string(r)
+}
+
+// String returns the wire format of the tags in sorted order, without the
+// leading '@'.
+func (t Tags) String() string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if value := t[key]; value != "" {
+			key += "=" + tagEscaper.Replace(value)
+		}
+		parts = append(parts, key)
+	}
+	return strings.Join(parts, ";")
+}
+
+// parseLine splits the tags from a raw line and parses the message.
+func parseLine(line string) (Tags, *irc.Message) {
+	var tags Tags
+	if strings.HasPrefix(line, "@") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return nil, nil
+		}
+		tags, line = ParseTags(line[1:i]), line[i+1:]
+	}
+	return tags, irc.ParseMessage(line)
+}
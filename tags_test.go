@@ -0,0 +1,34 @@
+package irckit
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Tags
+	}{
+		{"", Tags{}},
+		{"label=abc", Tags{"label": "abc"}},
+		{"a;b=", Tags{"a": "", "b": ""}},
+		{`account=a\:b\sc\\d;msgid=1`, Tags{"account": `a;b c\d`, "msgid": "1"}},
+		{`x=trailing\`, Tags{"x": "trailing"}},
+	}
+	for _, test := range tests {
+		if got := ParseTags(test.raw); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseTags(%q): got %v; want %v", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestTagsString(t *testing.T) {
+	tags := Tags{"msgid": "1", "account": "a;b c", "bot": ""}
+	if got, want := tags.String(), `account=a\:b\sc;bot;msgid=1`; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got := ParseTags(tags.String()); !reflect.DeepEqual(got, tags) {
+		t.Errorf("round trip: got %v; want %v", got, tags)
+	}
+}
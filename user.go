@@ -1,9 +1,13 @@
 package irckit
 
 import (
+	"io"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sorcix/irc"
 )
@@ -11,24 +15,31 @@ import (
 // NewUser creates a *User, wrapping a connection with metadata we need for our server.
 func NewUser(c Conn) *User {
 	return &User{
-		Conn:     c,
-		Host:     "*",
-		channels: map[Channel]struct{}{},
+		Conn:       c,
+		Host:       "*",
+		caps:       map[string]struct{}{},
+		channels:   map[Channel]struct{}{},
+		signon:     time.Now(),
+		lastActive: time.Now(),
+		lastRecv:   time.Now(),
+
+		correspondents: map[*User]struct{}{},
 	}
 }
 
 // NewUserNet creates a *User from a net.Conn connection.
 func NewUserNet(c net.Conn) *User {
-	return NewUser(&conn{
-		Conn:    c,
-		Encoder: irc.NewEncoder(c),
-		Decoder: irc.NewDecoder(c),
-	})
+	return NewUser(newConn(c))
 }
 
 const defaultCloseMsg = "Closed."
 
 type User struct {
+	// Bytes of the encoded lines sent and received, accessed atomically.
+	// They're kept first to be 64-bit aligned on 32-bit platforms.
+	bytesSent uint64
+	bytesRecv uint64
+
 	Conn
 
 	sync.RWMutex
@@ -37,14 +48,70 @@ type User struct {
 	Real string // From USER command
 	Host string
 
-	channels map[Channel]struct{}
+	id         string // Nick as normalized by the Server, see ID
+	oper       bool   // From OPER command
+	account    string // Authenticated account name, if any
+	realHost   string // Host before cloaking
+	ip         string // Address of the connection, if known
+	capVersion int    // From CAP LS
+	caps       map[string]struct{}
+	channels   map[Channel]struct{}
+	silence    []string  // Masks from SILENCE command
+	away       string    // From AWAY command, or set when idle
+	autoAway   bool      // Whether away was set for being idle
+	signon     time.Time // When the User connected
+	lastActive time.Time
+	lastRecv   time.Time
+
+	// Outstanding PING from the server, and the round trip of the last one
+	// which was answered.
+	pingToken string
+	pingSent  time.Time
+	lag       time.Duration
+
+	// Set by the Server before any messages are exchanged.
+	logPrefix string
+	rawLog    io.Writer
+
+	// Times of recent NICK commands, for ServerConfig.MaxNickChanges.
+	nickChanges []time.Time
+
+	// Users who exchanged private messages with this User.
+	correspondents map[*User]struct{}
+
+	// encodeMu serializes writes to the Conn, so that the messages of
+	// concurrent Encode calls don't interleave.
+	encodeMu sync.Mutex
+
+	// While labeling, responses are buffered to be sent with the label of
+	// the command which is being handled.
+	labeling bool
+	labeled  []taggedMessage
+
+	// draft/multiline BATCH which is being received, only accessed by the
+	// goroutine handling the User's messages.
+	multiline *multilineBatch
+}
+
+type taggedMessage struct {
+	tags Tags
+	msg  *irc.Message
 }
 
+// ID returns the nick as normalized by the Server, which the User is looked
+// up by. It's the lowercase nick if the Server hasn't assigned one.
 func (u *User) ID() string {
-	return strings.ToLower(u.Nick)
+	u.RLock()
+	defer u.RUnlock()
+	if u.id == "" {
+		return strings.ToLower(u.Nick)
+	}
+	return u.id
 }
 
 func (u *User) Prefix() *irc.Prefix {
+	u.RLock()
+	defer u.RUnlock()
 	return &irc.Prefix{
 		Name: u.Nick,
 		User: u.User,
@@ -52,8 +119,363 @@ func (u *User) Prefix() *irc.Prefix {
 	}
 }
 
+// IP returns the address which the User connected from, falling back to the
+// real host if it's unknown.
+func (u *User) IP() string {
+	u.RLock()
+	ip := u.ip
+	u.RUnlock()
+	if ip == "" {
+		return u.RealHost()
+	}
+	return ip
+}
+
+// BytesSent returns the number of bytes which have been sent to the User.
+func (u *User) BytesSent() uint64 {
+	return atomic.LoadUint64(&u.bytesSent)
+}
+
+// BytesReceived returns the number of bytes which have been received from the
+// User.
+func (u *User) BytesReceived() uint64 {
+	return atomic.LoadUint64(&u.bytesRecv)
+}
+
+// Secure returns whether the User is connected over TLS.
+func (u *User) Secure() bool {
+	sc, ok := u.Conn.(secureConn)
+	return ok && sc.Secure()
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the User's TLS client
+// certificate, in hex, or an empty string if they didn't present one.
+func (u *User) CertFingerprint() string {
+	cc, ok := u.Conn.(certConn)
+	if !ok {
+		return ""
+	}
+	return cc.CertFingerprint()
+}
+
+// RealHost returns the resolved host of the User, before any cloaking was
+// applied.
+func (u *User) RealHost() string {
+	u.RLock()
+	defer u.RUnlock()
+	if u.realHost == "" {
+		return u.Host
+	}
+	return u.realHost
+}
+
+// RealName returns the real name of the User, from the USER command.
+func (u *User) RealName() string {
+	u.RLock()
+	defer u.RUnlock()
+	return u.Real
+}
+
+// IsOper returns whether the User is a server operator.
+func (u *User) IsOper() bool {
+	u.RLock()
+	defer u.RUnlock()
+	return u.oper
+}
+
+// Set updates the identity of the User, leaving the fields whose new value is
+// empty unchanged.
+func (u *User) Set(nick, user, real, host string) {
+	u.Lock()
+	defer u.Unlock()
+	if nick != "" && nick != u.Nick {
+		u.Nick = nick
+		u.id = ""
+	}
+	if user != "" {
+		u.User = user
+	}
+	if real != "" {
+		u.Real = real
+	}
+	if host != "" {
+		u.Host = host
+	}
+}
+
+// setNick changes the nick along with its normalized ID.
+func (u *User) setNick(nick string, id string) {
+	u.Lock()
+	u.Nick = nick
+	u.id = id
+	u.Unlock()
+}
+
+// clearNick unsets the nick, which Set leaves unchanged, for when it was
+// rejected during the handshake.
+func (u *User) clearNick() {
+	u.setNick("", "")
+}
+
+// SetOper grants or revokes server operator status for the User.
+func (u *User) SetOper(oper bool) {
+	u.Lock()
+	u.oper = oper
+	u.Unlock()
+}
+
+// HasCap returns whether the User has negotiated the given capability.
+func (u *User) HasCap(name string) bool {
+	u.RLock()
+	_, ok := u.caps[name]
+	u.RUnlock()
+	return ok
+}
+
+// Caps returns a sorted slice of the capabilities the User has negotiated.
+func (u *User) Caps() []string {
+	u.RLock()
+	caps := make([]string, 0, len(u.caps))
+	for name := range u.caps {
+		caps = append(caps, name)
+	}
+	u.RUnlock()
+	sort.Strings(caps)
+	return caps
+}
+
+func (u *User) addCap(name string) {
+	u.Lock()
+	u.caps[name] = struct{}{}
+	u.Unlock()
+}
+
+func (u *User) delCap(name string) {
+	u.Lock()
+	delete(u.caps, name)
+	u.Unlock()
+}
+
+// capLSVersion returns the highest version which the User gave to CAP LS.
+func (u *User) capLSVersion() int {
+	u.RLock()
+	defer u.RUnlock()
+	return u.capVersion
+}
+
+// raiseCapVersion records the version given to CAP LS, if it's higher than a
+// previous one, and returns the highest.
+func (u *User) raiseCapVersion(v int) int {
+	u.Lock()
+	defer u.Unlock()
+	if v > u.capVersion {
+		u.capVersion = v
+	}
+	return u.capVersion
+}
+
+// LastActive returns when the User last sent a message, other than PING or
+// PONG.
+func (u *User) LastActive() time.Time {
+	u.RLock()
+	defer u.RUnlock()
+	return u.lastActive
+}
+
+// lastReceived returns when a message was last received from the User.
+func (u *User) lastReceived() time.Time {
+	u.RLock()
+	defer u.RUnlock()
+	return u.lastRecv
+}
+
+// Lag returns the round trip time of the last PING from the server which the
+// User answered with a PONG.
+func (u *User) Lag() time.Duration {
+	u.RLock()
+	defer u.RUnlock()
+	return u.lag
+}
+
+// sentPing records that a PING with the token was sent to the User.
+func (u *User) sentPing(token string, at time.Time) {
+	u.Lock()
+	u.pingToken = token
+	u.pingSent = at
+	u.Unlock()
+}
+
+// receivedPong matches a PONG from the User with the outstanding PING, and
+// records the lag. Returns whether it matched.
+func (u *User) receivedPong(token string, at time.Time) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.pingSent.IsZero() || token != u.pingToken {
+		return false
+	}
+	u.lag = at.Sub(u.pingSent)
+	u.pingToken = ""
+	u.pingSent = time.Time{}
+	return true
+}
+
+// Away returns the away message of the User, or empty if they're not away.
+func (u *User) Away() string {
+	u.RLock()
+	defer u.RUnlock()
+	return u.away
+}
+
+// Account returns the name of the account which the User is logged into, or
+// an empty string.
+func (u *User) Account() string {
+	u.RLock()
+	defer u.RUnlock()
+	return u.account
+}
+
+// SetAway marks the User as away with the message, or as back if it's empty.
+func (u *User) SetAway(msg string) {
+	u.Lock()
+	u.away = msg
+	u.autoAway = false
+	u.Unlock()
+}
+
+// touch records activity from the User, and clears their away message if it
+// was set for being idle. Returns whether it was cleared.
+func (u *User) touch() bool {
+	u.Lock()
+	defer u.Unlock()
+	u.lastActive = time.Now()
+	if !u.autoAway {
+		return false
+	}
+	u.away = ""
+	u.autoAway = false
+	return true
+}
+
+// idleAway marks the User as away with the message if they're not away yet
+// and haven't been active since the given time. Returns whether it was set.
+func (u *User) idleAway(msg string, since time.Time) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.away != "" || u.lastActive.After(since) {
+		return false
+	}
+	u.away = msg
+	u.autoAway = true
+	return true
+}
+
+// nickChange records a NICK command from the User at now, unless they have
+// already sent max of them within the window. Otherwise it returns how long
+// until the oldest of them expires.
+func (u *User) nickChange(now time.Time, max int, window time.Duration) time.Duration {
+	u.Lock()
+	defer u.Unlock()
+	recent := u.nickChanges[:0]
+	for _, t := range u.nickChanges {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	u.nickChanges = recent
+	if len(recent) >= max {
+		return window - now.Sub(recent[0])
+	}
+	u.nickChanges = append(u.nickChanges, now)
+	return 0
+}
+
+// addCorrespondent records that the User exchanged private messages with
+// the other User.
+func (u *User) addCorrespondent(other *User) {
+	if other == u {
+		return
+	}
+	u.Lock()
+	u.correspondents[other] = struct{}{}
+	u.Unlock()
+}
+
+// delCorrespondent forgets the other User, such as once they're gone.
+func (u *User) delCorrespondent(other *User) {
+	u.Lock()
+	delete(u.correspondents, other)
+	u.Unlock()
+}
+
+// Correspondents returns the Users who exchanged private messages with the
+// User.
+func (u *User) Correspondents() []*User {
+	u.RLock()
+	users := make([]*User, 0, len(u.correspondents))
+	for other := range u.correspondents {
+		users = append(users, other)
+	}
+	u.RUnlock()
+	return users
+}
+
+// addSilence adds a mask to the User's silence list, unless it's already
+// there or the list is full.
+func (u *User) addSilence(mask string) bool {
+	u.Lock()
+	defer u.Unlock()
+	if len(u.silence) >= maxSilence {
+		return false
+	}
+	for _, m := range u.silence {
+		if strings.EqualFold(m, mask) {
+			return false
+		}
+	}
+	u.silence = append(u.silence, mask)
+	return true
+}
+
+// delSilence removes a mask from the User's silence list.
+func (u *User) delSilence(mask string) bool {
+	u.Lock()
+	defer u.Unlock()
+	for i, m := range u.silence {
+		if strings.EqualFold(m, mask) {
+			u.silence = append(u.silence[:i], u.silence[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) silenceList() []string {
+	u.RLock()
+	defer u.RUnlock()
+	return append([]string(nil), u.silence...)
+}
+
+// silenced returns whether messages from the other User should be dropped
+// rather than delivered to this User.
+func (u *User) silenced(from *User) bool {
+	// Resolve the prefix before locking, since from may be this User.
+	prefix := from.Prefix().String()
+	for _, mask := range u.silenceList() {
+		if MatchMask(mask, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *User) Close() error {
+	u.RLock()
+	channels := make([]Channel, 0, len(u.channels))
 	for ch := range u.channels {
+		channels = append(channels, ch)
+	}
+	u.RUnlock()
+	for _, ch := range channels {
 		ch.Part(u, defaultCloseMsg)
 	}
 	return u.Conn.Close()
@@ -79,6 +501,16 @@ func (u *User) Channels() []Channel {
 	return channels
 }
 
+// NotifySeen sends a message from the User to each of the other Users who
+// share a channel with them, once.
+func (u *User) NotifySeen(msg *irc.Message) {
+	for _, other := range u.VisibleTo() {
+		other.relay(u, msg)
+	}
+}
+
+// VisibleTo returns the other Users who share a channel with the User,
+// excluding the User themselves.
 func (u *User) VisibleTo() []*User {
 	seen := map[*User]struct{}{}
 	seen[u] = struct{}{}
@@ -112,21 +544,191 @@ func (u *User) VisibleTo() []*User {
 
 // Encode and send each msg until an error occurs, then returns.
 func (user *User) Encode(msgs ...*irc.Message) (err error) {
+	return user.EncodeTags(nil, msgs...)
+}
+
+// EncodeTags sends each msg with the given tags until an error occurs, then
+// returns. Tags are dropped if the Conn is not a TagConn.
+//
+// Messages which exceed MaxMessageLen are split (PRIVMSG and NOTICE) or
+// truncated (numeric replies) to fit.
+//
+// While a labeled command of the User is being handled, the messages are
+// buffered as its responses.
+func (user *User) EncodeTags(tags Tags, msgs ...*irc.Message) error {
+	return user.encode(true, tags, msgs...)
+}
+
+// notify is like EncodeTags for messages which aren't responses to the User's
+// own command, such as ones from other Users or from the server's timers.
+// They're sent right away, without the label of a command being handled.
+func (user *User) notify(tags Tags, msgs ...*irc.Message) error {
+	return user.encode(false, tags, msgs...)
+}
+
+// encodeFrom sends messages caused by a User, which are only responses if
+// it's this User. A nil User is the server.
+func (user *User) encodeFrom(from *User, tags Tags, msgs ...*irc.Message) error {
+	return user.encode(from == user, tags, msgs...)
+}
+
+// encode sends the messages, or buffers them if they're responses and a
+// labeled command is being handled.
+func (user *User) encode(response bool, tags Tags, msgs ...*irc.Message) (err error) {
+	user.Lock()
+	if response && user.labeling {
+		for _, msg := range msgs {
+			user.labeled = append(user.labeled, taggedMessage{tags, msg})
+		}
+		user.Unlock()
+		return nil
+	}
+	user.Unlock()
+
+	user.encodeMu.Lock()
+	defer user.encodeMu.Unlock()
+	tc, ok := user.Conn.(TagConn)
+	if !ok || len(tags) == 0 {
+		tc = nil
+	}
 	for _, msg := range msgs {
-		logger.Debugf("-> %s", msg)
-		err := user.Conn.Encode(msg)
-		if err != nil {
-			return err
+		for _, msg := range fitMessage(msg) {
+			sent := tags
+			if tc != nil {
+				err = tc.EncodeTags(tags, msg)
+			} else {
+				err = user.Conn.Encode(msg)
+				sent = nil
+			}
+			if err != nil {
+				return err
+			}
+			user.logLine("->", sent, msg)
+			atomic.AddUint64(&user.bytesSent, lineLen(sent, msg))
 		}
 	}
 	return nil
 }
 
+// startLabel begins buffering responses for a labeled command.
+func (user *User) startLabel() {
+	user.Lock()
+	user.labeling = true
+	user.labeled = nil
+	user.Unlock()
+}
+
+// isLabeling returns whether responses are being buffered for a labeled
+// command.
+func (user *User) isLabeling() bool {
+	user.RLock()
+	defer user.RUnlock()
+	return user.labeling
+}
+
+// endLabel sends the buffered responses with the label, as a labeled-response
+// batch if there is more than one, or an ACK if there are none.
+func (user *User) endLabel(from Prefixer, label string) error {
+	user.Lock()
+	responses := user.labeled
+	user.labeling = false
+	user.labeled = nil
+	user.Unlock()
+
+	switch len(responses) {
+	case 0:
+		return user.EncodeTags(Tags{"label": label}, &irc.Message{
+			Prefix:  from.Prefix(),
+			Command: cmdAck,
+		})
+	case 1:
+		tags := Tags{"label": label}
+		for k, v := range responses[0].tags {
+			tags[k] = v
+		}
+		return user.EncodeTags(tags, responses[0].msg)
+	}
+	return user.encodeBatch(false, from, batchLabeledResponse, Tags{"label": label}, responses)
+}
+
+// relay sends messages which originate from another User, adding the tags
+// that this User has negotiated.
+func (user *User) relay(from *User, msgs ...*irc.Message) error {
+	return user.encodeFrom(from, user.relayTags(from), msgs...)
+}
+
+// relayMsg is like relay for a single message with an ID, which is sent as the
+// msgid tag if the User negotiated message-tags.
+func (user *User) relayMsg(from *User, msgid string, msg *irc.Message) error {
+	tags := user.relayTags(from)
+	if user.HasCap(CapMessageTags) {
+		if tags == nil {
+			tags = Tags{}
+		}
+		tags["msgid"] = msgid
+	}
+	return user.encodeFrom(from, tags, msg)
+}
+
+// relayTags returns the tags which the User negotiated for messages from
+// another User.
+func (user *User) relayTags(from *User) Tags {
+	if account := from.Account(); account != "" && user.HasCap(CapAccountTag) {
+		return Tags{"account": account}
+	}
+	return nil
+}
+
 // Decode will receive and return a decoded message, or an error.
 func (user *User) Decode() (*irc.Message, error) {
-	msg, err := user.Conn.Decode()
+	_, msg, err := user.DecodeTags()
+	return msg, err
+}
+
+// DecodeTags will receive and return a decoded message along with its tags,
+// or an error. Tags are always nil if the Conn is not a TagConn.
+func (user *User) DecodeTags() (tags Tags, msg *irc.Message, err error) {
+	if tc, ok := user.Conn.(TagConn); ok {
+		tags, msg, err = tc.DecodeTags()
+	} else {
+		msg, err = user.Conn.Decode()
+	}
+	if err == nil {
+		user.Lock()
+		user.lastRecv = time.Now()
+		user.Unlock()
+	}
 	if err == nil && msg != nil {
-		logger.Debugf("<- %s", msg)
+		atomic.AddUint64(&user.bytesRecv, lineLen(tags, msg))
+		user.logLine("<-", tags, msg)
 	}
-	return msg, err
+	return tags, msg, err
+}
+
+// logLine logs a line sent to or received from the User at debug level, and
+// copies it to the raw log if there is one.
+func (user *User) logLine(dir string, tags Tags, msg *irc.Message) {
+	line := msg.String()
+	if len(tags) > 0 {
+		line = "@" + tags.String() + " " + line
+	}
+	id := user.logID()
+	logger.Debugf("%s%s %s %s", user.logPrefix, id, dir, line)
+	if user.rawLog != nil {
+		io.WriteString(user.rawLog, user.logPrefix+id+" "+dir+" "+line+"\n")
+	}
+}
+
+// logID identifies the User in logs by their ID, or by their address until
+// they've picked a nick.
+func (user *User) logID() string {
+	user.RLock()
+	defer user.RUnlock()
+	if user.Nick != "" {
+		return strings.ToLower(user.Nick)
+	}
+	if user.ip != "" {
+		return user.ip
+	}
+	return user.realHost
 }
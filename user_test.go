@@ -1,8 +1,14 @@
 package irckit
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/sorcix/irc"
 )
@@ -11,6 +17,9 @@ type mockConn struct {
 	send    chan *irc.Message
 	receive chan *irc.Message
 	host    string
+
+	mu   sync.Mutex
+	tags map[*irc.Message]Tags
 }
 
 func (conn *mockConn) Close() error {
@@ -23,13 +32,50 @@ func (conn *mockConn) Encode(msg *irc.Message) error {
 }
 
 func (conn *mockConn) Decode() (*irc.Message, error) {
-	return <-conn.receive, nil
+	msg, ok := <-conn.receive
+	if !ok {
+		return nil, io.EOF
+	}
+	return msg, nil
 }
 
 func (conn *mockConn) ResolveHost() string {
 	return conn.host
 }
 
+func (conn *mockConn) EncodeTags(tags Tags, msg *irc.Message) error {
+	conn.setTags(msg, tags)
+	return conn.Encode(msg)
+}
+
+func (conn *mockConn) DecodeTags() (Tags, *irc.Message, error) {
+	msg, err := conn.Decode()
+	return conn.Tags(msg), msg, err
+}
+
+// Tags returns the tags that msg was sent or received with.
+func (conn *mockConn) Tags(msg *irc.Message) Tags {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.tags[msg]
+}
+
+func (conn *mockConn) setTags(msg *irc.Message, tags Tags) {
+	conn.mu.Lock()
+	if conn.tags == nil {
+		conn.tags = map[*irc.Message]Tags{}
+	}
+	conn.tags[msg] = tags
+	conn.mu.Unlock()
+}
+
+// receiveLine queues a raw line, including tags, to be decoded.
+func (conn *mockConn) receiveLine(line string) {
+	tags, msg := parseLine(line)
+	conn.setTags(msg, tags)
+	conn.receive <- msg
+}
+
 func NewConnMock(host string, capacity int) *mockConn {
 	return &mockConn{
 		send:    make(chan *irc.Message, capacity),
@@ -64,3 +110,182 @@ func TestUserMock(t *testing.T) {
 		t.Errorf("got %v; want %v", msg, expect)
 	}
 }
+
+func TestUserSet(t *testing.T) {
+	u := NewUser(NewConnMock("client", 1))
+	u.Set("foo", "root", "Foo Bar", "example.com")
+	u.Set("baz", "", "", "")
+
+	got := []string{u.Nick, u.User, u.Real, u.Host}
+	want := []string{"baz", "root", "Foo Bar", "example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestUserSetConcurrent(t *testing.T) {
+	// Run with -race: the identity is read while it's being changed.
+	u := NewUser(NewConnMock("client", 1))
+	u.Set("foo", "root", "Foo Bar", "example.com")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			u.Set("baz", "", "", "example.org")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		u.Prefix()
+		u.ID()
+		u.RealHost()
+	}
+	<-done
+}
+
+func TestUserSilencedSelf(t *testing.T) {
+	u := NewUser(NewConnMock("client", 1))
+	u.Set("foo", "root", "Foo Bar", "example.com")
+	u.addSilence("baz!*@*")
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			u.SetOper(i%2 == 0)
+		}
+	}()
+	silenced := false
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			silenced = silenced || u.silenced(u)
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(expectTimeout):
+		t.Fatal("deadlocked checking the silence list")
+	}
+	if silenced {
+		t.Error("expected own messages not to be silenced")
+	}
+}
+
+// bufConn is a Conn which writes to a buffer without any locking of its own.
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (conn *bufConn) Encode(msg *irc.Message) error {
+	conn.Write(msg.Bytes())
+	_, err := conn.Write(crlf)
+	return err
+}
+
+func (conn *bufConn) Close() error {
+	return nil
+}
+
+func (conn *bufConn) Decode() (*irc.Message, error) {
+	return nil, io.EOF
+}
+
+func (conn *bufConn) ResolveHost() string {
+	return "bufhost"
+}
+
+func TestUserConcurrentEncode(t *testing.T) {
+	conn := &bufConn{}
+	u := NewUser(conn)
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprint(i)
+			u.Encode(
+				&irc.Message{Command: irc.PRIVMSG, Params: []string{"#chat"}, Trailing: id + " first"},
+				&irc.Message{Command: irc.PRIVMSG, Params: []string{"#chat"}, Trailing: id + " second"},
+			)
+		}(i)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(conn.String(), "\r\n"), "\r\n")
+	if len(lines) != 2*n {
+		t.Fatalf("got %d lines; want %d", len(lines), 2*n)
+	}
+	for i := 0; i < len(lines); i += 2 {
+		first, second := irc.ParseMessage(lines[i]), irc.ParseMessage(lines[i+1])
+		if first == nil || second == nil {
+			t.Fatalf("malformed lines: %q, %q", lines[i], lines[i+1])
+		}
+		id := strings.Fields(first.Trailing)[0]
+		if first.Trailing != id+" first" || second.Trailing != id+" second" {
+			t.Errorf("interleaved messages: %q, %q", lines[i], lines[i+1])
+		}
+	}
+}
+
+func TestUserByteCounters(t *testing.T) {
+	send, receive := make(chan *irc.Message, 2), make(chan *irc.Message, 2)
+	u := NewUserMock(send, receive)
+
+	u.Encode(&irc.Message{Command: irc.PING, Trailing: "one"}) // "PING :one\r\n"
+	u.EncodeTags(Tags{"label": "x"}, &irc.Message{Command: irc.PING, Trailing: "two"})
+	if got, want := u.BytesSent(), uint64(11+20); got != want {
+		t.Errorf("got %d bytes sent; want %d", got, want)
+	}
+
+	receive <- &irc.Message{Command: irc.PONG, Trailing: "one"}
+	u.Decode()
+	if got, want := u.BytesReceived(), uint64(11); got != want {
+		t.Errorf("got %d bytes received; want %d", got, want)
+	}
+}
+
+func TestUserNotifySeen(t *testing.T) {
+	srv := NewServer(testServerName)
+	defer srv.Close()
+
+	conns := map[string]*mockConn{}
+	users := map[string]*User{}
+	for _, nick := range []string{"foo", "baz", "qux", "quux"} {
+		conns[nick] = NewConnMock(nick+"host", 20)
+		users[nick] = NewUser(conns[nick])
+		users[nick].Nick = nick
+	}
+	// baz shares both channels with foo, qux shares one and quux none.
+	chat, dev := srv.Channel("#chat"), srv.Channel("#dev")
+	for _, nick := range []string{"foo", "baz", "qux"} {
+		chat.Join(users[nick])
+	}
+	for _, nick := range []string{"foo", "baz"} {
+		dev.Join(users[nick])
+	}
+	srv.Channel("#other").Join(users["quux"])
+	for _, c := range conns {
+	drain:
+		for {
+			select {
+			case <-c.send:
+			default:
+				break drain
+			}
+		}
+	}
+
+	users["foo"].NotifySeen(&irc.Message{Prefix: users["foo"].Prefix(), Command: irc.NICK, Params: []string{"foo_"}})
+	for nick, want := range map[string]int{"foo": 0, "baz": 1, "qux": 1, "quux": 0} {
+		if got := len(conns[nick].send); got != want {
+			t.Errorf("%s got %d messages; want %d", nick, got, want)
+		}
+	}
+}